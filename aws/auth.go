@@ -1,6 +1,7 @@
 package aws
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
@@ -13,6 +14,9 @@ var (
 	awsConfPath       = "/.aws/"
 	awsConfigFile     = "config"
 	awsCredentialFile = "credentials"
+
+	// Silo Vars
+	siloConfPath = "/.silo/"
 )
 
 // isError - Checks for error
@@ -37,6 +41,16 @@ func isFile(filePath string) string {
 	return filePath
 }
 
+// printJSON - Print v as indented JSON so the output can be parsed by scripts
+func printJSON(v interface{}) {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	fmt.Println(string(out))
+}
+
 // UserHomeDir - Determine the user home path depends on OS Type
 func UserHomeDir() string {
 	if runtime.GOOS == "windows" {
@@ -49,6 +63,11 @@ func UserHomeDir() string {
 	return os.Getenv("HOME")
 }
 
+// siloDir - Directory holding silo's local state such as upload journals
+func siloDir() string {
+	return filepath.Join(UserHomeDir(), siloConfPath)
+}
+
 // userInputConfigs -  Request the user input for aws credentionas and configurations
 func userInputConfigs() (string, string, string, string) {
 	fmt.Print("AWS Access Key ID: ")
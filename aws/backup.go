@@ -0,0 +1,504 @@
+package aws
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// BackupOptions - Settings of a backup run
+type BackupOptions struct {
+	// Sources are directories, files or glob patterns to archive
+	Sources []string
+	// To is glacier://vault or s3://bucket/prefix
+	To string
+	// Name of the archive, defaults to the first source and the time
+	Name string
+	// Upload tunes Glacier uploads, S3 tunes S3 uploads
+	Upload UploadOptions
+	S3     S3UploadOptions
+	// Compress compresses the tar stream before it is uploaded
+	Compress CompressOptions
+	// Encrypt encrypts the archive and its manifest before they leave the host
+	Encrypt EncryptOptions
+	// Incremental only archives what changed since the last successful run
+	Incremental bool
+	// FullEvery starts a new full backup once a chain holds that many backups,
+	// 0 never does
+	FullEvery int
+}
+
+// backupTarget - Parsed destination of a backup
+type backupTarget struct {
+	vault  string
+	bucket string
+	prefix string
+}
+
+// parseBackupTarget - Understand glacier://vault and s3://bucket/prefix destinations
+func parseBackupTarget(to string) (*backupTarget, error) {
+	switch {
+	case strings.HasPrefix(to, "glacier://"):
+		vault := strings.Trim(strings.TrimPrefix(to, "glacier://"), "/")
+		if vault == "" || strings.Contains(vault, "/") {
+			return nil, fmt.Errorf("destination %q must look like glacier://vault", to)
+		}
+		return &backupTarget{vault: vault}, nil
+	case strings.HasPrefix(to, "s3://"):
+		bucket, prefix, err := parseS3URL(to)
+		if err != nil {
+			return nil, err
+		}
+		return &backupTarget{bucket: bucket, prefix: prefix}, nil
+	}
+	return nil, fmt.Errorf("destination %q must be glacier://vault or s3://bucket/prefix", to)
+}
+
+// key - S3 key of a backup file below the prefix
+func (t *backupTarget) key(name string) string {
+	if prefix := strings.TrimSuffix(t.prefix, "/"); prefix != "" {
+		return prefix + "/" + name
+	}
+	return name
+}
+
+// ManifestEntry - One path stored in a backup archive
+type ManifestEntry struct {
+	Path    string      `json:"path"`
+	Type    string      `json:"type"`
+	Mode    os.FileMode `json:"mode"`
+	Size    int64       `json:"size"`
+	SHA256  string      `json:"sha256,omitempty"`
+	Link    string      `json:"link,omitempty"`
+	ModTime time.Time   `json:"modTime"`
+	UID     int         `json:"uid"`
+	GID     int         `json:"gid"`
+}
+
+// BackupManifest - What a backup archive holds and where it went. Incremental
+// backups name their Parent, the Chain of backups to replay from the full one up to
+// this one, and the paths Deleted or changed in type since the parent.
+type BackupManifest struct {
+	Name        string          `json:"name"`
+	Destination string          `json:"destination"`
+	Sources     []string        `json:"sources"`
+	Created     time.Time       `json:"created"`
+	ArchiveID   string          `json:"archiveId,omitempty"`
+	Key         string          `json:"key,omitempty"`
+	Size        int64           `json:"size"`
+	TreeHash    string          `json:"treeHash,omitempty"`
+	SHA256      string          `json:"sha256,omitempty"`
+	Compression string          `json:"compression,omitempty"`
+	Encryption  string          `json:"encryption,omitempty"`
+	KeyIDs      []string        `json:"keyIds,omitempty"`
+	Parent      string          `json:"parent,omitempty"`
+	Chain       []string        `json:"chain,omitempty"`
+	Deleted     []string        `json:"deleted,omitempty"`
+	Files       []ManifestEntry `json:"files"`
+}
+
+// expandSources - Resolve glob patterns and make every source absolute
+func expandSources(patterns []string) ([]string, error) {
+	var sources []string
+	for _, pattern := range patterns {
+		matches := []string{pattern}
+		if strings.ContainsAny(pattern, "*?[") {
+			var err error
+			if matches, err = filepath.Glob(pattern); err != nil {
+				return nil, fmt.Errorf("source %q: %v", pattern, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("source %q matches nothing", pattern)
+			}
+		}
+		for _, match := range matches {
+			abs, err := filepath.Abs(match)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := os.Lstat(abs); err != nil {
+				return nil, err
+			}
+			sources = append(sources, abs)
+		}
+	}
+	return sources, nil
+}
+
+// tarName - Name of a path inside the archive: the absolute path without its leading
+// slash, the way GNU tar stores it
+func tarName(path string) string {
+	return strings.TrimPrefix(filepath.ToSlash(path), "/")
+}
+
+// tarBuilder - Writes files into a tar stream and records each one in the manifest.
+// Regular files unchanged since prev are left out of the stream.
+type tarBuilder struct {
+	tw      *tar.Writer
+	links   map[[2]uint64]string
+	entries []ManifestEntry
+	prev    map[string]fileState
+	state   map[string]fileState
+}
+
+// newTarBuilder - Start a tar stream on w
+func newTarBuilder(w io.Writer) *tarBuilder {
+	return &tarBuilder{tw: tar.NewWriter(w), links: map[[2]uint64]string{}, state: map[string]fileState{}}
+}
+
+// addSource - Walk a source without following symlinks and add everything below it
+func (b *tarBuilder) addSource(source string) error {
+	return filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return b.addPath(path, info)
+	})
+}
+
+// addPath - Add one file, directory, symlink or hard link with its ownership,
+// permissions and extended attributes
+func (b *tarBuilder) addPath(path string, info os.FileInfo) error {
+	if info.Mode()&os.ModeSocket != 0 {
+		fmt.Fprintf(os.Stderr, "skipping socket %s\n", path)
+		return nil
+	}
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	hdr.Name = tarName(path)
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	// PAX keeps sub-second times, long names and the xattr records
+	hdr.Format = tar.FormatPAX
+	if info.Mode()&os.ModeSymlink == 0 {
+		attrs, err := readXattrs(path)
+		if err != nil {
+			return fmt.Errorf("%s: xattrs: %v", path, err)
+		}
+		for name, value := range attrs {
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = map[string]string{}
+			}
+			hdr.PAXRecords["SCHILY.xattr."+name] = value
+		}
+	}
+
+	entry := ManifestEntry{
+		Path:    hdr.Name,
+		Mode:    info.Mode(),
+		ModTime: info.ModTime().UTC(),
+		UID:     hdr.Uid,
+		GID:     hdr.Gid,
+	}
+	switch {
+	case info.IsDir():
+		entry.Type = "dir"
+	case info.Mode()&os.ModeSymlink != 0:
+		entry.Type, entry.Link = "symlink", link
+	case info.Mode().IsRegular():
+		entry.Type, entry.Size = "file", info.Size()
+		if dev, ino, nlink, ok := fileID(info); ok && nlink > 1 {
+			id := [2]uint64{dev, ino}
+			if first, seen := b.links[id]; seen {
+				hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeLink, first, 0
+				entry.Type, entry.Link, entry.Size = "hardlink", first, 0
+			} else {
+				b.links[id] = hdr.Name
+			}
+		}
+	default:
+		entry.Type = "special"
+	}
+
+	st := fileState{Type: entry.Type, Mode: entry.Mode, UID: entry.UID, GID: entry.GID, ModTime: entry.ModTime, Size: entry.Size}
+	if _, ino, _, ok := fileID(info); ok {
+		st.Inode = ino
+	}
+	if old, ok := b.prev[hdr.Name]; ok && entry.Type == "file" && old.unchanged(st) {
+		st.SHA256 = old.SHA256
+		b.state[hdr.Name] = st
+		return nil
+	}
+	if err := b.tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if hdr.Typeflag == tar.TypeReg {
+		sum, err := b.copyFile(path, hdr.Size)
+		if err != nil {
+			return err
+		}
+		entry.SHA256 = sum
+	}
+	st.SHA256 = entry.SHA256
+	b.state[hdr.Name] = st
+	b.entries = append(b.entries, entry)
+	return nil
+}
+
+// copyFile - Copy exactly size bytes of a file into the archive and hash them
+func (b *tarBuilder) copyFile(path string, size int64) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.CopyN(b.tw, io.TeeReader(f, h), size); err != nil {
+		if err == io.EOF {
+			err = fmt.Errorf("file shrank while it was archived")
+		}
+		return "", fmt.Errorf("%s: %v", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// close - Write the tar trailer
+func (b *tarBuilder) close() error {
+	return b.tw.Close()
+}
+
+// writeBackupTar - Archive every source into w, leaving out the files unchanged since
+// prev, and return the manifest entries and the state of every path seen
+func writeBackupTar(w io.Writer, sources []string, prev map[string]fileState) ([]ManifestEntry, map[string]fileState, error) {
+	b := newTarBuilder(w)
+	b.prev = prev
+	for _, source := range sources {
+		if err := b.addSource(source); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := b.close(); err != nil {
+		return nil, nil, err
+	}
+	return b.entries, b.state, nil
+}
+
+// backupName - Default archive name: the first source and a UTC timestamp
+func backupName(sources []string, now time.Time) string {
+	base := filepath.Base(sources[0])
+	if base == "/" || base == "." {
+		base = "root"
+	}
+	return fmt.Sprintf("%s-%s.tar", base, now.UTC().Format("20060102T150405Z"))
+}
+
+// manifestPath - Local copy of a backup manifest
+func manifestPath(name string) string {
+	return filepath.Join(siloDir(), "backups", name+".manifest.json")
+}
+
+// saveManifest - Keep a local copy of the manifest next to the other silo state
+func saveManifest(m *BackupManifest, data []byte) error {
+	path := manifestPath(m.Name)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Backup - Stream a tar archive of the sources straight into a Glacier vault or S3
+// prefix without a temporary file, then store a manifest of paths, sizes and hashes
+// alongside it and under ~/.silo/backups.
+func Backup(awsRegion string, opts BackupOptions) {
+	target, err := parseBackupTarget(opts.To)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	if err := opts.Compress.validate(); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	sources, err := expandSources(opts.Sources)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	enc, err := newEncryptor(opts.Encrypt)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	now := time.Now().UTC()
+	name := opts.Name
+	if name == "" {
+		name = backupName(sources, now) + sealedExt(opts.Compress, enc)
+	}
+	manifest := &BackupManifest{
+		Name:        name,
+		Destination: opts.To,
+		Sources:     sources,
+		Created:     now,
+		Compression: opts.Compress.Codec,
+	}
+	if enc != nil {
+		manifest.Encryption, manifest.KeyIDs = enc.algorithm, enc.keyIDs()
+	}
+	var (
+		chain *incrementalState
+		prev  map[string]fileState
+		state map[string]fileState
+	)
+	if opts.Incremental {
+		if chain, err = loadIncrementalState(opts.To, sources); err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		if prev = chain.parent(opts.FullEvery); prev != nil {
+			manifest.Parent = chain.Chain[len(chain.Chain)-1]
+			manifest.Chain = append(append([]string{}, chain.Chain...), name)
+		} else {
+			manifest.Chain = []string{name}
+		}
+	}
+
+	// The tar is produced on one end of a pipe while the uploader consumes the other
+	pr, pw := io.Pipe()
+	tarDone := make(chan error, 1)
+	go func() {
+		entries, seen, err := writeBackupTar(pw, sources, prev)
+		manifest.Files, state = entries, seen
+		pw.CloseWithError(err)
+		tarDone <- err
+	}()
+
+	sess := session.New()
+	var uploadErr error
+	if target.vault != "" {
+		svc := glacier.New(sess, aws.NewConfig().WithRegion(awsRegion))
+		description := archiveDescription(name, opts.Compress.Codec)
+		var body io.Reader = pr
+		if opts.Compress.Codec != "" || enc != nil {
+			sealed, err := sealReader(pr, opts.Compress, enc)
+			if err != nil {
+				pr.CloseWithError(err)
+				<-tarDone
+				fmt.Println(err.Error())
+				return
+			}
+			defer sealed.Close()
+			body = sealed
+		}
+		var upload *ArchiveUpload
+		if upload, uploadErr = uploadArchiveStream(svc, target.vault, description, body, opts.Upload); uploadErr == nil {
+			manifest.ArchiveID, manifest.Size, manifest.TreeHash = upload.ArchiveID, upload.Size, upload.Checksum
+			upload.Compression, upload.Encryption, upload.KeyIDs = manifest.Compression, manifest.Encryption, manifest.KeyIDs
+			if err := catalogRecordUpload(awsRegion, target.vault, description, *upload); err != nil {
+				fmt.Fprintln(os.Stderr, "catalog:", err)
+			}
+		}
+	} else {
+		svc := s3.New(sess, aws.NewConfig().WithRegion(awsRegion))
+		s3opts := opts.S3
+		s3opts.Compress, s3opts.enc = opts.Compress, enc
+		var upload *ObjectUpload
+		if upload, uploadErr = uploadStream(svc, target.bucket, target.key(name), pr, -1, s3opts); uploadErr == nil {
+			manifest.Key, manifest.Size, manifest.SHA256 = upload.Key, upload.Size, upload.SHA256
+		}
+	}
+	// Unblock the tar writer if the upload stopped reading early
+	pr.CloseWithError(uploadErr)
+	tarErr := <-tarDone
+	if tarErr != nil && tarErr != uploadErr {
+		fmt.Println("backup:", tarErr)
+		return
+	}
+	if uploadErr != nil {
+		if target.vault != "" {
+			printGlacierError(uploadErr)
+		} else {
+			printS3Error(uploadErr)
+		}
+		return
+	}
+
+	if prev != nil {
+		manifest.Deleted = chain.deleted(state)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	if err := saveManifest(manifest, data); err != nil {
+		fmt.Fprintln(os.Stderr, "manifest:", err)
+	}
+	// The manifest lists every path, so it is encrypted along with the archive
+	manifestName := name + ".manifest.json" + sealedExt(CompressOptions{}, enc)
+	if target.vault != "" {
+		svc := glacier.New(sess, aws.NewConfig().WithRegion(awsRegion))
+		body := data
+		if enc != nil {
+			var sealed bytes.Buffer
+			if err = sealTo(&sealed, bytes.NewReader(data), CompressOptions{}, enc); err != nil {
+				fmt.Println(err.Error())
+				return
+			}
+			body = sealed.Bytes()
+		}
+		upload, err := uploadArchiveBody(svc, target.vault, manifestName, bytes.NewReader(body))
+		if err != nil {
+			printGlacierError(err)
+			fmt.Printf("backup stored, but its manifest is only kept in %s\n", manifestPath(name))
+			return
+		}
+		if err := catalogRecordUpload(awsRegion, target.vault, manifestName, *upload); err != nil {
+			fmt.Fprintln(os.Stderr, "catalog:", err)
+		}
+	} else {
+		svc := s3.New(sess, aws.NewConfig().WithRegion(awsRegion))
+		s3opts := opts.S3
+		s3opts.enc = enc
+		if _, err := uploadStream(svc, target.bucket, target.key(manifestName), bytes.NewReader(data), int64(len(data)), s3opts); err != nil {
+			printS3Error(err)
+			fmt.Printf("backup stored, but its manifest is only kept in %s\n", manifestPath(name))
+			return
+		}
+	}
+	// Only a backup stored with its manifest may become the parent of the next one
+	if chain != nil {
+		chain.Chain, chain.Files = manifest.Chain, state
+		if err := chain.save(); err != nil {
+			fmt.Fprintln(os.Stderr, "incremental state:", err)
+		}
+	}
+	printJSON(struct {
+		Name      string `json:"name"`
+		ArchiveID string `json:"archiveId,omitempty"`
+		Key       string `json:"key,omitempty"`
+		Size      int64  `json:"size"`
+		Files     int    `json:"files"`
+		Parent    string `json:"parent,omitempty"`
+		Deleted   int    `json:"deleted,omitempty"`
+		Manifest  string `json:"manifest"`
+	}{name, manifest.ArchiveID, manifest.Key, manifest.Size, len(manifest.Files), manifest.Parent, len(manifest.Deleted), manifestPath(name)})
+}
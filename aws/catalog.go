@@ -0,0 +1,344 @@
+package aws
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Catalog layout: one top-level bucket per "region/vault" holding a meta bucket with
+// the date and vault ARN of the last synced inventory, an archives bucket mapping
+// archive ID to CatalogArchive and a deleted bucket mapping archive ID to the time
+// silo deleted it.
+var (
+	catalogFile        = "catalog.db"
+	catalogMeta        = []byte("meta")
+	catalogArchives    = []byte("archives")
+	catalogDeleted     = []byte("deleted")
+	catalogInventoryAt = []byte("inventoryDate")
+	catalogVaultARN    = []byte("vaultARN")
+)
+
+// Archive sources recorded in the catalog
+const (
+	catalogSourceInventory = "inventory"
+	catalogSourceSilo      = "silo"
+)
+
+// CatalogArchive - Archive known to the local catalog
+type CatalogArchive struct {
+	InventoryArchive
+	Source string `json:"Source"`
+}
+
+// openCatalog - Open the catalog database under ~/.silo
+func openCatalog() (*bolt.DB, error) {
+	if err := os.MkdirAll(siloDir(), 0700); err != nil {
+		return nil, err
+	}
+	return bolt.Open(filepath.Join(siloDir(), catalogFile), 0600, &bolt.Options{Timeout: 5 * time.Second})
+}
+
+// catalogKey - Top-level bucket name of a vault
+func catalogKey(awsRegion, vaultName string) []byte {
+	return []byte(awsRegion + "/" + vaultName)
+}
+
+// vaultBuckets - Create or open the buckets of a vault in a writable transaction
+func vaultBuckets(tx *bolt.Tx, awsRegion, vaultName string) (meta, archives, deleted *bolt.Bucket, err error) {
+	vault, err := tx.CreateBucketIfNotExists(catalogKey(awsRegion, vaultName))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if meta, err = vault.CreateBucketIfNotExists(catalogMeta); err != nil {
+		return nil, nil, nil, err
+	}
+	if archives, err = vault.CreateBucketIfNotExists(catalogArchives); err != nil {
+		return nil, nil, nil, err
+	}
+	if deleted, err = vault.CreateBucketIfNotExists(catalogDeleted); err != nil {
+		return nil, nil, nil, err
+	}
+	return meta, archives, deleted, nil
+}
+
+// syncCatalog - Replace the catalog of a vault with a fresh inventory. Archives silo
+// uploaded after the inventory was taken are kept, and archives silo deleted since
+// then stay deleted.
+func syncCatalog(awsRegion, vaultName string, inventory *VaultInventory) error {
+	db, err := openCatalog()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		meta, archives, deleted, err := vaultBuckets(tx, awsRegion, vaultName)
+		if err != nil {
+			return err
+		}
+
+		// Keep silo uploads the inventory cannot know about yet
+		kept := map[string][]byte{}
+		err = archives.ForEach(func(k, v []byte) error {
+			var a CatalogArchive
+			if err := json.Unmarshal(v, &a); err != nil {
+				return err
+			}
+			if a.Source == catalogSourceSilo && a.CreationDate.After(inventory.InventoryDate) {
+				kept[string(k)] = v
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// Tombstones older than the inventory are already reflected in it
+		tombstones := map[string]bool{}
+		var stale [][]byte
+		err = deleted.ForEach(func(k, v []byte) error {
+			var at time.Time
+			if err := at.UnmarshalText(v); err != nil || !at.After(inventory.InventoryDate) {
+				stale = append(stale, k)
+				return nil
+			}
+			tombstones[string(k)] = true
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range stale {
+			if err := deleted.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		vault := tx.Bucket(catalogKey(awsRegion, vaultName))
+		if err := vault.DeleteBucket(catalogArchives); err != nil {
+			return err
+		}
+		if archives, err = vault.CreateBucket(catalogArchives); err != nil {
+			return err
+		}
+		for _, a := range inventory.ArchiveList {
+			if tombstones[a.ArchiveID] {
+				continue
+			}
+			v, err := json.Marshal(CatalogArchive{InventoryArchive: a, Source: catalogSourceInventory})
+			if err != nil {
+				return err
+			}
+			if err := archives.Put([]byte(a.ArchiveID), v); err != nil {
+				return err
+			}
+		}
+		for k, v := range kept {
+			if tombstones[k] {
+				continue
+			}
+			if err := archives.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+
+		date, err := inventory.InventoryDate.MarshalText()
+		if err != nil {
+			return err
+		}
+		if err := meta.Put(catalogInventoryAt, date); err != nil {
+			return err
+		}
+		return meta.Put(catalogVaultARN, []byte(inventory.VaultARN))
+	})
+}
+
+// catalogRecordUpload - Add an archive silo just uploaded to the catalog
+func catalogRecordUpload(awsRegion, vaultName, description string, upload ArchiveUpload) error {
+	db, err := openCatalog()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		_, archives, _, err := vaultBuckets(tx, awsRegion, vaultName)
+		if err != nil {
+			return err
+		}
+		v, err := json.Marshal(CatalogArchive{
+			InventoryArchive: InventoryArchive{
+				ArchiveID:          upload.ArchiveID,
+				ArchiveDescription: description,
+				CreationDate:       time.Now().UTC(),
+				Size:               upload.Size,
+				SHA256TreeHash:     upload.Checksum,
+			},
+			Source: catalogSourceSilo,
+		})
+		if err != nil {
+			return err
+		}
+		return archives.Put([]byte(upload.ArchiveID), v)
+	})
+}
+
+// catalogRecordDelete - Remove an archive silo just deleted and remember the delete
+// until an inventory taken afterwards no longer lists it
+func catalogRecordDelete(awsRegion, vaultName, archiveID string) error {
+	db, err := openCatalog()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		_, archives, deleted, err := vaultBuckets(tx, awsRegion, vaultName)
+		if err != nil {
+			return err
+		}
+		if err := archives.Delete([]byte(archiveID)); err != nil {
+			return err
+		}
+		at, err := time.Now().UTC().MarshalText()
+		if err != nil {
+			return err
+		}
+		return deleted.Put([]byte(archiveID), at)
+	})
+}
+
+// catalogInventoryDate - When the inventory behind the catalog of a vault was taken
+func catalogInventoryDate(tx *bolt.Tx, awsRegion, vaultName string) time.Time {
+	var at time.Time
+	if vault := tx.Bucket(catalogKey(awsRegion, vaultName)); vault != nil {
+		if meta := vault.Bucket(catalogMeta); meta != nil {
+			at.UnmarshalText(meta.Get(catalogInventoryAt))
+		}
+	}
+	return at
+}
+
+// lookupArchive - Find an archive in the catalog of a vault
+func lookupArchive(awsRegion, vaultName, archiveID string) (*CatalogArchive, time.Time, error) {
+	db, err := openCatalog()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer db.Close()
+	var (
+		archive *CatalogArchive
+		at      time.Time
+	)
+	err = db.View(func(tx *bolt.Tx) error {
+		at = catalogInventoryDate(tx, awsRegion, vaultName)
+		vault := tx.Bucket(catalogKey(awsRegion, vaultName))
+		if vault == nil {
+			return fmt.Errorf("no catalog for vault %s, run init-inventory-retrieval and get-inventory first", vaultName)
+		}
+		v := vault.Bucket(catalogArchives).Get([]byte(archiveID))
+		if v == nil {
+			return fmt.Errorf("archive %s is not in the catalog of %s", archiveID, vaultName)
+		}
+		archive = &CatalogArchive{}
+		return json.Unmarshal(v, archive)
+	})
+	if err != nil {
+		return nil, at, err
+	}
+	return archive, at, nil
+}
+
+// CatalogQuery - Filters for listing archives from the catalog
+type CatalogQuery struct {
+	Since time.Time
+	Until time.Time
+	Match string
+}
+
+// queryCatalog - Archives of a vault matching q, oldest first
+func queryCatalog(awsRegion, vaultName string, q CatalogQuery) ([]CatalogArchive, time.Time, error) {
+	if q.Match != "" {
+		if _, err := path.Match(q.Match, ""); err != nil {
+			return nil, time.Time{}, fmt.Errorf("bad pattern %q: %v", q.Match, err)
+		}
+	}
+	db, err := openCatalog()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer db.Close()
+	var (
+		list []CatalogArchive
+		at   time.Time
+	)
+	err = db.View(func(tx *bolt.Tx) error {
+		at = catalogInventoryDate(tx, awsRegion, vaultName)
+		vault := tx.Bucket(catalogKey(awsRegion, vaultName))
+		if vault == nil {
+			return fmt.Errorf("no catalog for vault %s, run init-inventory-retrieval and get-inventory first", vaultName)
+		}
+		return vault.Bucket(catalogArchives).ForEach(func(k, v []byte) error {
+			var a CatalogArchive
+			if err := json.Unmarshal(v, &a); err != nil {
+				return err
+			}
+			if !q.Since.IsZero() && a.CreationDate.Before(q.Since) {
+				return nil
+			}
+			if !q.Until.IsZero() && !a.CreationDate.Before(q.Until) {
+				return nil
+			}
+			if q.Match != "" {
+				if ok, _ := path.Match(q.Match, a.ArchiveDescription); !ok {
+					return nil
+				}
+			}
+			list = append(list, a)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, at, err
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreationDate.Before(list[j].CreationDate)
+	})
+	return list, at, nil
+}
+
+// CatalogListing - Result of a catalog query
+type CatalogListing struct {
+	VaultName     string           `json:"VaultName"`
+	InventoryDate time.Time        `json:"InventoryDate"`
+	ArchiveList   []CatalogArchive `json:"ArchiveList"`
+}
+
+// ListCatalog - List archives of a vault from the local catalog without a new inventory job
+func ListCatalog(awsRegion, vaultName string, q CatalogQuery, output string) {
+	output, err := outputFormat(output)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	list, at, err := queryCatalog(awsRegion, vaultName, q)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	if output == OutputJSON {
+		printJSON(CatalogListing{VaultName: vaultName, InventoryDate: at, ArchiveList: list})
+		return
+	}
+	inventory := &VaultInventory{InventoryDate: at}
+	for _, a := range list {
+		inventory.ArchiveList = append(inventory.ArchiveList, a.InventoryArchive)
+	}
+	if err := writeInventory(os.Stdout, inventory, output); err != nil {
+		fmt.Println(err.Error())
+	}
+}
@@ -0,0 +1,290 @@
+package aws
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/aws/aws-sdk-go/service/glacier/glacieriface"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+const (
+	// CompressGzip - gzip, fast and readable everywhere
+	CompressGzip = "gzip"
+	// CompressZstd - zstd, the best ratio for its speed
+	CompressZstd = "zstd"
+	// CompressXz - xz, the smallest output and the slowest
+	CompressXz = "xz"
+
+	// DecompressAuto - Undo the compression recorded when the data was uploaded
+	DecompressAuto = "auto"
+	// DecompressNone - Keep downloads exactly as they are stored
+	DecompressNone = "none"
+
+	// s3CompressionMetadata - Object metadata naming the codec of a compressed upload
+	s3CompressionMetadata = "Silo-Compression"
+	// descriptionCodecMarker - Glacier descriptions of compressed uploads end with
+	// this marker and the codec name
+	descriptionCodecMarker = " compress="
+)
+
+// codec - Levels and file extension of a compression format
+type codec struct {
+	maxLevel int
+	ext      string
+}
+
+var codecs = map[string]codec{
+	CompressGzip: {maxLevel: gzip.BestCompression, ext: ".gz"},
+	CompressZstd: {maxLevel: 22, ext: ".zst"},
+	CompressXz:   {maxLevel: 9, ext: ".xz"},
+}
+
+// xzDictCaps - Dictionary size of each xz level, the same as the xz presets
+var xzDictCaps = [...]int{8 << 20, 1 << 20, 2 << 20, 4 << 20, 4 << 20, 8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20}
+
+// CompressOptions - Codec and level used to compress uploads
+type CompressOptions struct {
+	// Codec is gzip, zstd or xz; empty uploads the bytes as they are
+	Codec string
+	// Level from 1 up to the codec maximum, 0 picks the codec default
+	Level int
+}
+
+// validate - Check the codec and level
+func (o CompressOptions) validate() error {
+	if o.Codec == "" {
+		if o.Level != 0 {
+			return fmt.Errorf("a compression level needs a codec, use --compress gzip|zstd|xz")
+		}
+		return nil
+	}
+	c, ok := codecs[o.Codec]
+	if !ok {
+		return fmt.Errorf("unknown compression %q, use gzip, zstd or xz", o.Codec)
+	}
+	if o.Level < 0 || o.Level > c.maxLevel {
+		return fmt.Errorf("%s levels go from 1 to %d", o.Codec, c.maxLevel)
+	}
+	return nil
+}
+
+// ext - File extension of the codec, empty without compression
+func (o CompressOptions) ext() string {
+	return codecs[o.Codec].ext
+}
+
+// compressWriter - Encoder writing the compressed form of everything written to it
+// into w. Close flushes the encoder but leaves w open.
+func compressWriter(w io.Writer, opts CompressOptions) (io.WriteCloser, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	switch opts.Codec {
+	case CompressGzip:
+		level := opts.Level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case CompressZstd:
+		level := zstd.SpeedDefault
+		if opts.Level > 0 {
+			level = zstd.EncoderLevelFromZstd(opts.Level)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(level))
+	case CompressXz:
+		return xz.WriterConfig{DictCap: xzDictCaps[opts.Level]}.NewWriter(w)
+	}
+	return nil, fmt.Errorf("no compression selected")
+}
+
+// decompressReader - Decoder for data compressed with codec
+func decompressReader(r io.Reader, codec string) (io.ReadCloser, error) {
+	switch codec {
+	case CompressGzip:
+		return gzip.NewReader(r)
+	case CompressZstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case CompressXz:
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(xr), nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", codec)
+}
+
+// unpackFile - Decrypt and decompress the verified download src into dst, which may
+// be src itself. Encryption is recognized by its header, which must be there when
+// encrypted is set; codec names the compression to undo. The output goes to a
+// temporary file next to dst that replaces it once the whole stream was
+// authenticated and decoded. It returns the size of the output and the cipher, and
+// only renames src when there is nothing to undo.
+func unpackFile(src, dst, codec string, encrypted bool, keys DecryptOptions) (int64, string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, "", err
+	}
+	defer in.Close()
+	br := bufio.NewReader(in)
+	if codec == "" && !encrypted && !encryptedStream(br) {
+		in.Close()
+		if src != dst {
+			return 0, "", os.Rename(src, dst)
+		}
+		return 0, "", nil
+	}
+	r, algorithm, err := unsealReader(br, codec, encrypted, keys)
+	if err != nil {
+		return 0, "", fmt.Errorf("%s: %v", src, err)
+	}
+	defer r.Close()
+	out, err := ioutil.TempFile(filepath.Dir(dst), filepath.Base(dst)+".*.part")
+	if err != nil {
+		return 0, "", err
+	}
+	n, err := io.Copy(out, r)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return 0, "", fmt.Errorf("%s: %v", src, err)
+	}
+	if src != dst {
+		os.Remove(src)
+	}
+	return n, algorithm, nil
+}
+
+// unsealReader - Undo the encryption, recognized by its header, and the compression
+// of r while it is read. It also returns the cipher, empty for data in the clear.
+// When encrypted is set a missing header is an error, so data recorded as encrypted
+// is never taken for plaintext.
+func unsealReader(r io.Reader, codec string, encrypted bool, keys DecryptOptions) (io.ReadCloser, string, error) {
+	br := bufio.NewReader(r)
+	var (
+		out       io.Reader = br
+		algorithm string
+	)
+	if encryptedStream(br) {
+		dr, h, err := decryptReader(br, keys)
+		if err != nil {
+			return nil, "", err
+		}
+		out, algorithm = dr, h.Algorithm
+	} else if encrypted {
+		return nil, "", errNoEncryptionHeader
+	}
+	if codec == "" {
+		return ioutil.NopCloser(out), algorithm, nil
+	}
+	zr, err := decompressReader(out, codec)
+	if err != nil {
+		return nil, "", err
+	}
+	return zr, algorithm, nil
+}
+
+// downloadCodec - Codec to undo on a download given the --decompress setting and the
+// codec recorded at upload time
+func downloadCodec(decompress, recorded string) (string, error) {
+	switch decompress {
+	case "", DecompressAuto:
+		return recorded, nil
+	case DecompressNone:
+		return "", nil
+	}
+	if _, ok := codecs[decompress]; !ok {
+		return "", fmt.Errorf("unknown compression %q, use auto, none, gzip, zstd or xz", decompress)
+	}
+	return decompress, nil
+}
+
+// archiveDescription - Glacier description of an upload. Compressed uploads carry
+// their codec so get-archive can expand them again.
+func archiveDescription(name, codec string) string {
+	if codec == "" {
+		return name
+	}
+	return name + descriptionCodecMarker + codec
+}
+
+// descriptionCodec - Codec recorded in a Glacier archive description
+func descriptionCodec(description string) string {
+	i := strings.LastIndex(description, descriptionCodecMarker)
+	if i < 0 {
+		return ""
+	}
+	codec := description[i+len(descriptionCodecMarker):]
+	if _, ok := codecs[codec]; !ok {
+		return ""
+	}
+	return codec
+}
+
+// descriptionEncrypted - Whether a Glacier archive description names an encrypted upload
+func descriptionEncrypted(description string) bool {
+	if i := strings.LastIndex(description, descriptionCodecMarker); i >= 0 {
+		description = description[:i]
+	}
+	return strings.HasSuffix(description, encryptedExt)
+}
+
+// jobArchiveCodec - Codec of the archive behind a retrieval job, read from the catalog,
+// and whether it was encrypted. Archives missing from the catalog are treated as
+// uncompressed and left to their header for encryption.
+func jobArchiveCodec(svc glacieriface.GlacierAPI, awsRegion, vaultName, jobID string) (string, bool, error) {
+	job, err := svc.DescribeJob(&glacier.DescribeJobInput{
+		AccountId: aws.String("-"),
+		JobId:     aws.String(jobID),
+		VaultName: aws.String(vaultName),
+	})
+	if err != nil {
+		return "", false, err
+	}
+	archive, _, err := lookupArchive(awsRegion, vaultName, aws.StringValue(job.ArchiveId))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v; the download is only expanded with --decompress\n", err)
+		return "", false, nil
+	}
+	return descriptionCodec(archive.ArchiveDescription), descriptionEncrypted(archive.ArchiveDescription), nil
+}
+
+// expandArchiveDownload - Decrypt and decompress a verified Glacier download in place.
+// Partial ranges cannot be decoded on their own and are left alone. encrypted says the
+// archive is recorded as encrypted, so a missing encryption header is an error.
+func expandArchiveDownload(download *ArchiveDownload, codec string, encrypted bool, byteRange string, keys DecryptOptions) error {
+	if byteRange != "" {
+		if codec != "" {
+			fmt.Fprintf(os.Stderr, "%s holds a byte range of %s data and was not decompressed\n", download.File, codec)
+		}
+		return nil
+	}
+	n, algorithm, err := unpackFile(download.File, download.File, codec, encrypted, keys)
+	if err != nil {
+		return fmt.Errorf("%v; the verified download is kept as stored in %s", err, download.File)
+	}
+	if codec != "" || algorithm != "" {
+		download.Compression, download.Encryption, download.ExpandedSize = codec, algorithm, n
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+package aws
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/aws/aws-sdk-go/service/glacier/glacieriface"
+)
+
+const (
+	// DefaultChunkSize - Size of each ranged request in chunked downloads
+	DefaultChunkSize = 64 << 20
+	// DefaultChunkThreshold - Job outputs larger than this are downloaded in chunks
+	DefaultChunkThreshold = 1 << 30
+	// DefaultRetries - Attempts per chunk before the download gives up
+	DefaultRetries = 5
+)
+
+// DownloadOptions - Tuning knobs for archive downloads
+type DownloadOptions struct {
+	// Range restricts the download to "start-end" bytes of the job output
+	Range string
+	// ChunkSize in bytes, a power of two MiB so every chunk is tree-hash aligned
+	ChunkSize int64
+	// Concurrency is the number of chunks in flight
+	Concurrency int
+	// Threshold is the job output size above which chunked download is used
+	Threshold int64
+	// Retries is the number of attempts per chunk
+	Retries int
+	// Decompress is auto, none or a codec to expand the verified download with
+	Decompress string
+	// Keys adds key files to the keyring used to decrypt encrypted archives
+	Keys DecryptOptions
+}
+
+// withDefaults - Fill in zero values
+func (o DownloadOptions) withDefaults() DownloadOptions {
+	if o.ChunkSize <= 0 {
+		o.ChunkSize = DefaultChunkSize
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = DefaultConcurrency
+	}
+	if o.Threshold <= 0 {
+		o.Threshold = DefaultChunkThreshold
+	}
+	if o.Retries <= 0 {
+		o.Retries = DefaultRetries
+	}
+	return o
+}
+
+// parseByteRange - Split a "start-end" range into its inclusive bounds
+func parseByteRange(byteRange string) (int64, int64, error) {
+	parts := strings.SplitN(byteRange, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("range %q must look like start-end", byteRange)
+	}
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("range %q: %v", byteRange, err)
+	}
+	end, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("range %q: %v", byteRange, err)
+	}
+	if start < 0 || end < start {
+		return 0, 0, fmt.Errorf("range %q is empty", byteRange)
+	}
+	return start, end, nil
+}
+
+// validRetrievalRange - Glacier needs retrieval ranges to start on a megabyte boundary.
+// The end must also be megabyte aligned unless it is the last byte of the archive,
+// which can only be checked by Glacier itself.
+func validRetrievalRange(byteRange string) error {
+	start, _, err := parseByteRange(byteRange)
+	if err != nil {
+		return err
+	}
+	if start%treeHashChunk != 0 {
+		return fmt.Errorf("range %q must start on a megabyte boundary", byteRange)
+	}
+	return nil
+}
+
+// jobOutputSize - Number of bytes an archive retrieval job will return
+func jobOutputSize(job *glacier.JobDescription) (int64, error) {
+	if r := aws.StringValue(job.RetrievalByteRange); r != "" {
+		start, end, err := parseByteRange(r)
+		if err != nil {
+			return 0, err
+		}
+		return end - start + 1, nil
+	}
+	return aws.Int64Value(job.ArchiveSizeInBytes), nil
+}
+
+// chunkedDownload - Download the output of a job in tree-hash aligned ranges
+type chunkedDownload struct {
+	svc       glacieriface.GlacierAPI
+	vaultName string
+	jobID     string
+	size      int64
+	opts      DownloadOptions
+}
+
+// fetchChunk - Download one chunk into out at its offset and return its tree hash
+func (d *chunkedDownload) fetchChunk(out io.WriterAt, index int) ([]byte, error) {
+	start := int64(index) * d.opts.ChunkSize
+	end := start + d.opts.ChunkSize - 1
+	if end >= d.size {
+		end = d.size - 1
+	}
+	input := &glacier.GetJobOutputInput{
+		AccountId: aws.String("-"),
+		JobId:     aws.String(d.jobID),
+		Range:     aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+		VaultName: aws.String(d.vaultName),
+	}
+	result, err := d.svc.GetJobOutput(input)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Body.Close()
+
+	th := NewTreeHash()
+	w := io.MultiWriter(io.NewOffsetWriter(out, start), th)
+	if _, err := io.Copy(w, result.Body); err != nil {
+		return nil, err
+	}
+	if th.Size() != end-start+1 {
+		return nil, fmt.Errorf("chunk %d: got %d bytes, expected %d", index, th.Size(), end-start+1)
+	}
+	if err := verifyTreeHash(th.HexSum(), aws.StringValue(result.Checksum)); err != nil {
+		return nil, fmt.Errorf("chunk %d: %v", index, err)
+	}
+	return th.Sum(), nil
+}
+
+// fetchChunkWithRetry - Retry a single chunk with a growing pause between attempts
+func (d *chunkedDownload) fetchChunkWithRetry(out io.WriterAt, index int) ([]byte, error) {
+	var err error
+	for attempt := 1; attempt <= d.opts.Retries; attempt++ {
+		var sum []byte
+		if sum, err = d.fetchChunk(out, index); err == nil {
+			return sum, nil
+		}
+		fmt.Printf("chunk %d attempt %d failed: %v\n", index, attempt, err)
+		time.Sleep(time.Duration(attempt) * 2 * time.Second)
+	}
+	return nil, err
+}
+
+// run - Fetch every chunk and return the tree hash of the whole output
+func (d *chunkedDownload) run(out io.WriterAt) (string, error) {
+	count := partCount(d.size, d.opts.ChunkSize)
+	hashes := make([][]byte, count)
+	jobs := make(chan int)
+	var (
+		mu       sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	for w := 0; w < d.opts.Concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range jobs {
+				sum, err := d.fetchChunkWithRetry(out, index)
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				hashes[index] = sum
+				mu.Unlock()
+			}
+		}()
+	}
+	for index := 0; index < count; index++ {
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+		jobs <- index
+	}
+	close(jobs)
+	wg.Wait()
+	if firstErr != nil {
+		return "", firstErr
+	}
+	return hex.EncodeToString(combineTreeHashes(hashes)), nil
+}
+
+// saveChunked - Download the job output into a preallocated file chunk by chunk.
+// The file only replaces fileName when the combined tree hash matches every checksum.
+func (d *chunkedDownload) saveChunked(fileName string, checksums ...string) (*ArchiveDownload, error) {
+	if err := validPartSize(d.opts.ChunkSize); err != nil {
+		return nil, fmt.Errorf("chunk size: %v", err)
+	}
+	tmp := fileName + ".part"
+	outFile, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	// Truncate leaves a sparse file of the final size so chunks can land in any order
+	err = outFile.Truncate(d.size)
+	var treeHash string
+	if err == nil {
+		treeHash, err = d.run(outFile)
+	}
+	if cerr := outFile.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = verifyTreeHash(treeHash, checksums...)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	if err := os.Rename(tmp, fileName); err != nil {
+		return nil, err
+	}
+	verified := anyChecksum(checksums...)
+	if !verified {
+		warnUnverified(fileName)
+	}
+	return &ArchiveDownload{File: fileName, Size: d.size, TreeHash: treeHash, Verified: verified}, nil
+}
@@ -0,0 +1,895 @@
+package aws
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+const (
+	// EncryptAES256GCM - AES-256 in GCM mode, fastest on CPUs with AES instructions
+	EncryptAES256GCM = "aes-256-gcm"
+	// EncryptChaCha20Poly1305 - ChaCha20-Poly1305, fast everywhere else
+	EncryptChaCha20Poly1305 = "chacha20-poly1305"
+
+	// KeyTypeSymmetric - Key file holding a secret key
+	KeyTypeSymmetric = "symmetric"
+	// KeyTypeX25519 - Key file holding an X25519 identity, its public key is the recipient
+	KeyTypeX25519 = "x25519"
+	// keyTypeScrypt - Key slot opened with a passphrase
+	keyTypeScrypt = "scrypt"
+
+	// PassphraseEnv - Environment variable read before asking for a passphrase
+	PassphraseEnv = "SILO_PASSPHRASE"
+
+	// encMagic - First bytes of every encrypted stream
+	encMagic = "SILOENC1"
+	// encChunkSize - Plaintext bytes sealed together, the unit of authentication
+	encChunkSize = 64 << 10
+	// maxEncHeader - Upper bound on the header so garbage cannot make silo allocate much
+	maxEncHeader = 1 << 20
+	// recipientPrefix - Printable form of an X25519 public key
+	recipientPrefix = "silo-x25519:"
+	// scrypt cost of new passphrase slots, and the most a header may ask for. scrypt
+	// needs 128·N·r bytes, so the limits keep an edited header under 1 GiB of memory.
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	maxScryptN   = 1 << 20
+	maxScryptR   = 8
+	maxScryptP   = 16
+	maxScryptMem = 1 << 30
+
+	// s3EncryptionMetadata - Object metadata naming the cipher of an encrypted upload
+	s3EncryptionMetadata = "Silo-Encryption"
+	// encryptedExt - Extension added to names of encrypted uploads
+	encryptedExt = ".enc"
+)
+
+// errTampered - Any authentication failure of the encrypted data
+var errTampered = errors.New("encrypted data failed authentication: it was modified or truncated")
+
+// errNoEncryptionHeader - Data recorded as encrypted that does not start with the header
+var errNoEncryptionHeader = errors.New("recorded as encrypted but has no encryption header, refusing to read it as plaintext")
+
+// EncryptOptions - How data is encrypted before it leaves the host. Any combination
+// of key file, passphrase and recipients may be given; each one can open the data.
+type EncryptOptions struct {
+	// Algorithm is aes-256-gcm (default) or chacha20-poly1305
+	Algorithm string
+	// KeyFile is a key file made by silo keygen
+	KeyFile string
+	// Passphrase derives a key with scrypt from SILO_PASSPHRASE or a prompt
+	Passphrase bool
+	// Recipients are X25519 public keys, or key files holding them
+	Recipients []string
+}
+
+// enabled - Whether any key was given
+func (o EncryptOptions) enabled() bool {
+	return o.KeyFile != "" || o.Passphrase || len(o.Recipients) > 0
+}
+
+// DecryptOptions - Where to look for keys besides the keyring in ~/.silo/keys
+type DecryptOptions struct {
+	KeyFiles []string
+}
+
+// keyFile - A secret key or X25519 identity as stored on disk
+type keyFile struct {
+	Type       string `json:"type"`
+	KeyID      string `json:"keyId"`
+	Key        []byte `json:"key,omitempty"`
+	PrivateKey []byte `json:"privateKey,omitempty"`
+	PublicKey  string `json:"publicKey,omitempty"`
+}
+
+// keyStanza - One way to open the data key of a stream
+type keyStanza struct {
+	Type       string `json:"type"`
+	KeyID      string `json:"keyId,omitempty"`
+	Salt       []byte `json:"salt,omitempty"`
+	N          int    `json:"n,omitempty"`
+	R          int    `json:"r,omitempty"`
+	P          int    `json:"p,omitempty"`
+	Ephemeral  []byte `json:"ephemeral,omitempty"`
+	Nonce      []byte `json:"nonce"`
+	WrappedKey []byte `json:"wrappedKey"`
+}
+
+// encHeader - Header in front of every encrypted stream. Its hash is authenticated
+// with every chunk, so changing any field breaks the whole stream.
+type encHeader struct {
+	Version   int         `json:"version"`
+	Algorithm string      `json:"algorithm"`
+	ChunkSize int         `json:"chunkSize"`
+	Keys      []keyStanza `json:"keys"`
+}
+
+// keyIDs - IDs of the key files and recipients that can open the stream
+func (h *encHeader) keyIDs() []string {
+	var ids []string
+	for _, k := range h.Keys {
+		if k.KeyID != "" {
+			ids = append(ids, k.KeyID)
+		}
+	}
+	return ids
+}
+
+// newAEAD - Cipher for a 32 byte key
+func newAEAD(algorithm string, key []byte) (cipher.AEAD, error) {
+	switch algorithm {
+	case EncryptAES256GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case EncryptChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	}
+	return nil, fmt.Errorf("unknown cipher %q, use %s or %s", algorithm, EncryptAES256GCM, EncryptChaCha20Poly1305)
+}
+
+// randomBytes - n bytes from the system random source
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// keyID - Short public identifier of key material
+func keyID(material []byte) string {
+	sum := sha256.Sum256(append([]byte("silo key id\x00"), material...))
+	return hex.EncodeToString(sum[:8])
+}
+
+// recipientString - Printable form of an X25519 public key
+func recipientString(pub []byte) string {
+	return recipientPrefix + base64.RawURLEncoding.EncodeToString(pub)
+}
+
+// parseRecipient - Public key from its printable form or from a key file
+func parseRecipient(s string) (*ecdh.PublicKey, error) {
+	if !strings.HasPrefix(s, recipientPrefix) {
+		k, err := loadKeyFile(s)
+		if err != nil {
+			return nil, fmt.Errorf("recipient %q is neither a %s public key nor a key file: %v", s, recipientPrefix, err)
+		}
+		if k.Type != KeyTypeX25519 {
+			return nil, fmt.Errorf("key file %s holds no public key", s)
+		}
+		s = k.PublicKey
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, recipientPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("recipient %q: %v", s, err)
+	}
+	return ecdh.X25519().NewPublicKey(raw)
+}
+
+// keysDir - Keyring searched when encrypted data is read
+func keysDir() string {
+	return filepath.Join(siloDir(), "keys")
+}
+
+// generateKey - New random key file of keyType
+func generateKey(keyType string) (*keyFile, error) {
+	switch keyType {
+	case "", KeyTypeSymmetric:
+		key, err := randomBytes(32)
+		if err != nil {
+			return nil, err
+		}
+		return &keyFile{Type: KeyTypeSymmetric, KeyID: keyID(key), Key: key}, nil
+	case KeyTypeX25519:
+		priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		pub := priv.PublicKey().Bytes()
+		return &keyFile{Type: KeyTypeX25519, KeyID: keyID(pub), PrivateKey: priv.Bytes(), PublicKey: recipientString(pub)}, nil
+	}
+	return nil, fmt.Errorf("unknown key type %q, use %s or %s", keyType, KeyTypeSymmetric, KeyTypeX25519)
+}
+
+// saveKeyFile - Write a key file readable only by its owner
+func saveKeyFile(k *keyFile, path string) error {
+	data, err := json.MarshalIndent(k, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadKeyFile - Read and check a key file
+func loadKeyFile(path string) (*keyFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	k := &keyFile{}
+	if err := json.Unmarshal(data, k); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	switch {
+	case k.Type == KeyTypeSymmetric && len(k.Key) == 32:
+		k.KeyID = keyID(k.Key)
+	case k.Type == KeyTypeX25519 && len(k.PrivateKey) == 32:
+		priv, err := ecdh.X25519().NewPrivateKey(k.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		pub := priv.PublicKey().Bytes()
+		k.KeyID, k.PublicKey = keyID(pub), recipientString(pub)
+	default:
+		return nil, fmt.Errorf("%s is not a silo key file", path)
+	}
+	return k, nil
+}
+
+// loadKeyring - Key files of the keyring and the extra files, by key ID
+func loadKeyring(extra []string) (map[string]*keyFile, error) {
+	keys := map[string]*keyFile{}
+	paths, _ := filepath.Glob(filepath.Join(keysDir(), "*.json"))
+	for _, path := range paths {
+		k, err := loadKeyFile(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "keyring:", err)
+			continue
+		}
+		keys[k.KeyID] = k
+	}
+	for _, path := range extra {
+		k, err := loadKeyFile(path)
+		if err != nil {
+			return nil, err
+		}
+		keys[k.KeyID] = k
+	}
+	return keys, nil
+}
+
+// keyCache - Keys resolved during one command. A repository restore opens many indexes,
+// snapshots and packs; without it each one would reload the keyring, ask for the
+// passphrase and run scrypt again.
+var keyCache struct {
+	sync.Mutex
+	keyrings   map[string]map[string]*keyFile
+	passphrase []byte
+	keks       map[string][]byte
+}
+
+// cachedKeyring - loadKeyring, read once per keyring and set of extra key files
+func cachedKeyring(extra []string) (map[string]*keyFile, error) {
+	keyCache.Lock()
+	defer keyCache.Unlock()
+	id := strings.Join(append([]string{keysDir()}, extra...), "\x00")
+	if keys, ok := keyCache.keyrings[id]; ok {
+		return keys, nil
+	}
+	keys, err := loadKeyring(extra)
+	if err != nil {
+		return nil, err
+	}
+	if keyCache.keyrings == nil {
+		keyCache.keyrings = map[string]map[string]*keyFile{}
+	}
+	keyCache.keyrings[id] = keys
+	return keys, nil
+}
+
+// cachedPassphrase - readPassphrase, typed at most once per command
+func cachedPassphrase(confirm bool) ([]byte, error) {
+	if p := os.Getenv(PassphraseEnv); p != "" {
+		return []byte(p), nil
+	}
+	keyCache.Lock()
+	defer keyCache.Unlock()
+	if keyCache.passphrase != nil {
+		return keyCache.passphrase, nil
+	}
+	p, err := readPassphrase(confirm)
+	if err != nil {
+		return nil, err
+	}
+	keyCache.passphrase = p
+	return p, nil
+}
+
+// forgetPassphrase - Drop a cached passphrase that opened nothing, so it is asked again
+func forgetPassphrase() {
+	keyCache.Lock()
+	keyCache.passphrase = nil
+	keyCache.Unlock()
+}
+
+// scryptKEK - Key encryption key of a passphrase slot, derived once per salt
+func scryptKEK(p []byte, s keyStanza) ([]byte, error) {
+	keyCache.Lock()
+	defer keyCache.Unlock()
+	id := fmt.Sprintf("%x/%x/%d/%d/%d", sha256.Sum256(p), s.Salt, s.N, s.R, s.P)
+	if kek, ok := keyCache.keks[id]; ok {
+		return kek, nil
+	}
+	kek, err := scrypt.Key(p, s.Salt, s.N, s.R, s.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	if keyCache.keks == nil {
+		keyCache.keks = map[string][]byte{}
+	}
+	keyCache.keks[id] = kek
+	return kek, nil
+}
+
+// readPassphrase - Passphrase from SILO_PASSPHRASE, or typed on the terminal without
+// echo. New passphrases are asked twice.
+func readPassphrase(confirm bool) ([]byte, error) {
+	if p := os.Getenv(PassphraseEnv); p != "" {
+		return []byte(p), nil
+	}
+	// The terminal is used directly because stdin may carry the data being uploaded
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("no terminal to ask for the passphrase, set %s", PassphraseEnv)
+	}
+	defer tty.Close()
+	ask := func(prompt string) ([]byte, error) {
+		fmt.Fprint(tty, prompt)
+		p, err := term.ReadPassword(int(tty.Fd()))
+		fmt.Fprintln(tty)
+		return p, err
+	}
+	p, err := ask("Passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if len(p) == 0 {
+		return nil, fmt.Errorf("the passphrase is empty")
+	}
+	if confirm {
+		again, err := ask("Repeat passphrase: ")
+		if err != nil {
+			return nil, err
+		}
+		if string(again) != string(p) {
+			return nil, fmt.Errorf("the passphrases do not match")
+		}
+	}
+	return p, nil
+}
+
+// wrapKey - Seal a data key with a key encryption key
+func wrapKey(kek, dataKey []byte) (nonce, wrapped []byte, err error) {
+	aead, err := newAEAD(EncryptAES256GCM, kek)
+	if err != nil {
+		return nil, nil, err
+	}
+	if nonce, err = randomBytes(aead.NonceSize()); err != nil {
+		return nil, nil, err
+	}
+	return nonce, aead.Seal(nil, nonce, dataKey, []byte(encMagic)), nil
+}
+
+// unwrapKey - Open the data key sealed in a stanza
+func unwrapKey(kek []byte, s keyStanza) ([]byte, error) {
+	aead, err := newAEAD(EncryptAES256GCM, kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.Nonce) != aead.NonceSize() {
+		return nil, errTampered
+	}
+	return aead.Open(nil, s.Nonce, s.WrappedKey, []byte(encMagic))
+}
+
+// x25519KEK - Key encryption key agreed between an ephemeral key and a recipient
+func x25519KEK(shared, ephemeral, recipient []byte) ([]byte, error) {
+	salt := append(append([]byte{}, ephemeral...), recipient...)
+	kek := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte("silo x25519")), kek)
+	return kek, err
+}
+
+// encryptor - Keys resolved once per command, used to seal any number of streams.
+// Every stream gets its own random data key, so nonces never repeat under a key.
+type encryptor struct {
+	algorithm  string
+	keys       []*keyFile
+	passphrase *keyStanza
+	kek        []byte
+	recipients []*ecdh.PublicKey
+}
+
+// newEncryptor - Load key files, parse recipients and ask for the passphrase.
+// It returns nil when no encryption was asked for.
+func newEncryptor(opts EncryptOptions) (*encryptor, error) {
+	if !opts.enabled() {
+		if opts.Algorithm != "" {
+			return nil, fmt.Errorf("a cipher needs a key, use --encrypt-key, --passphrase or --recipient")
+		}
+		return nil, nil
+	}
+	e := &encryptor{algorithm: opts.Algorithm}
+	if e.algorithm == "" {
+		e.algorithm = EncryptAES256GCM
+	}
+	if _, err := newAEAD(e.algorithm, make([]byte, 32)); err != nil {
+		return nil, err
+	}
+	if opts.KeyFile != "" {
+		k, err := loadKeyFile(opts.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if k.Type == KeyTypeX25519 {
+			opts.Recipients = append(opts.Recipients, k.PublicKey)
+		} else {
+			e.keys = append(e.keys, k)
+		}
+	}
+	for _, r := range opts.Recipients {
+		pub, err := parseRecipient(r)
+		if err != nil {
+			return nil, err
+		}
+		e.recipients = append(e.recipients, pub)
+	}
+	if opts.Passphrase {
+		p, err := cachedPassphrase(true)
+		if err != nil {
+			return nil, err
+		}
+		salt, err := randomBytes(16)
+		if err != nil {
+			return nil, err
+		}
+		if e.kek, err = scrypt.Key(p, salt, scryptN, scryptR, scryptP, 32); err != nil {
+			return nil, err
+		}
+		e.passphrase = &keyStanza{Type: keyTypeScrypt, Salt: salt, N: scryptN, R: scryptR, P: scryptP}
+	}
+	return e, nil
+}
+
+// keyIDs - IDs of the key files and recipients streams are sealed for
+func (e *encryptor) keyIDs() []string {
+	var ids []string
+	for _, k := range e.keys {
+		ids = append(ids, k.KeyID)
+	}
+	for _, pub := range e.recipients {
+		ids = append(ids, keyID(pub.Bytes()))
+	}
+	return ids
+}
+
+// newHeader - Fresh data key wrapped for every key, passphrase and recipient
+func (e *encryptor) newHeader() (*encHeader, []byte, error) {
+	dataKey, err := randomBytes(32)
+	if err != nil {
+		return nil, nil, err
+	}
+	h := &encHeader{Version: 1, Algorithm: e.algorithm, ChunkSize: encChunkSize}
+	for _, k := range e.keys {
+		nonce, wrapped, err := wrapKey(k.Key, dataKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		h.Keys = append(h.Keys, keyStanza{Type: KeyTypeSymmetric, KeyID: k.KeyID, Nonce: nonce, WrappedKey: wrapped})
+	}
+	if e.passphrase != nil {
+		s := *e.passphrase
+		if s.Nonce, s.WrappedKey, err = wrapKey(e.kek, dataKey); err != nil {
+			return nil, nil, err
+		}
+		h.Keys = append(h.Keys, s)
+	}
+	for _, pub := range e.recipients {
+		eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		shared, err := eph.ECDH(pub)
+		if err != nil {
+			return nil, nil, err
+		}
+		kek, err := x25519KEK(shared, eph.PublicKey().Bytes(), pub.Bytes())
+		if err != nil {
+			return nil, nil, err
+		}
+		s := keyStanza{Type: KeyTypeX25519, KeyID: keyID(pub.Bytes()), Ephemeral: eph.PublicKey().Bytes()}
+		if s.Nonce, s.WrappedKey, err = wrapKey(kek, dataKey); err != nil {
+			return nil, nil, err
+		}
+		h.Keys = append(h.Keys, s)
+	}
+	return h, dataKey, nil
+}
+
+// writer - Write a fresh header to w and return a writer sealing everything after it
+func (e *encryptor) writer(w io.Writer) (io.WriteCloser, error) {
+	h, dataKey, err := e.newHeader()
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	raw := binary.BigEndian.AppendUint32([]byte(encMagic), uint32(len(body)))
+	raw = append(raw, body...)
+	if _, err := w.Write(raw); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(h.Algorithm, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	ad := sha256.Sum256(raw)
+	return &encryptWriter{w: w, aead: aead, ad: ad[:], buf: make([]byte, 0, h.ChunkSize)}, nil
+}
+
+// chunkNonce - Nonce of a chunk: its counter, and a flag on the last chunk so a
+// stream cut at a chunk boundary is detected
+func chunkNonce(size int, counter uint64, last bool) []byte {
+	nonce := make([]byte, size)
+	binary.BigEndian.PutUint64(nonce[size-9:size-1], counter)
+	if last {
+		nonce[size-1] = 1
+	}
+	return nonce
+}
+
+// encryptWriter - Seals the stream chunk by chunk
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	ad      []byte
+	buf     []byte
+	sealed  []byte
+	counter uint64
+}
+
+// Write - Buffer p and seal every chunk once it is known not to be the last
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(e.buf) == cap(e.buf) {
+			if err := e.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):cap(e.buf)], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// flush - Seal and write the buffered chunk
+func (e *encryptWriter) flush(last bool) error {
+	e.sealed = e.aead.Seal(e.sealed[:0], chunkNonce(e.aead.NonceSize(), e.counter, last), e.buf, e.ad)
+	e.counter++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(e.sealed)
+	return err
+}
+
+// Close - Seal the last chunk, which may be empty, and leave w open
+func (e *encryptWriter) Close() error {
+	return e.flush(true)
+}
+
+// sealReader - Compress then encrypt r on the fly, as asked. Both run in one goroutine
+// writing into a pipe, so memory stays flat. Closing the returned reader early stops it.
+func sealReader(r io.Reader, c CompressOptions, enc *encryptor) (io.ReadCloser, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(sealTo(pw, r, c, enc))
+	}()
+	return pr, nil
+}
+
+// sealTo - Copy r into w through the compressor and the encryptor. Encoders are only
+// built here because some write a header right away.
+func sealTo(w io.Writer, r io.Reader, c CompressOptions, enc *encryptor) error {
+	var closers []io.Closer
+	if enc != nil {
+		ew, err := enc.writer(w)
+		if err != nil {
+			return err
+		}
+		w = ew
+		closers = append(closers, ew)
+	}
+	if c.Codec != "" {
+		zw, err := compressWriter(w, c)
+		if err != nil {
+			return err
+		}
+		w = zw
+		closers = append(closers, zw)
+	}
+	_, err := io.Copy(w, r)
+	// The compressor flushes into the encryptor, so it is closed first
+	for i := len(closers) - 1; i >= 0; i-- {
+		if cerr := closers[i].Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// encryptedStream - Whether a stream starts with the silo encryption header
+func encryptedStream(r *bufio.Reader) bool {
+	magic, err := r.Peek(len(encMagic))
+	return err == nil && string(magic) == encMagic
+}
+
+// readEncHeader - Parse the header and return it with its raw bytes
+func readEncHeader(r io.Reader) (*encHeader, []byte, error) {
+	raw := make([]byte, len(encMagic)+4)
+	if _, err := io.ReadFull(r, raw); err != nil || string(raw[:len(encMagic)]) != encMagic {
+		return nil, nil, fmt.Errorf("not silo encrypted data")
+	}
+	size := binary.BigEndian.Uint32(raw[len(encMagic):])
+	if size > maxEncHeader {
+		return nil, nil, errTampered
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, errTampered
+	}
+	h := &encHeader{}
+	if err := json.Unmarshal(body, h); err != nil {
+		return nil, nil, errTampered
+	}
+	if h.Version != 1 || h.ChunkSize <= 0 || h.ChunkSize > 16<<20 {
+		return nil, nil, fmt.Errorf("unsupported encryption header version %d", h.Version)
+	}
+	return h, append(raw, body...), nil
+}
+
+// validScryptCost - Whether a passphrase slot asks for a cost silo is willing to pay
+func validScryptCost(s keyStanza) bool {
+	if s.N <= 1 || s.N > maxScryptN || s.N&(s.N-1) != 0 {
+		return false
+	}
+	if s.R <= 0 || s.R > maxScryptR || s.P <= 0 || s.P > maxScryptP {
+		return false
+	}
+	return 128*s.N*s.R <= maxScryptMem
+}
+
+// openDataKey - Find a key in the keyring, the extra key files or the passphrase that
+// opens one of the stanzas, and return the data key
+func openDataKey(h *encHeader, keys DecryptOptions) ([]byte, error) {
+	keyring, err := cachedKeyring(keys.KeyFiles)
+	if err != nil {
+		return nil, err
+	}
+	passphrase := false
+	for _, s := range h.Keys {
+		k := keyring[s.KeyID]
+		switch {
+		case s.Type == keyTypeScrypt:
+			// The cost comes from untrusted data, so it is checked before any prompt
+			if !validScryptCost(s) {
+				return nil, fmt.Errorf("passphrase slot: %v", errTampered)
+			}
+			passphrase = true
+		case s.Type == KeyTypeSymmetric && k != nil && k.Type == KeyTypeSymmetric:
+			dataKey, err := unwrapKey(k.Key, s)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: %v", k.KeyID, errTampered)
+			}
+			return dataKey, nil
+		case s.Type == KeyTypeX25519 && k != nil && k.Type == KeyTypeX25519:
+			priv, err := ecdh.X25519().NewPrivateKey(k.PrivateKey)
+			if err != nil {
+				return nil, err
+			}
+			eph, err := ecdh.X25519().NewPublicKey(s.Ephemeral)
+			if err != nil {
+				return nil, errTampered
+			}
+			shared, err := priv.ECDH(eph)
+			if err != nil {
+				return nil, errTampered
+			}
+			kek, err := x25519KEK(shared, s.Ephemeral, priv.PublicKey().Bytes())
+			if err != nil {
+				return nil, err
+			}
+			dataKey, err := unwrapKey(kek, s)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: %v", k.KeyID, errTampered)
+			}
+			return dataKey, nil
+		}
+	}
+	if !passphrase {
+		ids := h.keyIDs()
+		sort.Strings(ids)
+		return nil, fmt.Errorf("no key for this data, it was encrypted for key IDs %s; pass the key file with --key-file", strings.Join(ids, ", "))
+	}
+	p, err := cachedPassphrase(false)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range h.Keys {
+		if s.Type != keyTypeScrypt {
+			continue
+		}
+		kek, err := scryptKEK(p, s)
+		if err != nil {
+			return nil, err
+		}
+		if dataKey, err := unwrapKey(kek, s); err == nil {
+			return dataKey, nil
+		}
+	}
+	forgetPassphrase()
+	return nil, fmt.Errorf("wrong passphrase, or the header was modified")
+}
+
+// decryptReader - Check every chunk of an encrypted stream as it is read. Nothing
+// unauthenticated is ever returned: a bad chunk is an error, and so is a stream that
+// ends before its last chunk or carries anything after it.
+func decryptReader(r io.Reader, keys DecryptOptions) (io.Reader, *encHeader, error) {
+	h, raw, err := readEncHeader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	dataKey, err := openDataKey(h, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := newAEAD(h.Algorithm, dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	ad := sha256.Sum256(raw)
+	return &decryptingReader{
+		r:     r,
+		aead:  aead,
+		ad:    ad[:],
+		chunk: make([]byte, h.ChunkSize+aead.Overhead()),
+	}, h, nil
+}
+
+// decryptingReader - Opens the stream chunk by chunk
+type decryptingReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	ad      []byte
+	chunk   []byte
+	plain   []byte
+	out     []byte
+	counter uint64
+	done    bool
+}
+
+// Read - Hand out plaintext of authenticated chunks only
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+// next - Read and open one chunk. A full chunk is the last one only when it does not
+// open as a middle chunk.
+func (d *decryptingReader) next() error {
+	n, err := io.ReadFull(d.r, d.chunk)
+	short := false
+	switch err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		short = true
+	default:
+		return err
+	}
+	sealed := d.chunk[:n]
+	size := d.aead.NonceSize()
+	if !short {
+		if plain, err := d.aead.Open(d.plain[:0], chunkNonce(size, d.counter, false), sealed, d.ad); err == nil {
+			d.plain, d.out = plain, plain
+			d.counter++
+			return nil
+		}
+	}
+	plain, err := d.aead.Open(d.plain[:0], chunkNonce(size, d.counter, true), sealed, d.ad)
+	if err != nil {
+		return fmt.Errorf("chunk %d: %v", d.counter, errTampered)
+	}
+	d.plain, d.out = plain, plain
+	d.done = true
+	if !short {
+		var extra [1]byte
+		if m, _ := io.ReadFull(d.r, extra[:]); m > 0 {
+			return fmt.Errorf("data after the last chunk: %v", errTampered)
+		}
+	}
+	return nil
+}
+
+// GenerateKey - Create a key file in the keyring under ~/.silo/keys, and copy it to out
+// when given. x25519 keys print the public key that others encrypt to with --recipient.
+func GenerateKey(keyType, out string) {
+	k, err := generateKey(keyType)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	path := filepath.Join(keysDir(), k.KeyID+".json")
+	if err := saveKeyFile(k, path); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	if out != "" {
+		if err := saveKeyFile(k, out); err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		path = out
+	}
+	printJSON(struct {
+		KeyID     string `json:"keyId"`
+		Type      string `json:"type"`
+		File      string `json:"file"`
+		PublicKey string `json:"publicKey,omitempty"`
+	}{k.KeyID, k.Type, path, k.PublicKey})
+}
+
+// sealedExt - Extensions naming what was done to an upload, such as .gz.enc
+func sealedExt(c CompressOptions, enc *encryptor) string {
+	if enc != nil {
+		return c.ext() + encryptedExt
+	}
+	return c.ext()
+}
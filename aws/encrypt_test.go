@@ -0,0 +1,243 @@
+package aws
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testKeyFile - Generate a key of keyType and save it below dir
+func testKeyFile(t *testing.T, dir, keyType string) (*keyFile, string) {
+	t.Helper()
+	k, err := generateKey(keyType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, k.KeyID+".json")
+	if err := saveKeyFile(k, path); err != nil {
+		t.Fatal(err)
+	}
+	return k, path
+}
+
+// sealTest - Encrypt data with the options
+func sealTest(t *testing.T, data []byte, opts EncryptOptions) []byte {
+	t.Helper()
+	enc, err := newEncryptor(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := sealTo(&out, bytes.NewReader(data), CompressOptions{}, enc); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+// openTest - Decrypt everything, or fail
+func openTest(data []byte, encrypted bool, keys DecryptOptions) ([]byte, error) {
+	r, _, err := unsealReader(bytes.NewReader(data), "", encrypted, keys)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// headerLen - Bytes of the encryption header in front of the first chunk
+func headerLen(t *testing.T, data []byte) int {
+	t.Helper()
+	_, raw, err := readEncHeader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(raw)
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	dir := t.TempDir()
+	_, path := testKeyFile(t, dir, KeyTypeSymmetric)
+	keys := DecryptOptions{KeyFiles: []string{path}}
+
+	sizes := []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"one byte short of a chunk", encChunkSize - 1},
+		{"one chunk", encChunkSize},
+		{"one byte over a chunk", encChunkSize + 1},
+		{"several chunks", 3*encChunkSize + 17},
+	}
+	for _, algorithm := range []string{EncryptAES256GCM, EncryptChaCha20Poly1305} {
+		for _, tt := range sizes {
+			t.Run(algorithm+"/"+tt.name, func(t *testing.T) {
+				data := make([]byte, tt.size)
+				rand.Read(data)
+				sealed := sealTest(t, data, EncryptOptions{Algorithm: algorithm, KeyFile: path})
+				got, err := openTest(sealed, true, keys)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, data) {
+					t.Fatalf("got %d bytes back, want the %d sealed", len(got), len(data))
+				}
+			})
+		}
+	}
+}
+
+func TestEncryptTamper(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	dir := t.TempDir()
+	_, path := testKeyFile(t, dir, KeyTypeSymmetric)
+	keys := DecryptOptions{KeyFiles: []string{path}}
+
+	data := make([]byte, 3*encChunkSize+17)
+	rand.Read(data)
+	sealed := sealTest(t, data, EncryptOptions{KeyFile: path})
+	header := headerLen(t, sealed)
+	chunk := encChunkSize + 16
+
+	tests := []struct {
+		name   string
+		mutate func([]byte) []byte
+	}{
+		{"flipped body byte", func(b []byte) []byte {
+			b[header+chunk+100] ^= 1
+			return b
+		}},
+		{"flipped last byte", func(b []byte) []byte {
+			b[len(b)-1] ^= 1
+			return b
+		}},
+		{"flipped header byte", func(b []byte) []byte {
+			b[header-2] ^= 1
+			return b
+		}},
+		{"truncated at a chunk boundary", func(b []byte) []byte {
+			return b[:header+3*chunk]
+		}},
+		{"truncated after the header", func(b []byte) []byte {
+			return b[:header]
+		}},
+		{"truncated inside a chunk", func(b []byte) []byte {
+			return b[:len(b)-5]
+		}},
+		{"trailing data", func(b []byte) []byte {
+			return append(b, 0)
+		}},
+		{"chunks swapped", func(b []byte) []byte {
+			first := append([]byte{}, b[header:header+chunk]...)
+			copy(b[header:], b[header+chunk:header+2*chunk])
+			copy(b[header+chunk:], first)
+			return b
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bad := tt.mutate(append([]byte{}, sealed...))
+			if _, err := openTest(bad, true, keys); err == nil {
+				t.Fatal("modified data was accepted")
+			}
+		})
+	}
+}
+
+func TestEncryptWrongKey(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	dir := t.TempDir()
+	sym, symPath := testKeyFile(t, dir, KeyTypeSymmetric)
+	_, otherPath := testKeyFile(t, dir, KeyTypeSymmetric)
+	id, idPath := testKeyFile(t, dir, KeyTypeX25519)
+	_, otherIDPath := testKeyFile(t, dir, KeyTypeX25519)
+
+	tests := []struct {
+		name    string
+		opts    EncryptOptions
+		keyFile string
+		wantID  string
+	}{
+		{"symmetric key", EncryptOptions{KeyFile: symPath}, otherPath, sym.KeyID},
+		{"recipient", EncryptOptions{Recipients: []string{id.PublicKey}}, otherIDPath, id.KeyID},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sealed := sealTest(t, []byte("customer record"), tt.opts)
+			_, err := openTest(sealed, true, DecryptOptions{KeyFiles: []string{tt.keyFile}})
+			if err == nil {
+				t.Fatal("opened with the wrong key")
+			}
+			if !strings.Contains(err.Error(), tt.wantID) {
+				t.Errorf("error %q does not name key %s", err, tt.wantID)
+			}
+		})
+	}
+
+	sealed := sealTest(t, []byte("customer record"), EncryptOptions{Recipients: []string{id.PublicKey}})
+	got, err := openTest(sealed, true, DecryptOptions{KeyFiles: []string{idPath}})
+	if err != nil || string(got) != "customer record" {
+		t.Fatalf("identity did not open its data: %q %v", got, err)
+	}
+}
+
+func TestEncryptPassphrase(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv(PassphraseEnv, "correct horse")
+	sealed := sealTest(t, []byte("customer record"), EncryptOptions{Passphrase: true})
+	if got, err := openTest(sealed, true, DecryptOptions{}); err != nil || string(got) != "customer record" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	t.Setenv(PassphraseEnv, "battery staple")
+	if _, err := openTest(sealed, true, DecryptOptions{}); err == nil {
+		t.Fatal("opened with the wrong passphrase")
+	}
+}
+
+func TestEncryptMissingHeader(t *testing.T) {
+	plain := []byte("looks like plaintext")
+	if _, err := openTest(plain, true, DecryptOptions{}); !errors.Is(err, errNoEncryptionHeader) {
+		t.Fatalf("got %v, want %v", err, errNoEncryptionHeader)
+	}
+	got, err := openTest(plain, false, DecryptOptions{})
+	if err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("plaintext not passed through: %q %v", got, err)
+	}
+}
+
+func TestScryptCostLimit(t *testing.T) {
+	tests := []struct {
+		name  string
+		slot  keyStanza
+		valid bool
+	}{
+		{"default", keyStanza{N: scryptN, R: scryptR, P: scryptP}, true},
+		{"largest", keyStanza{N: maxScryptN, R: maxScryptR, P: 1}, true},
+		{"N too large", keyStanza{N: maxScryptN << 1, R: 1, P: 1}, false},
+		{"r too large", keyStanza{N: 1 << 10, R: maxScryptR + 1, P: 1}, false},
+		{"16 GiB", keyStanza{N: 1 << 22, R: 32, P: 1}, false},
+		{"N not a power of two", keyStanza{N: 3 << 10, R: 8, P: 1}, false},
+		{"no p", keyStanza{N: scryptN, R: scryptR}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validScryptCost(tt.slot); got != tt.valid {
+				t.Errorf("validScryptCost = %v, want %v", got, tt.valid)
+			}
+		})
+	}
+
+	// The cost is refused before any passphrase is asked for
+	t.Setenv(PassphraseEnv, "")
+	h := &encHeader{Version: 1, Algorithm: EncryptAES256GCM, ChunkSize: encChunkSize, Keys: []keyStanza{
+		{Type: keyTypeScrypt, Salt: make([]byte, 16), N: 1 << 22, R: 32, P: 1},
+	}}
+	if _, err := openDataKey(h, DecryptOptions{}); err == nil || !strings.Contains(err.Error(), errTampered.Error()) {
+		t.Fatalf("got %v, want %v", err, errTampered)
+	}
+}
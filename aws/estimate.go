@@ -0,0 +1,93 @@
+package aws
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// retrievalPrice - Cost and completion window of a Glacier retrieval tier
+type retrievalPrice struct {
+	PerGB               float64
+	PerThousandRequests float64
+	Window              string
+	MaxWait             time.Duration
+}
+
+// retrievalPrices - us-east-1 list prices for S3 Glacier Flexible Retrieval.
+// Other regions differ slightly, so the estimate is a guide rather than a quote.
+// Reference - https://aws.amazon.com/s3/glacier/pricing/
+var retrievalPrices = map[string]retrievalPrice{
+	glacierTierExpedited: {PerGB: 0.03, PerThousandRequests: 10.00, Window: "1-5 minutes", MaxWait: 5 * time.Minute},
+	glacierTierStandard:  {PerGB: 0.01, PerThousandRequests: 0.05, Window: "3-5 hours", MaxWait: 5 * time.Hour},
+	glacierTierBulk:      {PerGB: 0.00, PerThousandRequests: 0.025, Window: "5-12 hours", MaxWait: 12 * time.Hour},
+}
+
+const (
+	glacierTierExpedited = "Expedited"
+	glacierTierStandard  = "Standard"
+	glacierTierBulk      = "Bulk"
+)
+
+// retrievalTier - Normalize a tier name given on the command line, empty means Standard
+func retrievalTier(tier string) (string, error) {
+	switch strings.ToLower(tier) {
+	case "", "standard":
+		return glacierTierStandard, nil
+	case "expedited":
+		return glacierTierExpedited, nil
+	case "bulk":
+		return glacierTierBulk, nil
+	}
+	return "", fmt.Errorf("unknown retrieval tier %q, use expedited, standard or bulk", tier)
+}
+
+// RetrievalEstimate - Expected cost and completion window of an archive retrieval
+type RetrievalEstimate struct {
+	ArchiveID        string    `json:"archiveId"`
+	Tier             string    `json:"tier"`
+	Bytes            int64     `json:"bytes"`
+	EstimatedCostUSD float64   `json:"estimatedCostUSD"`
+	CompletionWindow string    `json:"completionWindow"`
+	InventoryDate    time.Time `json:"inventoryDate"`
+}
+
+// estimateRetrieval - Price a retrieval of size bytes at the given tier
+func estimateRetrieval(tier string, size int64) (float64, string) {
+	price := retrievalPrices[tier]
+	gb := float64(size) / (1 << 30)
+	return gb*price.PerGB + price.PerThousandRequests/1000, price.Window
+}
+
+// EstimateArchiveRetrieval - Print the expected cost and completion window of an
+// archive-retrieval job using the archive size from the local catalog
+func EstimateArchiveRetrieval(awsRegion, vaultName, archiveID, byteRange, tier string) {
+	tier, err := retrievalTier(tier)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	archive, inventoryDate, err := lookupArchive(awsRegion, vaultName, archiveID)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	size := archive.Size
+	if byteRange != "" {
+		start, end, err := parseByteRange(byteRange)
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		size = end - start + 1
+	}
+	cost, window := estimateRetrieval(tier, size)
+	printJSON(RetrievalEstimate{
+		ArchiveID:        archiveID,
+		Tier:             tier,
+		Bytes:            size,
+		EstimatedCostUSD: cost,
+		CompletionWindow: window,
+		InventoryDate:    inventoryDate,
+	})
+}
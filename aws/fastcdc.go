@@ -0,0 +1,130 @@
+package aws
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+const (
+	// DefaultAvgChunkSize - Average chunk size of new repositories
+	DefaultAvgChunkSize = 1 << 20
+	// minChunkDivisor and maxChunkMultiple bound chunks around the average, as in FastCDC
+	minChunkDivisor  = 4
+	maxChunkMultiple = 8
+)
+
+// gearTable - Random value per byte value for the rolling gear hash. It is derived
+// from a fixed seed so chunk boundaries never change between silo versions.
+var gearTable = func() (table [256]uint64) {
+	for i := range table {
+		sum := sha256.Sum256([]byte{'s', 'i', 'l', 'o', 'c', 'd', 'c', byte(i)})
+		table[i] = binary.BigEndian.Uint64(sum[:8])
+	}
+	return table
+}()
+
+// chunkParams - Size limits of content-defined chunks, kept in the repository config
+// because changing them moves every boundary and defeats deduplication
+type chunkParams struct {
+	Min int `json:"min"`
+	Avg int `json:"avg"`
+	Max int `json:"max"`
+}
+
+// newChunkParams - Limits around an average chunk size, a power of two
+func newChunkParams(avg int) (chunkParams, error) {
+	if avg < 64<<10 || avg > 64<<20 || avg&(avg-1) != 0 {
+		return chunkParams{}, fmt.Errorf("average chunk size %d must be a power of two between 64 KiB and 64 MiB", avg)
+	}
+	return chunkParams{Min: avg / minChunkDivisor, Avg: avg, Max: avg * maxChunkMultiple}, nil
+}
+
+// chunker - FastCDC content-defined chunking over a stream. Boundaries depend only on
+// the last bytes seen, so an insert early in a file only changes the chunks around it.
+type chunker struct {
+	r     io.Reader
+	p     chunkParams
+	maskS uint64
+	maskL uint64
+	buf   []byte
+	start int
+	end   int
+	eof   bool
+}
+
+// newChunker - Split r into chunks of p
+func newChunker(r io.Reader, p chunkParams) *chunker {
+	// Normalized chunking: a harder mask before the average size and an easier one
+	// after it pull chunk sizes towards the average
+	b := bits.TrailingZeros(uint(p.Avg))
+	return &chunker{
+		r:     r,
+		p:     p,
+		maskS: topBits(b + 2),
+		maskL: topBits(b - 2),
+		buf:   make([]byte, 2*p.Max),
+	}
+}
+
+// topBits - Mask of the n highest bits, so the hash covers the last 64 bytes
+func topBits(n int) uint64 {
+	return ^uint64(0) << uint(64-n)
+}
+
+// next - The next chunk, valid until the following call, or io.EOF at the end
+func (c *chunker) next() ([]byte, error) {
+	if c.end-c.start < c.p.Max && !c.eof {
+		copy(c.buf, c.buf[c.start:c.end])
+		c.end -= c.start
+		c.start = 0
+		for c.end < len(c.buf) && !c.eof {
+			n, err := c.r.Read(c.buf[c.end:])
+			c.end += n
+			if err == io.EOF {
+				c.eof = true
+			} else if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+	n := c.cut(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
+
+// cut - Length of the chunk at the start of data
+func (c *chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.p.Min {
+		return n
+	}
+	if n > c.p.Max {
+		n = c.p.Max
+	}
+	normal := c.p.Avg
+	if n < normal {
+		normal = n
+	}
+	var fp uint64
+	i := c.p.Min
+	for ; i < normal; i++ {
+		fp = fp<<1 + gearTable[data[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = fp<<1 + gearTable[data[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
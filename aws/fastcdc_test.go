@@ -0,0 +1,142 @@
+package aws
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+)
+
+// chunkAll - Cut r into chunks, copied since the chunker reuses its buffer
+func chunkAll(t *testing.T, r io.Reader, p chunkParams) [][]byte {
+	t.Helper()
+	c := newChunker(r, p)
+	var chunks [][]byte
+	for {
+		chunk, err := c.next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, append([]byte{}, chunk...))
+	}
+}
+
+func TestNewChunkParams(t *testing.T) {
+	tests := []struct {
+		name    string
+		avg     int
+		wantErr bool
+	}{
+		{"smallest", 64 << 10, false},
+		{"default", 1 << 20, false},
+		{"largest", 64 << 20, false},
+		{"too small", 32 << 10, true},
+		{"too large", 128 << 20, true},
+		{"not a power of two", 100000, true},
+		{"zero", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newChunkParams(tt.avg)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", p)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Min >= p.Avg || p.Avg >= p.Max {
+				t.Errorf("sizes out of order: %+v", p)
+			}
+		})
+	}
+}
+
+func TestChunker(t *testing.T) {
+	p, err := newChunkParams(64 << 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	random := make([]byte, 40*p.Avg+123)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	tests := []struct {
+		name  string
+		data  []byte
+		atMax bool
+	}{
+		{"empty", nil, false},
+		{"under the minimum", random[:p.Min-1], false},
+		{"exactly the minimum", random[:p.Min], false},
+		{"exactly the maximum", random[:p.Max], false},
+		{"random", random, false},
+		// Zeros never match the boundary mask, so every chunk is cut at the maximum
+		{"zeros", make([]byte, 3*p.Max+7), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := chunkAll(t, bytes.NewReader(tt.data), p)
+			for i, chunk := range chunks {
+				if len(chunk) > p.Max {
+					t.Errorf("chunk %d has %d bytes, over the maximum %d", i, len(chunk), p.Max)
+				}
+				if len(chunk) < p.Min && i != len(chunks)-1 {
+					t.Errorf("chunk %d has %d bytes, under the minimum %d", i, len(chunk), p.Min)
+				}
+				if len(chunk) == 0 {
+					t.Errorf("chunk %d is empty", i)
+				}
+				if tt.atMax && len(chunk) != p.Max && i != len(chunks)-1 {
+					t.Errorf("chunk %d has %d bytes, want the maximum %d", i, len(chunk), p.Max)
+				}
+			}
+			if got := bytes.Join(chunks, nil); !bytes.Equal(got, tt.data) {
+				t.Fatalf("reassembled %d bytes, want the %d cut", len(got), len(tt.data))
+			}
+
+			// Boundaries depend on the content only, not on how it is read
+			again := chunkAll(t, iotest.HalfReader(bytes.NewReader(tt.data)), p)
+			if len(again) != len(chunks) {
+				t.Fatalf("%d chunks on a short reader, want %d", len(again), len(chunks))
+			}
+			for i := range chunks {
+				if !bytes.Equal(again[i], chunks[i]) {
+					t.Fatalf("chunk %d differs on a short reader", i)
+				}
+			}
+		})
+	}
+}
+
+func TestChunkerInsertion(t *testing.T) {
+	p, err := newChunkParams(64 << 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 60*p.Avg)
+	rand.New(rand.NewSource(2)).Read(data)
+	edited := append(append(append([]byte{}, data[:1000]...), "inserted"...), data[1000:]...)
+
+	before := map[[sha256.Size]byte]bool{}
+	original := chunkAll(t, bytes.NewReader(data), p)
+	for _, chunk := range original {
+		before[sha256.Sum256(chunk)] = true
+	}
+	moved := 0
+	for _, chunk := range chunkAll(t, bytes.NewReader(edited), p) {
+		if !before[sha256.Sum256(chunk)] {
+			moved++
+		}
+	}
+	// Only the chunks around the insertion change, the boundaries after it resync
+	if moved > 3 {
+		t.Errorf("%d of %d chunks changed after inserting 8 bytes", moved, len(original))
+	}
+}
@@ -1,31 +1,33 @@
 package aws
 
 import (
-	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
-	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/aws/aws-sdk-go/service/glacier/glacieriface"
 )
 
 // VaultInventory - Vault inventory struct used for unmarshaling data
 type VaultInventory struct {
-	VaultARN      string    `json:"VaultARN"`
-	InventoryDate time.Time `json:"InventoryDate"`
-	ArchiveList   []struct {
-		ArchiveID          string    `json:"ArchiveId"`
-		ArchiveDescription string    `json:"ArchiveDescription"`
-		CreationDate       time.Time `json:"CreationDate"`
-		Size               int       `json:"Size"`
-		SHA256TreeHash     string    `json:"SHA256TreeHash"`
-	} `json:"ArchiveList"`
+	VaultARN      string             `json:"VaultARN"`
+	InventoryDate time.Time          `json:"InventoryDate"`
+	ArchiveList   []InventoryArchive `json:"ArchiveList"`
+}
+
+// InventoryArchive - Single archive entry of a vault inventory
+type InventoryArchive struct {
+	ArchiveID          string    `json:"ArchiveId"`
+	ArchiveDescription string    `json:"ArchiveDescription"`
+	CreationDate       time.Time `json:"CreationDate"`
+	Size               int64     `json:"Size"`
+	SHA256TreeHash     string    `json:"SHA256TreeHash"`
 }
 
 // GetVaultLock - Retrieve vault lock-policy related attributes that are set on a vault
@@ -92,6 +94,91 @@ func GetVaultAccessPolicy(awsRegion, vaultName string) {
 	fmt.Println(result)
 }
 
+// SetVaultAccessPolicy - Set the access-policy of a vault from a JSON file.
+// The policy is validated locally first, see validateVaultPolicy.
+func SetVaultAccessPolicy(awsRegion, vaultName, policyFile string, force bool) {
+	document, err := ioutil.ReadFile(isFile(policyFile))
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	svc := glacier.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
+	vault, err := svc.DescribeVault(&glacier.DescribeVaultInput{
+		AccountId: aws.String("-"),
+		VaultName: aws.String(vaultName),
+	})
+	if err != nil {
+		printGlacierError(err)
+		return
+	}
+	if err := validateVaultPolicy(document, aws.StringValue(vault.VaultARN), force); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	input := &glacier.SetVaultAccessPolicyInput{
+		AccountId: aws.String("-"),
+		Policy: &glacier.VaultAccessPolicy{
+			Policy: aws.String(string(document)),
+		},
+		VaultName: aws.String(vaultName),
+	}
+	_, err = svc.SetVaultAccessPolicy(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			switch aerr.Code() {
+			case glacier.ErrCodeResourceNotFoundException:
+				fmt.Println(glacier.ErrCodeResourceNotFoundException, aerr.Error())
+			case glacier.ErrCodeInvalidParameterValueException:
+				fmt.Println(glacier.ErrCodeInvalidParameterValueException, aerr.Error())
+			case glacier.ErrCodeMissingParameterValueException:
+				fmt.Println(glacier.ErrCodeMissingParameterValueException, aerr.Error())
+			case glacier.ErrCodeServiceUnavailableException:
+				fmt.Println(glacier.ErrCodeServiceUnavailableException, aerr.Error())
+			default:
+				fmt.Println(aerr.Error())
+			}
+		} else {
+			// Print the error, cast err to awserr.Error to get the Code and
+			// Message from an error.
+			fmt.Println(err.Error())
+		}
+		return
+	}
+	fmt.Printf("Access policy set on %s \n", vaultName)
+}
+
+// DeleteVaultAccessPolicy - Delete the access-policy set on the vault
+func DeleteVaultAccessPolicy(awsRegion, vaultName string) {
+	svc := glacier.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
+	input := &glacier.DeleteVaultAccessPolicyInput{
+		AccountId: aws.String("-"),
+		VaultName: aws.String(vaultName),
+	}
+	_, err := svc.DeleteVaultAccessPolicy(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			switch aerr.Code() {
+			case glacier.ErrCodeResourceNotFoundException:
+				fmt.Println(glacier.ErrCodeResourceNotFoundException, aerr.Error())
+			case glacier.ErrCodeInvalidParameterValueException:
+				fmt.Println(glacier.ErrCodeInvalidParameterValueException, aerr.Error())
+			case glacier.ErrCodeMissingParameterValueException:
+				fmt.Println(glacier.ErrCodeMissingParameterValueException, aerr.Error())
+			case glacier.ErrCodeServiceUnavailableException:
+				fmt.Println(glacier.ErrCodeServiceUnavailableException, aerr.Error())
+			default:
+				fmt.Println(aerr.Error())
+			}
+		} else {
+			// Print the error, cast err to awserr.Error to get the Code and
+			// Message from an error.
+			fmt.Println(err.Error())
+		}
+		return
+	}
+	fmt.Printf("Access policy deleted on %s \n", vaultName)
+}
+
 // DeleteArchive - Delete archive
 func DeleteArchive(awsRegion, vaultName, ArchiveID string) {
 	svc := glacier.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
@@ -122,20 +209,23 @@ func DeleteArchive(awsRegion, vaultName, ArchiveID string) {
 		}
 		return
 	}
+	if err := catalogRecordDelete(awsRegion, vaultName, ArchiveID); err != nil {
+		fmt.Println("catalog:", err)
+	}
 	fmt.Println(result)
 }
 
 // InitInventoryRetrieval - Initiate an inventory-retrieval job based on vault name
-func InitInventoryRetrieval(awsRegion, vaultName, jobDescription string) {
-	svc := glacier.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
-	input := &glacier.InitiateJobInput{
-		AccountId: aws.String("-"),
-		JobParameters: &glacier.JobParameters{
-			Description: aws.String(jobDescription),
-			Type:        aws.String("inventory-retrieval"),
-		},
-		VaultName: aws.String(vaultName),
+// The inventory is produced as CSV or JSON depending on format, JSON when empty,
+// and can be narrowed down by creation date, limited in size or continued from a marker.
+// When snsTopic is set Glacier publishes to it once the job completes.
+func InitInventoryRetrieval(awsRegion, vaultName, jobDescription, format, snsTopic string, filter InventoryFilter) {
+	input, err := inventoryRetrievalInput(vaultName, jobDescription, format, snsTopic, filter)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
 	}
+	svc := glacier.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
 	result, err := svc.InitiateJob(input)
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
@@ -166,17 +256,15 @@ func InitInventoryRetrieval(awsRegion, vaultName, jobDescription string) {
 }
 
 // InitArchiveRetrieval - Initiate an archive-retrieval job based on vault name
-func InitArchiveRetrieval(awsRegion, vaultName, jobDescription, archiveID string) {
-	svc := glacier.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
-	input := &glacier.InitiateJobInput{
-		AccountId: aws.String("-"),
-		JobParameters: &glacier.JobParameters{
-			ArchiveId:   aws.String(archiveID),
-			Description: aws.String(jobDescription),
-			Type:        aws.String("archive-retrieval"),
-		},
-		VaultName: aws.String(vaultName),
+// An empty byteRange retrieves the whole archive, an empty tier uses Standard.
+// When snsTopic is set Glacier publishes to it once the job completes.
+func InitArchiveRetrieval(awsRegion, vaultName, jobDescription, archiveID, byteRange, tier, snsTopic string) {
+	input, err := archiveRetrievalInput(vaultName, jobDescription, archiveID, byteRange, tier, snsTopic)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
 	}
+	svc := glacier.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
 	result, err := svc.InitiateJob(input)
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
@@ -206,6 +294,34 @@ func InitArchiveRetrieval(awsRegion, vaultName, jobDescription, archiveID string
 	fmt.Println(result)
 }
 
+// archiveRetrievalInput - Build the InitiateJob request for an archive retrieval
+func archiveRetrievalInput(vaultName, jobDescription, archiveID, byteRange, tier, snsTopic string) (*glacier.InitiateJobInput, error) {
+	tier, err := retrievalTier(tier)
+	if err != nil {
+		return nil, err
+	}
+	input := &glacier.InitiateJobInput{
+		AccountId: aws.String("-"),
+		JobParameters: &glacier.JobParameters{
+			ArchiveId:   aws.String(archiveID),
+			Description: aws.String(jobDescription),
+			Tier:        aws.String(tier),
+			Type:        aws.String("archive-retrieval"),
+		},
+		VaultName: aws.String(vaultName),
+	}
+	if byteRange != "" {
+		if err := validRetrievalRange(byteRange); err != nil {
+			return nil, err
+		}
+		input.JobParameters.RetrievalByteRange = aws.String(byteRange)
+	}
+	if snsTopic != "" {
+		input.JobParameters.SNSTopic = aws.String(snsTopic)
+	}
+	return input, nil
+}
+
 // InitJobInput - Initiate an inventory-retrieval job based on vault name
 // Resource - https://docs.aws.amazon.com/sdk-for-go/api/service/glacier/#example_Glacier_InitiateJob_shared00
 // This operation initiates a job of the specified type, which can be a select, an archival retrieval, or a vault retrieval.
@@ -253,8 +369,63 @@ func InitJobInput(awsRegion, vaultName string) {
 }
 
 // GetVautlInventory - Get the output of a previously initiated job for inventory retrieval that is identified by the job ID
-func GetVautlInventory(awsRegion, vaultName, jobID string) {
+// Both CSV and JSON inventories are understood and printed as json, csv or a table.
+// Several job IDs, for example the pages of a limited inventory, are stitched into one inventory.
+func GetVautlInventory(awsRegion, vaultName string, jobIDs []string, output string) {
+	output, err := outputFormat(output)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
 	svc := glacier.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
+
+	var (
+		inventory VaultInventory
+		jobs      []*glacier.JobDescription
+		undated   bool
+	)
+	for _, jobID := range jobIDs {
+		page, job, err := fetchInventoryPage(svc, vaultName, jobID)
+		if err != nil {
+			printGlacierError(err)
+			return
+		}
+		jobs = append(jobs, job)
+		inventory.VaultARN = page.VaultARN
+		// The oldest page decides how fresh the stitched inventory is
+		if page.InventoryDate.IsZero() {
+			undated = true
+		} else if inventory.InventoryDate.IsZero() || page.InventoryDate.Before(inventory.InventoryDate) {
+			inventory.InventoryDate = page.InventoryDate
+		}
+		inventory.ArchiveList = append(inventory.ArchiveList, page.ArchiveList...)
+	}
+
+	if undated {
+		inventory.InventoryDate = time.Time{}
+		fmt.Fprintln(os.Stderr, "inventory date unknown, the local catalog was not updated")
+	} else if inventoryComplete(awsRegion, vaultName, jobs) {
+		if err := syncCatalog(awsRegion, vaultName, &inventory); err != nil {
+			fmt.Println("error:", err)
+		}
+	} else {
+		fmt.Fprintln(os.Stderr, "partial inventory, the local catalog was not updated")
+	}
+	if err := writeInventory(os.Stdout, &inventory, output); err != nil {
+		fmt.Println("error:", err)
+	}
+}
+
+// fetchInventoryPage - Download and parse the output of one inventory job
+func fetchInventoryPage(svc glacieriface.GlacierAPI, vaultName, jobID string) (*VaultInventory, *glacier.JobDescription, error) {
+	job, err := svc.DescribeJob(&glacier.DescribeJobInput{
+		AccountId: aws.String("-"),
+		JobId:     aws.String(jobID),
+		VaultName: aws.String(vaultName),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
 	input := &glacier.GetJobOutputInput{
 		AccountId: aws.String("-"),
 		JobId:     aws.String(jobID),
@@ -263,107 +434,184 @@ func GetVautlInventory(awsRegion, vaultName, jobID string) {
 	}
 	result, err := svc.GetJobOutput(input)
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case glacier.ErrCodeResourceNotFoundException:
-				fmt.Println(glacier.ErrCodeResourceNotFoundException, aerr.Error())
-			case glacier.ErrCodeInvalidParameterValueException:
-				fmt.Println(glacier.ErrCodeInvalidParameterValueException, aerr.Error())
-			case glacier.ErrCodeMissingParameterValueException:
-				fmt.Println(glacier.ErrCodeMissingParameterValueException, aerr.Error())
-			case glacier.ErrCodeServiceUnavailableException:
-				fmt.Println(glacier.ErrCodeServiceUnavailableException, aerr.Error())
-			default:
-				fmt.Println(aerr.Error())
-			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			fmt.Println(err.Error())
-		}
-		return
+		return nil, nil, err
 	}
-	//fmt.Println(result)
+	defer result.Body.Close()
 
 	body, err := ioutil.ReadAll(result.Body)
-
-	var inventory VaultInventory
-	err1 := json.Unmarshal(body, &inventory)
-	if err1 != nil {
-		fmt.Println("error:", err)
+	if err != nil {
+		return nil, nil, err
 	}
-	t := inventory.ArchiveList
-
-	fmt.Printf("VaultARN: %s\n", inventory.VaultARN)
-	fmt.Printf("InventoryDate: %s\n", inventory.InventoryDate)
-	for _, j := range t {
-		fmt.Printf("ArchiveID: %s\n", j.ArchiveID)
-		fmt.Printf("ArchiveDescription %s\n", j.ArchiveDescription)
-		fmt.Printf("CreationDate %s\n", j.CreationDate)
-		fmt.Printf("Size: %v\n", j.Size)
-		fmt.Printf("SHA256TreeHash: %v\n", j.SHA256TreeHash)
-
+	inventory, err := parseInventory(body, aws.StringValue(result.ContentType))
+	if err != nil {
+		return nil, nil, err
 	}
+	if inventory.VaultARN == "" {
+		// CSV inventories carry neither the vault ARN nor the inventory date. The job
+		// returns the vault's last inventory, which is older than the job itself, so
+		// the date comes from the vault. When the vault was inventoried again since,
+		// the date stays zero: the inventory is still printed but not synced.
+		inventory.VaultARN = aws.StringValue(job.VaultARN)
+		vault, err := svc.DescribeVault(&glacier.DescribeVaultInput{
+			AccountId: aws.String("-"),
+			VaultName: aws.String(vaultName),
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		date, err := time.Parse(time.RFC3339, aws.StringValue(vault.LastInventoryDate))
+		created, cerr := time.Parse(time.RFC3339, aws.StringValue(job.CreationDate))
+		switch {
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "vault %s reports no inventory date for the CSV output of job %s\n", vaultName, jobID)
+		case cerr == nil && date.After(created):
+			fmt.Fprintf(os.Stderr, "vault %s was inventoried again after job %s started, so the date of its CSV output is unknown\n", vaultName, jobID)
+		default:
+			inventory.InventoryDate = date
+		}
+	}
+	return inventory, job, nil
 }
 
-/* TODO: In the case of an archive retrieval job, depending on the byte range you specify,
-Amazon Glacier returns the checksum for the portion of the data.
-To ensure the portion you downloaded is the correct data, compute the checksum on the client,
-verify that the values match, and verify that the size is what you expected.
-*/
+// ArchiveDownload - Result of a verified archive download
+type ArchiveDownload struct {
+	File     string `json:"file"`
+	Size     int64  `json:"size"`
+	TreeHash string `json:"treeHash"`
+	Range    string `json:"range,omitempty"`
+	// Verified is false when no checksum was available to compare the data with
+	Verified bool `json:"verified"`
+	// Encryption and Compression name what was undone after the download was verified
+	Encryption   string `json:"encryption,omitempty"`
+	Compression  string `json:"compression,omitempty"`
+	ExpandedSize int64  `json:"expandedSize,omitempty"`
+}
 
 // GetVaultArchive - Get the output of a previously initiated job for archive retrieval
 // GetJobOutput -  Get the output of a previously initiated job, for instance inventory retrieval job that is identified by the job ID
 // https://docs.aws.amazon.com/amazonglacier/latest/dev/api-job-output-get.html
-func GetVaultArchive(awsRegion, vaultName, jobID, fileName string) {
+// The SHA-256 tree hash is computed while streaming and compared with the checksum Glacier
+// returns and, when given, the SHA256TreeHash from the vault inventory. The file is only
+// kept when they match. Outputs larger than opts.Threshold are fetched in chunks.
+// Archives uploaded with --compress or encryption are expanded once they are verified.
+func GetVaultArchive(awsRegion, vaultName, jobID, fileName, expectedTreeHash string, opts DownloadOptions) {
 	svc := glacier.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
+	recorded, encrypted, err := jobArchiveCodec(svc, awsRegion, vaultName, jobID)
+	if err != nil {
+		printGlacierError(err)
+		return
+	}
+	codec, err := downloadCodec(opts.Decompress, recorded)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	download, err := downloadJobOutput(svc, vaultName, jobID, fileName, expectedTreeHash, opts)
+	if err != nil {
+		printGlacierError(err)
+		return
+	}
+	if err := expandArchiveDownload(download, codec, encrypted, opts.Range, opts.Keys); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	printJSON(download)
+}
+
+// downloadJobOutput - Download and verify the output of an archive retrieval job
+func downloadJobOutput(svc glacieriface.GlacierAPI, vaultName, jobID, fileName, expectedTreeHash string, opts DownloadOptions) (*ArchiveDownload, error) {
+	opts = opts.withDefaults()
+	byteRange := ""
+	jobTreeHash := ""
+	if opts.Range != "" {
+		if _, _, err := parseByteRange(opts.Range); err != nil {
+			return nil, err
+		}
+		// The inventory and job tree hashes cover the whole output, not the range
+		byteRange = "bytes=" + opts.Range
+		expectedTreeHash = ""
+	} else {
+		job, err := svc.DescribeJob(&glacier.DescribeJobInput{
+			AccountId: aws.String("-"),
+			JobId:     aws.String(jobID),
+			VaultName: aws.String(vaultName),
+		})
+		if err != nil {
+			return nil, err
+		}
+		size, err := jobOutputSize(job)
+		if err != nil {
+			return nil, err
+		}
+		jobTreeHash = aws.StringValue(job.SHA256TreeHash)
+		if size > opts.Threshold {
+			d := &chunkedDownload{svc: svc, vaultName: vaultName, jobID: jobID, size: size, opts: opts}
+			return d.saveChunked(fileName, jobTreeHash, expectedTreeHash)
+		}
+	}
+
 	input := &glacier.GetJobOutputInput{
 		AccountId: aws.String("-"),
 		JobId:     aws.String(jobID),
-		Range:     aws.String(""),
+		Range:     aws.String(byteRange),
 		VaultName: aws.String(vaultName),
 	}
 	result, err := svc.GetJobOutput(input)
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case glacier.ErrCodeResourceNotFoundException:
-				fmt.Println(glacier.ErrCodeResourceNotFoundException, aerr.Error())
-			case glacier.ErrCodeInvalidParameterValueException:
-				fmt.Println(glacier.ErrCodeInvalidParameterValueException, aerr.Error())
-			case glacier.ErrCodeMissingParameterValueException:
-				fmt.Println(glacier.ErrCodeMissingParameterValueException, aerr.Error())
-			case glacier.ErrCodeServiceUnavailableException:
-				fmt.Println(glacier.ErrCodeServiceUnavailableException, aerr.Error())
-			default:
-				fmt.Println(aerr.Error())
-			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			fmt.Println(err.Error())
-		}
-		return
+		return nil, err
 	}
-	fmt.Println(result)
+	defer result.Body.Close()
 
-	outFile, err1 := os.Create(fileName)
-	if err1 != nil {
-		panic(err)
+	download, err := saveVerified(fileName, result.Body, aws.StringValue(result.Checksum), jobTreeHash, expectedTreeHash)
+	if err != nil {
+		return nil, err
 	}
-	defer outFile.Close()
-	_, err1 = io.Copy(outFile, result.Body)
+	download.Range = aws.StringValue(result.ContentRange)
+	return download, nil
+}
 
+// saveVerified - Stream body into fileName while computing its tree hash.
+// The data is written to a temporary file next to fileName and only renamed into
+// place when every non-empty checksum matches. Without any checksum the file is
+// kept with a warning and Verified false.
+func saveVerified(fileName string, body io.Reader, checksums ...string) (*ArchiveDownload, error) {
+	tmp := fileName + ".part"
+	outFile, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	th := NewTreeHash()
+	_, err = io.Copy(io.MultiWriter(outFile, th), body)
+	if cerr := outFile.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = verifyTreeHash(th.HexSum(), checksums...)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	if err := os.Rename(tmp, fileName); err != nil {
+		return nil, err
+	}
+	verified := anyChecksum(checksums...)
+	if !verified {
+		warnUnverified(fileName)
+	}
+	return &ArchiveDownload{File: fileName, Size: th.Size(), TreeHash: th.HexSum(), Verified: verified}, nil
 }
 
-// ListJobs - List all pending jobs per vault
-func ListJobs(awsRegion, vaultName string) {
-	svc := glacier.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
-	input := &glacier.ListJobsInput{
-		AccountId: aws.String("-"),
-		VaultName: aws.String(vaultName),
+// ListJobs - List all pending jobs per vault. Every page is fetched unless page limits the listing.
+// output is empty for the raw SDK listing, or json or table.
+func ListJobs(awsRegion, vaultName string, filter JobFilter, output string, page PageOptions) {
+	input, action, err := jobListInput(vaultName, filter)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
 	}
-	result, err := svc.ListJobs(input)
+	svc := glacier.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
+	result, err := listJobs(svc, input, page)
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			switch aerr.Code() {
@@ -385,7 +633,19 @@ func ListJobs(awsRegion, vaultName string) {
 		}
 		return
 	}
-	fmt.Println(result)
+	result.JobList = filterJobsByAction(result.JobList, action)
+	switch output {
+	case "":
+		fmt.Println(result)
+	case OutputJSON:
+		printJSON(result.JobList)
+	case OutputTable:
+		writeJobTable(os.Stdout, result.JobList, time.Now())
+	default:
+		fmt.Printf("unknown output format %q, use json or table\n", output)
+		return
+	}
+	printNextToken(result.Marker)
 }
 
 // DescribeJob - Get information about a previously initiated job, specified by the job ID.
@@ -453,19 +713,80 @@ func DescriveVault(awsRegion, vaultName string) {
 	fmt.Println(result)
 }
 
-// UploadArchive - Upload archive to vault
-// Reference - https://docs.aws.amazon.com/amazonglacier/latest/dev/api-archive-post.html
-// More - https://docs.aws.amazon.com/amazonglacier/latest/dev/uploading-an-archive.html
-func UploadArchive(awsRegion, vaultName, fileUpload string) {
-	svc := glacier.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
+// ArchiveUpload - Result of a completed archive upload
+type ArchiveUpload struct {
+	ArchiveID string `json:"archiveId"`
+	Location  string `json:"location"`
+	Checksum  string `json:"checksum"`
+	Size      int64  `json:"size"`
+	// Compression and Encryption name how the archive was transformed before upload
+	Compression string   `json:"compression,omitempty"`
+	Encryption  string   `json:"encryption,omitempty"`
+	KeyIDs      []string `json:"keyIds,omitempty"`
+}
+
+// uploadArchiveBody - Upload body as a single-request archive. The tree hash has to be
+// sent along with the body, so body is read once to compute it and rewound before it is
+// handed to the SDK.
+func uploadArchiveBody(svc glacieriface.GlacierAPI, vaultName, description string, body io.ReadSeeker) (*ArchiveUpload, error) {
+	th, err := computeTreeHash(body)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
 	input := &glacier.UploadArchiveInput{
 		AccountId:          aws.String("-"),
-		ArchiveDescription: aws.String(getFilename(fileUpload)),
-		Body:               aws.ReadSeekCloser(strings.NewReader(isFile(fileUpload))),
-		Checksum:           aws.String(""),
+		ArchiveDescription: aws.String(description),
+		Body:               body,
+		Checksum:           aws.String(th.HexSum()),
 		VaultName:          aws.String(vaultName),
 	}
 	result, err := svc.UploadArchive(input)
+	if err != nil {
+		return nil, err
+	}
+	if aws.StringValue(result.Checksum) != th.HexSum() {
+		return nil, fmt.Errorf("checksum mismatch: local %s, glacier %s", th.HexSum(), aws.StringValue(result.Checksum))
+	}
+	return &ArchiveUpload{
+		ArchiveID: aws.StringValue(result.ArchiveId),
+		Location:  aws.StringValue(result.Location),
+		Checksum:  aws.StringValue(result.Checksum),
+		Size:      th.Size(),
+	}, nil
+}
+
+// UploadArchive - Upload archive to vault
+// Reference - https://docs.aws.amazon.com/amazonglacier/latest/dev/api-archive-post.html
+// More - https://docs.aws.amazon.com/amazonglacier/latest/dev/uploading-an-archive.html
+// Archives larger than opts.Threshold, or resumed uploads, are handed over to UploadMultipartArchive.
+// Compressed or encrypted archives are streamed through uploadSealedArchive.
+func UploadArchive(awsRegion, vaultName, fileUpload string, opts UploadOptions) {
+	opts = opts.withDefaults()
+	if opts.Compress != (CompressOptions{}) || opts.Encrypt.enabled() || opts.Encrypt.Algorithm != "" {
+		uploadSealedArchive(awsRegion, vaultName, fileUpload, opts)
+		return
+	}
+	f, err := os.Open(isFile(fileUpload))
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	if info.Size() > opts.Threshold || opts.Resume {
+		UploadMultipartArchive(awsRegion, vaultName, fileUpload, opts)
+		return
+	}
+
+	svc := glacier.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
+	upload, err := uploadArchiveBody(svc, vaultName, getFilename(fileUpload), f)
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			switch aerr.Code() {
@@ -489,7 +810,56 @@ func UploadArchive(awsRegion, vaultName, fileUpload string) {
 		}
 		return
 	}
-	fmt.Println(result)
+	if err := catalogRecordUpload(awsRegion, vaultName, getFilename(fileUpload), *upload); err != nil {
+		fmt.Println("catalog:", err)
+	}
+	printJSON(upload)
+}
+
+// uploadSealedArchive - Compress and encrypt a file on the fly and stream it into the
+// vault. The final size is unknown up front, so the upload cannot be resumed.
+func uploadSealedArchive(awsRegion, vaultName, fileUpload string, opts UploadOptions) {
+	if err := opts.Compress.validate(); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	if opts.Resume {
+		fmt.Println("compressed and encrypted uploads are streamed and cannot be resumed, drop --resume")
+		return
+	}
+	enc, err := newEncryptor(opts.Encrypt)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	f, err := os.Open(isFile(fileUpload))
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	defer f.Close()
+	body, err := sealReader(f, opts.Compress, enc)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	defer body.Close()
+
+	svc := glacier.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
+	description := archiveDescription(getFilename(fileUpload)+sealedExt(opts.Compress, enc), opts.Compress.Codec)
+	upload, err := uploadArchiveStream(svc, vaultName, description, body, opts)
+	if err != nil {
+		printGlacierError(err)
+		return
+	}
+	upload.Compression = opts.Compress.Codec
+	if enc != nil {
+		upload.Encryption, upload.KeyIDs = enc.algorithm, enc.keyIDs()
+	}
+	if err := catalogRecordUpload(awsRegion, vaultName, description, *upload); err != nil {
+		fmt.Println("catalog:", err)
+	}
+	printJSON(upload)
 }
 
 // DeleteVault - Delete vault based on name and region
@@ -524,8 +894,13 @@ func DeleteVault(awsRegion, vaultName string) {
 	fmt.Println(result)
 }
 
-// CreateVault - Create new vault based on name and region
-func CreateVault(awsRegion, vaultName string) {
+// CreateVault - Create new vault based on name and region, tagged with "key=value" tagArgs
+func CreateVault(awsRegion, vaultName string, tagArgs []string) {
+	tags, err := parseTags(tagArgs)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
 	svc := glacier.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
 	input := &glacier.CreateVaultInput{
 		AccountId: aws.String("-"),
@@ -556,17 +931,19 @@ func CreateVault(awsRegion, vaultName string) {
 		return
 	}
 	fmt.Println(result)
+	if len(tags) > 0 {
+		if err := addVaultTags(svc, vaultName, tags); err != nil {
+			fmt.Printf("vault %s was created but could not be tagged, retry with tag-vault\n", vaultName)
+			printGlacierError(err)
+		}
+	}
 }
 
-// ListVault - List all vaults based on region
-func ListVault(awsRegion string) {
+// ListVault - List all vaults based on region, optionally only those carrying every
+// "key=value" or "key" in tags. Every page is fetched unless page limits the listing.
+func ListVault(awsRegion string, tags []string, page PageOptions) {
 	svc := glacier.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
-	input := &glacier.ListVaultsInput{
-		AccountId: aws.String("-"),
-		//Limit:     aws.String(""),
-		//Marker:    aws.String(""),
-	}
-	result, err := svc.ListVaults(input)
+	result, err := listVaults(svc, page)
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			switch aerr.Code() {
@@ -588,7 +965,14 @@ func ListVault(awsRegion string) {
 		}
 		return
 	}
+	if len(tags) > 0 {
+		if result.VaultList, err = filterVaultsByTag(svc, result.VaultList, tags); err != nil {
+			printGlacierError(err)
+			return
+		}
+	}
 	fmt.Println(result)
+	printNextToken(result.Marker)
 }
 
 // GetRetrievalPolicy - Get the current data retrieval policy for an account
@@ -620,25 +1004,41 @@ func GetRetrievalPolicy(awsRegion string) {
 	fmt.Println(result)
 }
 
-// TODO SetDataRetrievalPolicyFreeTier and SetDataRetrievalPolicy needs testing
-
 // SetDataRetrievalPolicyFreeTier - Set FreeTier retrieval policy
 func SetDataRetrievalPolicyFreeTier(awsRegion string) {
+	SetDataRetrievalPolicy(awsRegion, RetrievalStrategyFreeTier, 0)
+}
+
+// SetDataRetrievalPolicy - Set and then enact a data retrieval policy.
+// bytesPerHour is only used with the BytesPerHour strategy.
+func SetDataRetrievalPolicy(awsRegion, strategyPolicy string, bytesPerHour int64) {
 	svc := glacier.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
-	input := &glacier.SetDataRetrievalPolicyInput{
-		Policy: &glacier.DataRetrievalPolicy{
-			Rules: []*glacier.DataRetrievalRule{
-				{
-					Strategy: aws.String("FreeTier"),
-				},
-			},
-		},
+	policy, err := setRetrievalPolicy(svc, strategyPolicy, bytesPerHour)
+	if err != nil {
+		printGlacierError(err)
+		return
+	}
+	fmt.Println(policy)
+}
+
+// InitiateVaultLock - Installing a vault lock policy on the specified vault.
+// Setting the lock state of vault lock to InProgress.
+// Returning a lock ID, which is used to complete the vault locking process.
+func InitiateVaultLock(awsRegion, vaultName, vaultPolicy string) {
+	svc := glacier.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
+	input := &glacier.InitiateVaultLockInput{
 		AccountId: aws.String("-"),
+		Policy: &glacier.VaultLockPolicy{
+			Policy: aws.String(vaultPolicy),
+		},
+		VaultName: aws.String(vaultName),
 	}
-	result, err := svc.SetDataRetrievalPolicy(input)
+	result, err := svc.InitiateVaultLock(input)
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			switch aerr.Code() {
+			case glacier.ErrCodeResourceNotFoundException:
+				fmt.Println(glacier.ErrCodeResourceNotFoundException, aerr.Error())
 			case glacier.ErrCodeInvalidParameterValueException:
 				fmt.Println(glacier.ErrCodeInvalidParameterValueException, aerr.Error())
 			case glacier.ErrCodeMissingParameterValueException:
@@ -658,24 +1058,22 @@ func SetDataRetrievalPolicyFreeTier(awsRegion string) {
 	fmt.Println(result)
 }
 
-// SetDataRetrievalPolicy - Set and then enact a data retrieval policy
-func SetDataRetrievalPolicy(awsRegion, strategyPolicy string, bytesPerHour int64) {
+// AbortVaultLock - This operation aborts the vault locking process if the vault lock is not in the Locked state.
+// If the vault lock is in the Locked state when this operation is requested, the operation returns an AccessDeniedException error.
+// Aborting the vault locking process removes the vault lock policy from the specified vault.
+// The error is printed and also returned so callers know whether the lock is gone.
+func AbortVaultLock(awsRegion, vaultName string) error {
 	svc := glacier.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
-	input := &glacier.SetDataRetrievalPolicyInput{
-		Policy: &glacier.DataRetrievalPolicy{
-			Rules: []*glacier.DataRetrievalRule{
-				{
-					BytesPerHour: aws.Int64(bytesPerHour),
-					Strategy:     aws.String(strategyPolicy),
-				},
-			},
-		},
+	input := &glacier.AbortVaultLockInput{
 		AccountId: aws.String("-"),
+		VaultName: aws.String(vaultName),
 	}
-	result, err := svc.SetDataRetrievalPolicy(input)
+	_, err := svc.AbortVaultLock(input)
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			switch aerr.Code() {
+			case glacier.ErrCodeResourceNotFoundException:
+				fmt.Println(glacier.ErrCodeResourceNotFoundException, aerr.Error())
 			case glacier.ErrCodeInvalidParameterValueException:
 				fmt.Println(glacier.ErrCodeInvalidParameterValueException, aerr.Error())
 			case glacier.ErrCodeMissingParameterValueException:
@@ -690,26 +1088,22 @@ func SetDataRetrievalPolicy(awsRegion, strategyPolicy string, bytesPerHour int64
 			// Message from an error.
 			fmt.Println(err.Error())
 		}
-		return
+		return err
 	}
-
-	fmt.Println(result)
+	fmt.Printf("Vault lock aborted on %s \n", vaultName)
+	return nil
 }
 
-// InitiateVaultLock - Installing a vault lock policy on the specified vault.
-// Setting the lock state of vault lock to InProgress.
-// Returning a lock ID, which is used to complete the vault locking process.
-func InitiateVaultLock(awsRegion, vaultName, vaultPolicy string) {
+// CompleteVaultLock - This operation completes the vault locking process by transitioning the vault lock
+// from the InProgress state to the Locked state, which causes the vault lock policy to become unchangeable.
+func CompleteVaultLock(awsRegion, vaultName, lockID string) {
 	svc := glacier.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
-	input := &glacier.InitiateVaultLockInput{
+	input := &glacier.CompleteVaultLockInput{
 		AccountId: aws.String("-"),
-		Policy: &glacier.VaultLockPolicy{
-			Policy: aws.String(vaultPolicy),
-			//Policy: aws.String("{\"Version\":\"2012-10-17\",\"Statement\":[{\"Sid\":\"Define-vault-lock\",\"Effect\":\"Deny\",\"Principal\":{\"AWS\":\"*\"},\"Action\":\"glacier:DeleteArchive\",\"Resource\":\"arn:aws:glacier:us-east-2:757758175257:vaults/my-vault\",\"Condition\":{\"NumericLessThanEquals\":{\"glacier:ArchiveAgeinDays\":\"365\"}}}]}"),
-		},
+		LockId:    aws.String(lockID),
 		VaultName: aws.String(vaultName),
 	}
-	result, err := svc.InitiateVaultLock(input)
+	result, err := svc.CompleteVaultLock(input)
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			switch aerr.Code() {
@@ -734,16 +1128,24 @@ func InitiateVaultLock(awsRegion, vaultName, vaultPolicy string) {
 	fmt.Println(result)
 }
 
-// AbortVaultLock - This operation aborts the vault locking process if the vault lock is not in the Locked state.
-// If the vault lock is in the Locked state when this operation is requested, the operation returns an AccessDeniedException error.
-// Aborting the vault locking process removes the vault lock policy from the specified vault.
-func AbortVaultLock(awsRegion, vaultName string) {
+// DefaultNotificationEvents - Job events a vault publishes when none are given
+var DefaultNotificationEvents = []string{"ArchiveRetrievalCompleted", "InventoryRetrievalCompleted"}
+
+// SetVaultNotifications - Configure a vault to publish job completion events to an SNS topic
+func SetVaultNotifications(awsRegion, vaultName, snsTopic string, events []string) {
+	if len(events) == 0 {
+		events = DefaultNotificationEvents
+	}
 	svc := glacier.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
-	input := &glacier.AbortVaultLockInput{
+	input := &glacier.SetVaultNotificationsInput{
 		AccountId: aws.String("-"),
 		VaultName: aws.String(vaultName),
+		VaultNotificationConfig: &glacier.VaultNotificationConfig{
+			Events:   aws.StringSlice(events),
+			SNSTopic: aws.String(snsTopic),
+		},
 	}
-	_, err := svc.AbortVaultLock(input)
+	_, err := svc.SetVaultNotifications(input)
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			switch aerr.Code() {
@@ -765,19 +1167,17 @@ func AbortVaultLock(awsRegion, vaultName string) {
 		}
 		return
 	}
-	fmt.Printf("Vault lock aborted on %s \n", vaultName)
+	fmt.Printf("Vault notifications set on %s \n", vaultName)
 }
 
-// CompleteVaultLock - This operation completes the vault locking process by transitioning the vault lock
-// from the InProgress state to the Locked state, which causes the vault lock policy to become unchangeable.
-func CompleteVaultLock(awsRegion, vaultName, lockID string) {
+// GetVaultNotifications - Retrieve the notification configuration set on a vault
+func GetVaultNotifications(awsRegion, vaultName string) {
 	svc := glacier.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
-	input := &glacier.CompleteVaultLockInput{
+	input := &glacier.GetVaultNotificationsInput{
 		AccountId: aws.String("-"),
-		LockId:    aws.String(lockID),
 		VaultName: aws.String(vaultName),
 	}
-	result, err := svc.CompleteVaultLock(input)
+	result, err := svc.GetVaultNotifications(input)
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			switch aerr.Code() {
@@ -801,3 +1201,35 @@ func CompleteVaultLock(awsRegion, vaultName, lockID string) {
 	}
 	fmt.Println(result)
 }
+
+// DeleteVaultNotifications - Stop a vault from publishing job events
+func DeleteVaultNotifications(awsRegion, vaultName string) {
+	svc := glacier.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
+	input := &glacier.DeleteVaultNotificationsInput{
+		AccountId: aws.String("-"),
+		VaultName: aws.String(vaultName),
+	}
+	_, err := svc.DeleteVaultNotifications(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			switch aerr.Code() {
+			case glacier.ErrCodeResourceNotFoundException:
+				fmt.Println(glacier.ErrCodeResourceNotFoundException, aerr.Error())
+			case glacier.ErrCodeInvalidParameterValueException:
+				fmt.Println(glacier.ErrCodeInvalidParameterValueException, aerr.Error())
+			case glacier.ErrCodeMissingParameterValueException:
+				fmt.Println(glacier.ErrCodeMissingParameterValueException, aerr.Error())
+			case glacier.ErrCodeServiceUnavailableException:
+				fmt.Println(glacier.ErrCodeServiceUnavailableException, aerr.Error())
+			default:
+				fmt.Println(aerr.Error())
+			}
+		} else {
+			// Print the error, cast err to awserr.Error to get the Code and
+			// Message from an error.
+			fmt.Println(err.Error())
+		}
+		return
+	}
+	fmt.Printf("Vault notifications deleted on %s \n", vaultName)
+}
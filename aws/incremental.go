@@ -0,0 +1,476 @@
+package aws
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// fileState - What the last successful incremental run saw of a path
+type fileState struct {
+	Type    string      `json:"type"`
+	Mode    os.FileMode `json:"mode"`
+	UID     int         `json:"uid"`
+	GID     int         `json:"gid"`
+	ModTime time.Time   `json:"modTime"`
+	Size    int64       `json:"size"`
+	Inode   uint64      `json:"inode,omitempty"`
+	SHA256  string      `json:"sha256,omitempty"`
+}
+
+// unchanged - Whether a file still looks the way it did; the hash is carried over
+// because reading every file again is what incremental runs avoid. chmod and chown
+// leave the mtime alone, so mode and owner are compared too.
+func (s fileState) unchanged(cur fileState) bool {
+	return s.Type == cur.Type && s.Mode == cur.Mode && s.UID == cur.UID && s.GID == cur.GID &&
+		s.ModTime.Equal(cur.ModTime) && s.Size == cur.Size && s.Inode == cur.Inode
+}
+
+// incrementalState - Local cache of an incremental chain, one per destination and
+// set of sources, kept under ~/.silo/incremental
+type incrementalState struct {
+	Destination string               `json:"destination"`
+	Sources     []string             `json:"sources"`
+	Chain       []string             `json:"chain"`
+	Updated     time.Time            `json:"updated"`
+	Files       map[string]fileState `json:"files"`
+
+	path string
+}
+
+// incrementalStatePath - Cache file of the chain backing up sources to a destination
+func incrementalStatePath(to string, sources []string) string {
+	sorted := append([]string{}, sources...)
+	sort.Strings(sorted)
+	sum := sha256.Sum256([]byte(to + "\n" + strings.Join(sorted, "\n")))
+	return filepath.Join(siloDir(), "incremental", hex.EncodeToString(sum[:8])+".json")
+}
+
+// loadIncrementalState - Read the cache of a chain, empty when no run succeeded yet
+func loadIncrementalState(to string, sources []string) (*incrementalState, error) {
+	st := &incrementalState{Destination: to, Sources: sources, path: incrementalStatePath(to, sources)}
+	data, err := ioutil.ReadFile(st.path)
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, fmt.Errorf("%s: %v", st.path, err)
+	}
+	return st, nil
+}
+
+// parent - State the next backup is compared against, nil when it has to be a full
+// backup because there is no chain yet or it reached fullEvery backups
+func (st *incrementalState) parent(fullEvery int) map[string]fileState {
+	if len(st.Chain) == 0 || st.Files == nil {
+		return nil
+	}
+	if fullEvery > 0 && len(st.Chain) >= fullEvery {
+		return nil
+	}
+	return st.Files
+}
+
+// deleted - Tombstones: paths of the last run that are gone now or changed type,
+// sorted. A restore clears them before it extracts the backup, so a directory that
+// became a file, or a file that became a symlink, does not block its replacement.
+func (st *incrementalState) deleted(current map[string]fileState) []string {
+	var gone []string
+	for path, old := range st.Files {
+		if cur, ok := current[path]; !ok || cur.Type != old.Type {
+			gone = append(gone, path)
+		}
+	}
+	sort.Strings(gone)
+	return gone
+}
+
+// save - Write the cache atomically
+func (st *incrementalState) save() error {
+	st.Updated = time.Now().UTC()
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(st.path), 0700); err != nil {
+		return err
+	}
+	tmp := st.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, st.path)
+}
+
+// RestoreBackupOptions - Settings of a backup restore
+type RestoreBackupOptions struct {
+	// Name of the backup to restore; incremental backups replay their whole chain
+	Name string
+	// From is the backup destination, needed when a manifest is not in ~/.silo/backups
+	From string
+	// Target is the directory the archived paths are recreated below
+	Target string
+	// Tier and Poll control the retrieval jobs of backups kept in Glacier
+	Tier string
+	Poll PollOptions
+	// Keys decrypts encrypted backups and manifests
+	Keys DecryptOptions
+}
+
+// loadBackupManifest - Manifest of a backup from ~/.silo/backups, or from the S3
+// destination when it is not kept locally
+func loadBackupManifest(svc s3iface.S3API, name, from string, keys DecryptOptions) (*BackupManifest, error) {
+	data, err := ioutil.ReadFile(manifestPath(name))
+	if os.IsNotExist(err) {
+		data, err = fetchBackupManifest(svc, name, from, keys)
+	}
+	if err != nil {
+		return nil, err
+	}
+	m := &BackupManifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("manifest of %s: %v", name, err)
+	}
+	return m, nil
+}
+
+// fetchBackupManifest - Download the manifest stored next to a backup in S3 and keep
+// a local copy of it
+func fetchBackupManifest(svc s3iface.S3API, name, from string, keys DecryptOptions) ([]byte, error) {
+	target, err := parseBackupTarget(from)
+	if err != nil || target.vault != "" {
+		return nil, fmt.Errorf("the manifest of %s is not in %s; use --from s3://bucket/prefix, or fetch it from Glacier with glacier restore", name, filepath.Dir(manifestPath(name)))
+	}
+	var (
+		result    *s3.GetObjectOutput
+		encrypted bool
+	)
+	for _, ext := range []string{"", encryptedExt} {
+		result, err = svc.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(target.bucket),
+			Key:    aws.String(target.key(name + ".manifest.json" + ext)),
+		})
+		if err == nil {
+			encrypted = ext == encryptedExt
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer result.Body.Close()
+	r, _, err := unsealReader(result.Body, "", encrypted, keys)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	m := &BackupManifest{Name: name}
+	if err := saveManifest(m, data); err != nil {
+		fmt.Fprintln(os.Stderr, "manifest:", err)
+	}
+	return data, nil
+}
+
+// noSymlinkBelow - Refuse to write through a symlink an earlier entry created
+// between target and dir
+func noSymlinkBelow(target, dir string) error {
+	for d := dir; d != target && strings.HasPrefix(d, target+string(filepath.Separator)); d = filepath.Dir(d) {
+		if info, err := os.Lstat(d); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s is a symlink, refusing to restore below it", d)
+		}
+	}
+	return nil
+}
+
+// extractTar - Recreate the entries of a backup archive below target, replacing the
+// paths an earlier backup of the chain restored
+func extractTar(r io.Reader, target string) (int, error) {
+	tr := tar.NewReader(r)
+	var dirs []SnapshotEntry
+	n := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		dest, err := restoreTarget(target, strings.TrimSuffix(hdr.Name, "/"))
+		if err != nil {
+			return n, err
+		}
+		if err := noSymlinkBelow(target, filepath.Dir(dest)); err != nil {
+			return n, err
+		}
+		if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+			return n, err
+		}
+		e := SnapshotEntry{ManifestEntry: ManifestEntry{
+			Path:    hdr.Name,
+			Mode:    hdr.FileInfo().Mode(),
+			ModTime: hdr.ModTime,
+			UID:     hdr.Uid,
+			GID:     hdr.Gid,
+		}}
+		for key, value := range hdr.PAXRecords {
+			if strings.HasPrefix(key, "SCHILY.xattr.") {
+				if e.Xattrs == nil {
+					e.Xattrs = map[string]string{}
+				}
+				e.Xattrs[strings.TrimPrefix(key, "SCHILY.xattr.")] = value
+			}
+		}
+		n++
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(dest, 0700); err != nil {
+				return n, err
+			}
+			e.Type = "dir"
+			dirs = append(dirs, e)
+			continue
+		case tar.TypeReg:
+			if err := replaceFile(dest, tr); err != nil {
+				return n, err
+			}
+			e.Type = "file"
+		case tar.TypeSymlink:
+			if err := removeExisting(dest); err != nil {
+				return n, err
+			}
+			if err := os.Symlink(hdr.Linkname, dest); err != nil {
+				return n, err
+			}
+			e.Type = "symlink"
+		case tar.TypeLink:
+			first, err := restoreTarget(target, hdr.Linkname)
+			if err != nil {
+				return n, err
+			}
+			if err := removeExisting(dest); err != nil {
+				return n, err
+			}
+			if err := os.Link(first, dest); err != nil {
+				return n, err
+			}
+			continue
+		default:
+			fmt.Fprintf(os.Stderr, "skipping special file %s\n", hdr.Name)
+			continue
+		}
+		if err := restoreMetadata(dest, e); err != nil {
+			return n, fmt.Errorf("%s: %v", hdr.Name, err)
+		}
+	}
+	// Deepest directories first, so setting a parent's time is the last change to it
+	for i := len(dirs) - 1; i >= 0; i-- {
+		dest, _ := restoreTarget(target, strings.TrimSuffix(dirs[i].Path, "/"))
+		if err := restoreMetadata(dest, dirs[i]); err != nil {
+			return n, fmt.Errorf("%s: %v", dirs[i].Path, err)
+		}
+	}
+	return n, nil
+}
+
+// removeExisting - Make room for a restored entry; directories are left alone
+func removeExisting(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", path)
+	}
+	return os.Remove(path)
+}
+
+// replaceFile - Write a restored file, breaking any hard link the old one had
+func replaceFile(path string, r io.Reader) error {
+	if err := removeExisting(path); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// applyTombstones - Remove the paths an incremental backup recorded as deleted
+func applyTombstones(target string, deleted []string) error {
+	for _, path := range deleted {
+		dest, err := restoreTarget(target, strings.TrimSuffix(path, "/"))
+		if err != nil {
+			return err
+		}
+		if err := noSymlinkBelow(target, filepath.Dir(dest)); err != nil {
+			return err
+		}
+		if err := os.RemoveAll(dest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchBackup - Download one backup of a chain into file and undo its compression
+// and encryption. Glacier backups need their retrieval job prepared in jobs.
+func fetchBackup(sess *session.Session, awsRegion string, m *BackupManifest, jobs *archiveJobs, file string, opts RestoreBackupOptions) error {
+	target, err := parseBackupTarget(m.Destination)
+	if err != nil {
+		return err
+	}
+	if target.vault == "" {
+		svc := s3.New(sess, aws.NewConfig().WithRegion(awsRegion))
+		_, err := downloadObject(svc, target.bucket, m.Key, file, S3DownloadOptions{Overwrite: true, Keys: opts.Keys})
+		return err
+	}
+	svc := glacier.New(sess, aws.NewConfig().WithRegion(awsRegion))
+	jobID, err := jobs.wait(svc, jobArchive{ID: m.ArchiveID, Label: m.Name}, opts.Poll)
+	if err != nil {
+		return err
+	}
+	download, err := downloadJobOutput(svc, target.vault, jobID, file, m.TreeHash, DownloadOptions{Keys: opts.Keys})
+	if err != nil {
+		return err
+	}
+	encrypted := m.Encryption != "" || strings.HasSuffix(m.Name, encryptedExt)
+	return expandArchiveDownload(download, m.Compression, encrypted, "", opts.Keys)
+}
+
+// RestoreBackup - Rebuild a backup below a target directory. For an incremental
+// backup the chain is replayed from its full backup: every archive is extracted over
+// the previous ones and its tombstones are removed, which gives the tree as it was
+// when the named backup ran. Glacier retrievals for the whole chain start up front and
+// their job IDs are kept under ~/.silo, so running the restore again reuses the jobs
+// Glacier still holds.
+func RestoreBackup(awsRegion string, opts RestoreBackupOptions) {
+	sess := session.New()
+	s3svc := s3.New(sess, aws.NewConfig().WithRegion(awsRegion))
+	last, err := loadBackupManifest(s3svc, opts.Name, opts.From, opts.Keys)
+	if err != nil {
+		printS3Error(err)
+		return
+	}
+	names := last.Chain
+	if len(names) == 0 {
+		names = []string{last.Name}
+	}
+	manifests := make([]*BackupManifest, len(names))
+	for i, name := range names {
+		if name == last.Name {
+			manifests[i] = last
+		} else if manifests[i], err = loadBackupManifest(s3svc, name, last.Destination, opts.Keys); err != nil {
+			printS3Error(err)
+			return
+		}
+	}
+	target, err := filepath.Abs(opts.Target)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	var jobs *archiveJobs
+	if dest, err := parseBackupTarget(last.Destination); err != nil {
+		fmt.Println(err.Error())
+		return
+	} else if dest.vault != "" {
+		tier, err := retrievalTier(opts.Tier)
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		if jobs, err = loadArchiveJobs(awsRegion, dest.vault, "chain "+last.Name, tier); err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		archives := make([]jobArchive, len(manifests))
+		for i, m := range manifests {
+			archives[i] = jobArchive{ID: m.ArchiveID, Label: m.Name}
+		}
+		svc := glacier.New(sess, aws.NewConfig().WithRegion(awsRegion))
+		if err := jobs.prepare(svc, archives); err != nil {
+			printGlacierError(err)
+			return
+		}
+	}
+
+	if err := os.MkdirAll(target, 0755); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	dir, err := ioutil.TempDir(target, ".silo-restore-")
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	defer os.RemoveAll(dir)
+	files, deleted := 0, 0
+	for _, m := range manifests {
+		file := filepath.Join(dir, "archive.tar")
+		if err := fetchBackup(sess, awsRegion, m, jobs, file, opts); err != nil {
+			fmt.Printf("%s: %v\n", m.Name, err)
+			return
+		}
+		// Tombstones first: a path whose type changed is in both lists
+		if err := applyTombstones(target, m.Deleted); err != nil {
+			fmt.Printf("%s: %v\n", m.Name, err)
+			return
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		n, err := extractTar(f, target)
+		f.Close()
+		os.Remove(file)
+		if err != nil {
+			fmt.Printf("%s: %v\n", m.Name, err)
+			return
+		}
+		files += n
+		deleted += len(m.Deleted)
+	}
+	if jobs != nil {
+		jobs.remove()
+	}
+	printJSON(struct {
+		Name    string   `json:"name"`
+		Target  string   `json:"target"`
+		Chain   []string `json:"chain"`
+		Files   int      `json:"files"`
+		Deleted int      `json:"deleted"`
+	}{last.Name, target, names, files, deleted})
+}
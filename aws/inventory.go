@@ -0,0 +1,344 @@
+package aws
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/glacier"
+)
+
+// Output formats accepted by --output
+const (
+	OutputJSON  = "json"
+	OutputCSV   = "csv"
+	OutputTable = "table"
+)
+
+// inventoryColumns - Stable column names, the same Glacier uses in CSV inventories
+var inventoryColumns = []string{"ArchiveId", "ArchiveDescription", "CreationDate", "Size", "SHA256TreeHash"}
+
+// outputFormat - Normalize an --output value
+func outputFormat(format string) (string, error) {
+	switch strings.ToLower(format) {
+	case "", OutputTable:
+		return OutputTable, nil
+	case OutputJSON:
+		return OutputJSON, nil
+	case OutputCSV:
+		return OutputCSV, nil
+	}
+	return "", fmt.Errorf("unknown output format %q, use json, csv or table", format)
+}
+
+// inventoryFormat - Normalize the --format of an inventory job
+func inventoryFormat(format string) (string, error) {
+	switch strings.ToUpper(format) {
+	case "", "JSON":
+		return "JSON", nil
+	case "CSV":
+		return "CSV", nil
+	}
+	return "", fmt.Errorf("unknown inventory format %q, use CSV or JSON", format)
+}
+
+// parseInventory - Decode an inventory job output in either JSON or CSV
+func parseInventory(body []byte, contentType string) (*VaultInventory, error) {
+	var inventory VaultInventory
+	if !strings.Contains(contentType, "csv") && bytes.HasPrefix(bytes.TrimSpace(body), []byte("{")) {
+		if err := json.Unmarshal(body, &inventory); err != nil {
+			return nil, err
+		}
+		return &inventory, nil
+	}
+
+	r := csv.NewReader(bytes.NewReader(body))
+	header, err := r.Read()
+	if err == io.EOF {
+		return &inventory, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	index := map[string]int{}
+	for i, name := range header {
+		index[strings.TrimSpace(name)] = i
+	}
+	for _, name := range inventoryColumns {
+		if _, ok := index[name]; !ok {
+			return nil, fmt.Errorf("csv inventory is missing column %s", name)
+		}
+	}
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		created, err := time.Parse(time.RFC3339, row[index["CreationDate"]])
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.ParseInt(row[index["Size"]], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		inventory.ArchiveList = append(inventory.ArchiveList, InventoryArchive{
+			ArchiveID:          row[index["ArchiveId"]],
+			ArchiveDescription: row[index["ArchiveDescription"]],
+			CreationDate:       created,
+			Size:               size,
+			SHA256TreeHash:     row[index["SHA256TreeHash"]],
+		})
+	}
+	return &inventory, nil
+}
+
+// writeInventory - Render an inventory as json, csv or a table
+func writeInventory(w io.Writer, inventory *VaultInventory, format string) error {
+	switch format {
+	case OutputJSON:
+		out, err := json.MarshalIndent(inventory, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(out))
+		return err
+	case OutputCSV:
+		cw := csv.NewWriter(w)
+		cw.Write(inventoryColumns)
+		for _, a := range inventory.ArchiveList {
+			cw.Write([]string{
+				a.ArchiveID,
+				a.ArchiveDescription,
+				a.CreationDate.UTC().Format(time.RFC3339),
+				strconv.FormatInt(a.Size, 10),
+				a.SHA256TreeHash,
+			})
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	fmt.Fprintf(w, "VaultARN: %s\n", inventory.VaultARN)
+	fmt.Fprintf(w, "InventoryDate: %s\n", inventory.InventoryDate)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(inventoryColumns, "\t"))
+	for _, a := range inventory.ArchiveList {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", a.ArchiveID, a.ArchiveDescription, a.CreationDate.UTC().Format(time.RFC3339), a.Size, a.SHA256TreeHash)
+	}
+	return tw.Flush()
+}
+
+// InventoryFilter - Narrow down an inventory-retrieval job
+type InventoryFilter struct {
+	// StartDate and EndDate bound the archive creation dates, YYYY-MM-DD or RFC 3339
+	StartDate string
+	EndDate   string
+	// Limit is the maximum number of archives per job
+	Limit int
+	// Marker continues an inventory where a limited job stopped
+	Marker string
+}
+
+// inventoryDate - Convert a YYYY-MM-DD or RFC 3339 date to the form Glacier expects
+func inventoryDate(value string) (string, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC().Format(time.RFC3339), nil
+		}
+	}
+	return "", fmt.Errorf("date %q must be YYYY-MM-DD or RFC 3339", value)
+}
+
+// inventoryRetrievalInput - Build the InitiateJob request for an inventory retrieval
+func inventoryRetrievalInput(vaultName, jobDescription, format, snsTopic string, filter InventoryFilter) (*glacier.InitiateJobInput, error) {
+	format, err := inventoryFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	input := &glacier.InitiateJobInput{
+		AccountId: aws.String("-"),
+		JobParameters: &glacier.JobParameters{
+			Description: aws.String(jobDescription),
+			Format:      aws.String(format),
+			Type:        aws.String("inventory-retrieval"),
+		},
+		VaultName: aws.String(vaultName),
+	}
+	if snsTopic != "" {
+		input.JobParameters.SNSTopic = aws.String(snsTopic)
+	}
+	if filter == (InventoryFilter{}) {
+		return input, nil
+	}
+	params := &glacier.InventoryRetrievalJobInput{}
+	if filter.StartDate != "" {
+		date, err := inventoryDate(filter.StartDate)
+		if err != nil {
+			return nil, err
+		}
+		params.StartDate = aws.String(date)
+	}
+	if filter.EndDate != "" {
+		date, err := inventoryDate(filter.EndDate)
+		if err != nil {
+			return nil, err
+		}
+		params.EndDate = aws.String(date)
+	}
+	if filter.Limit < 0 {
+		return nil, fmt.Errorf("limit must be positive")
+	}
+	if filter.Limit > 0 {
+		params.Limit = aws.String(strconv.Itoa(filter.Limit))
+	}
+	if filter.Marker != "" {
+		params.Marker = aws.String(filter.Marker)
+	}
+	input.JobParameters.InventoryRetrievalParameters = params
+	return input, nil
+}
+
+// inventoryChain - Job IDs of an inventory listed page by page through markers
+type inventoryChain struct {
+	JobIDs   []string `json:"jobIds"`
+	Filtered bool     `json:"filtered"`
+	Complete bool     `json:"complete"`
+}
+
+// inventoryChainPath - Location of the last followed inventory chain of a vault
+func inventoryChainPath(awsRegion, vaultName string) string {
+	return filepath.Join(siloDir(), "inventory", awsRegion, vaultName+".chain.json")
+}
+
+// save - Write the chain atomically
+func (c *inventoryChain) save(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadInventoryChain - Read the last followed inventory chain of a vault
+func loadInventoryChain(awsRegion, vaultName string) (*inventoryChain, error) {
+	data, err := ioutil.ReadFile(inventoryChainPath(awsRegion, vaultName))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no inventory chain for vault %s, run init-inventory-retrieval --all first", vaultName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var c inventoryChain
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// InventoryChainJobs - Job IDs of the last followed inventory chain of a vault
+func InventoryChainJobs(awsRegion, vaultName string) ([]string, error) {
+	c, err := loadInventoryChain(awsRegion, vaultName)
+	if err != nil {
+		return nil, err
+	}
+	if !c.Complete {
+		return nil, fmt.Errorf("inventory chain of %s is incomplete, run init-inventory-retrieval --all again", vaultName)
+	}
+	return c.JobIDs, nil
+}
+
+// inventoryComplete - Whether stitched pages cover the whole vault, which is required
+// before they may replace the local catalog. That is the case for a single job without
+// date filters, marker or limit, or for the complete unfiltered chain recorded by
+// FollowInventoryRetrieval.
+func inventoryComplete(awsRegion, vaultName string, jobs []*glacier.JobDescription) bool {
+	if len(jobs) == 1 {
+		params := jobs[0].InventoryRetrievalParameters
+		return params == nil || (aws.StringValue(params.StartDate) == "" &&
+			aws.StringValue(params.EndDate) == "" && aws.StringValue(params.Limit) == "" &&
+			aws.StringValue(params.Marker) == "")
+	}
+	c, err := loadInventoryChain(awsRegion, vaultName)
+	if err != nil || !c.Complete || c.Filtered || len(c.JobIDs) != len(jobs) {
+		return false
+	}
+	for i, job := range jobs {
+		if aws.StringValue(job.JobId) != c.JobIDs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// FollowInventoryRetrieval - List a whole vault through successive limited jobs.
+// Each job is waited for and the marker it returns starts the next one. The job IDs
+// are recorded so get-inventory --chain can stitch the pages together.
+func FollowInventoryRetrieval(awsRegion, vaultName, jobDescription, format, snsTopic string, filter InventoryFilter, poll PollOptions) {
+	svc := glacier.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
+	path := inventoryChainPath(awsRegion, vaultName)
+	chain := &inventoryChain{Filtered: filter.StartDate != "" || filter.EndDate != "" || filter.Marker != ""}
+	for {
+		input, err := inventoryRetrievalInput(vaultName, jobDescription, format, snsTopic, filter)
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		result, err := svc.InitiateJob(input)
+		if err != nil {
+			printGlacierError(err)
+			return
+		}
+		jobID := aws.StringValue(result.JobId)
+		fmt.Printf("submitted inventory-retrieval job %s\n", jobID)
+		chain.JobIDs = append(chain.JobIDs, jobID)
+		if err := chain.save(path); err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+
+		job, err := waitForJob(svc, vaultName, jobID, poll)
+		if err != nil {
+			printGlacierError(err)
+			return
+		}
+		if aws.StringValue(job.StatusCode) != glacier.StatusCodeSucceeded {
+			fmt.Printf("job %s %s: %s\n", jobID, aws.StringValue(job.StatusCode), aws.StringValue(job.StatusMessage))
+			return
+		}
+		marker := ""
+		if job.InventoryRetrievalParameters != nil {
+			marker = aws.StringValue(job.InventoryRetrievalParameters.Marker)
+		}
+		if marker == "" {
+			break
+		}
+		filter.Marker = marker
+	}
+	chain.Complete = true
+	if err := chain.save(path); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	printJSON(chain)
+}
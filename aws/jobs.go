@@ -0,0 +1,219 @@
+package aws
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/aws/aws-sdk-go/service/glacier/glacieriface"
+)
+
+// DefaultWatchInterval - Pause between redraws of list-jobs --watch
+const DefaultWatchInterval = time.Minute
+
+// inventoryRetrievalWait - Inventory jobs have no tier and usually finish within hours
+const inventoryRetrievalWait = 5 * time.Hour
+
+// JobFilter - Filters of list-jobs. Status and Completed are applied by Glacier,
+// Type is applied locally because ListJobs cannot filter on it.
+type JobFilter struct {
+	Status    string
+	Completed string
+	Type      string
+}
+
+// jobTypes - Command line job types and the Action Glacier reports for them
+var jobTypes = map[string]string{
+	"archive-retrieval":   glacier.ActionCodeArchiveRetrieval,
+	"inventory-retrieval": glacier.ActionCodeInventoryRetrieval,
+	"select":              glacier.ActionCodeSelect,
+}
+
+// jobListInput - Build a ListJobs request from the filter and return the Action to keep
+func jobListInput(vaultName string, filter JobFilter) (*glacier.ListJobsInput, string, error) {
+	input := &glacier.ListJobsInput{
+		AccountId: aws.String("-"),
+		VaultName: aws.String(vaultName),
+	}
+	if filter.Status != "" {
+		status := ""
+		for _, code := range glacier.StatusCode_Values() {
+			if strings.EqualFold(code, filter.Status) {
+				status = code
+			}
+		}
+		if status == "" {
+			return nil, "", fmt.Errorf("unknown job status %q, use %s", filter.Status, strings.Join(glacier.StatusCode_Values(), ", "))
+		}
+		input.Statuscode = aws.String(status)
+	}
+	switch strings.ToLower(filter.Completed) {
+	case "":
+	case "true", "false":
+		input.Completed = aws.String(strings.ToLower(filter.Completed))
+	default:
+		return nil, "", fmt.Errorf("--completed must be true or false, not %q", filter.Completed)
+	}
+	action := ""
+	if filter.Type != "" {
+		var ok bool
+		if action, ok = jobTypes[strings.ToLower(filter.Type)]; !ok {
+			return nil, "", fmt.Errorf("unknown job type %q, use archive-retrieval, inventory-retrieval or select", filter.Type)
+		}
+	}
+	return input, action, nil
+}
+
+// filterJobsByAction - Keep the jobs of one Action, all of them when action is empty
+func filterJobsByAction(jobs []*glacier.JobDescription, action string) []*glacier.JobDescription {
+	if action == "" {
+		return jobs
+	}
+	var kept []*glacier.JobDescription
+	for _, job := range jobs {
+		if aws.StringValue(job.Action) == action {
+			kept = append(kept, job)
+		}
+	}
+	return kept
+}
+
+// jobExpectedBy - Latest time the job should complete according to its tier
+func jobExpectedBy(job *glacier.JobDescription) (time.Time, bool) {
+	created, err := time.Parse(time.RFC3339, aws.StringValue(job.CreationDate))
+	if err != nil {
+		return time.Time{}, false
+	}
+	if aws.StringValue(job.Action) == glacier.ActionCodeInventoryRetrieval {
+		return created.Add(inventoryRetrievalWait), true
+	}
+	tier := aws.StringValue(job.Tier)
+	if tier == "" {
+		tier = glacierTierStandard
+	}
+	price, ok := retrievalPrices[tier]
+	if !ok {
+		return time.Time{}, false
+	}
+	return created.Add(price.MaxWait), true
+}
+
+// jobElapsed - Time a job has been running, or took when it is completed
+func jobElapsed(job *glacier.JobDescription, now time.Time) time.Duration {
+	created, err := time.Parse(time.RFC3339, aws.StringValue(job.CreationDate))
+	if err != nil {
+		return 0
+	}
+	if completed, err := time.Parse(time.RFC3339, aws.StringValue(job.CompletionDate)); err == nil && aws.BoolValue(job.Completed) {
+		now = completed
+	}
+	return now.Sub(created).Round(time.Second)
+}
+
+// shortJobID - Job IDs are long, the first characters are enough to tell jobs apart
+func shortJobID(jobID string) string {
+	if len(jobID) > 16 {
+		return jobID[:16]
+	}
+	return jobID
+}
+
+// writeJobTable - Write a compact table of jobs with elapsed time and expected completion
+func writeJobTable(w io.Writer, jobs []*glacier.JobDescription, now time.Time) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "JOB\tTYPE\tTIER\tSTATUS\tELAPSED\tEXPECTED BY\tDESCRIPTION")
+	for _, job := range jobs {
+		expected := "-"
+		if by, ok := jobExpectedBy(job); ok && !aws.BoolValue(job.Completed) {
+			expected = by.Local().Format("2006-01-02 15:04")
+			if by.Before(now) {
+				expected += " (overdue)"
+			}
+		}
+		tier := aws.StringValue(job.Tier)
+		if tier == "" {
+			tier = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			shortJobID(aws.StringValue(job.JobId)),
+			aws.StringValue(job.Action),
+			tier,
+			aws.StringValue(job.StatusCode),
+			jobElapsed(job, now),
+			expected,
+			aws.StringValue(job.JobDescription))
+	}
+	return tw.Flush()
+}
+
+// watchRows - Jobs to draw: every active job plus the ones seen active earlier, so a
+// job that finishes during the watch stays on screen with its final status.
+// It reports whether any of them is still running.
+func watchRows(jobs []*glacier.JobDescription, seen map[string]bool) ([]*glacier.JobDescription, bool) {
+	var rows []*glacier.JobDescription
+	active := false
+	for _, job := range jobs {
+		id := aws.StringValue(job.JobId)
+		if !aws.BoolValue(job.Completed) {
+			seen[id] = true
+			active = true
+		}
+		if seen[id] {
+			rows = append(rows, job)
+		}
+	}
+	return rows, active
+}
+
+// WatchJobs - Redraw a table of the active jobs of a vault every interval until all
+// of them have finished
+func WatchJobs(awsRegion, vaultName string, filter JobFilter, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultWatchInterval
+	}
+	// Completed jobs must stay listed so finished rows can show their final status
+	filter.Completed = ""
+	input, action, err := jobListInput(vaultName, filter)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	svc := glacier.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
+	seen := map[string]bool{}
+	for {
+		rows, active, err := pollJobs(svc, input, action, seen)
+		if err != nil {
+			printGlacierError(err)
+			return
+		}
+		// Clear the terminal and move the cursor home before redrawing
+		fmt.Print("\033[H\033[2J")
+		fmt.Printf("Jobs in %s at %s, refreshing every %s\n\n", vaultName, time.Now().Format("15:04:05"), interval)
+		if len(rows) == 0 {
+			fmt.Println("no active jobs")
+			return
+		}
+		writeJobTable(os.Stdout, rows, time.Now())
+		if !active {
+			fmt.Println("\nall jobs finished")
+			return
+		}
+		time.Sleep(interval)
+	}
+}
+
+// pollJobs - List the jobs once and pick the rows to draw
+func pollJobs(svc glacieriface.GlacierAPI, input *glacier.ListJobsInput, action string, seen map[string]bool) ([]*glacier.JobDescription, bool, error) {
+	result, err := listJobs(svc, input, PageOptions{})
+	if err != nil {
+		return nil, false, err
+	}
+	rows, active := watchRows(filterJobsByAction(result.JobList, action), seen)
+	return rows, active, nil
+}
@@ -0,0 +1,165 @@
+package aws
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/glacier"
+)
+
+// uploadJournal - Local record of a multipart upload so it can be resumed
+type uploadJournal struct {
+	UploadID  string         `json:"uploadId"`
+	Region    string         `json:"region"`
+	VaultName string         `json:"vaultName"`
+	File      string         `json:"file"`
+	Size      int64          `json:"size"`
+	ModTime   time.Time      `json:"modTime"`
+	PartSize  int64          `json:"partSize"`
+	Parts     map[int]string `json:"parts"`
+	path      string
+}
+
+// journalPath - Location of the journal for a file uploaded to a vault in a region
+func journalPath(awsRegion, vaultName, absFile string) string {
+	sum := sha256.Sum256([]byte(awsRegion + "\x00" + vaultName + "\x00" + absFile))
+	return filepath.Join(siloDir(), "uploads", hex.EncodeToString(sum[:8])+".json")
+}
+
+// newUploadJournal - Start a journal for a freshly initiated upload
+func newUploadJournal(awsRegion, vaultName, absFile string, info os.FileInfo, m *multipartUpload) *uploadJournal {
+	return &uploadJournal{
+		UploadID:  m.uploadID,
+		Region:    awsRegion,
+		VaultName: vaultName,
+		File:      absFile,
+		Size:      info.Size(),
+		ModTime:   info.ModTime(),
+		PartSize:  m.partSize,
+		Parts:     map[int]string{},
+		path:      journalPath(awsRegion, vaultName, absFile),
+	}
+}
+
+// loadUploadJournal - Read the journal for a file, nil if there is none
+func loadUploadJournal(awsRegion, vaultName, absFile string) (*uploadJournal, error) {
+	path := journalPath(awsRegion, vaultName, absFile)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var j uploadJournal
+	if err := json.Unmarshal(data, &j); err != nil {
+		return nil, fmt.Errorf("journal %s: %v", path, err)
+	}
+	if j.Region != awsRegion || j.VaultName != vaultName || j.File != absFile {
+		return nil, fmt.Errorf("journal %s records upload %s of %s to %s in %s, not to %s in %s", path, j.UploadID, j.File, j.VaultName, j.Region, vaultName, awsRegion)
+	}
+	j.path = path
+	return &j, nil
+}
+
+// save - Write the journal atomically so a crash never leaves it half written
+func (j *uploadJournal) save() error {
+	if err := os.MkdirAll(filepath.Dir(j.path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := j.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.path)
+}
+
+// remove - Delete the journal once the upload is completed or aborted
+func (j *uploadJournal) remove() {
+	os.Remove(j.path)
+}
+
+// matches - Check the file has not changed since the journal was written
+func (j *uploadJournal) matches(info os.FileInfo) bool {
+	return j.Size == info.Size() && j.ModTime.Equal(info.ModTime())
+}
+
+// verifiedParts - Parts recorded in the journal that Glacier also holds with the same tree hash
+func (j *uploadJournal) verifiedParts(m *multipartUpload) (map[int][]byte, error) {
+	remote := map[int]string{}
+	input := &glacier.ListPartsInput{
+		AccountId: aws.String("-"),
+		UploadId:  aws.String(m.uploadID),
+		VaultName: aws.String(m.vaultName),
+	}
+	var parseErr error
+	err := m.svc.ListPartsPages(input, func(page *glacier.ListPartsOutput, lastPage bool) bool {
+		for _, p := range page.Parts {
+			start, err := parseRangeStart(aws.StringValue(p.RangeInBytes))
+			if err != nil {
+				parseErr = err
+				return false
+			}
+			remote[int(start/m.partSize)] = aws.StringValue(p.SHA256TreeHash)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if parseErr != nil {
+		return nil, parseErr
+	}
+
+	done := map[int][]byte{}
+	for index, local := range j.Parts {
+		if remote[index] != local {
+			delete(j.Parts, index)
+			continue
+		}
+		sum, err := hex.DecodeString(local)
+		if err != nil {
+			delete(j.Parts, index)
+			continue
+		}
+		done[index] = sum
+	}
+	return done, nil
+}
+
+// parseRangeStart - First byte of a "start-end" range as returned by ListParts
+func parseRangeStart(rangeInBytes string) (int64, error) {
+	parts := strings.SplitN(rangeInBytes, "-", 2)
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("unexpected part range %q", rangeInBytes)
+	}
+	return strconv.ParseInt(parts[0], 10, 64)
+}
+
+// removeJournalsForUpload - Drop any local journal that refers to uploadID
+func removeJournalsForUpload(uploadID string) {
+	paths, _ := filepath.Glob(filepath.Join(siloDir(), "uploads", "*.json"))
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var j uploadJournal
+		if json.Unmarshal(data, &j) == nil && j.UploadID == uploadID {
+			os.Remove(path)
+		}
+	}
+}
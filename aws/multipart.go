@@ -0,0 +1,562 @@
+package aws
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/aws/aws-sdk-go/service/glacier/glacieriface"
+)
+
+const (
+	// minPartSize / maxPartSize - Glacier accepts power of two part sizes from 1 MiB to 4 GiB
+	minPartSize = 1 << 20
+	maxPartSize = 4 << 30
+	// maxParts - Glacier allows at most 10,000 parts per multipart upload
+	maxParts = 10000
+	// DefaultMultipartThreshold - Archives larger than this are uploaded in parts
+	DefaultMultipartThreshold = 100 << 20
+	// DefaultConcurrency - Number of parts uploaded at the same time
+	DefaultConcurrency = 4
+	// DefaultStreamPartSize - Part size for streams of unknown length, which caps a
+	// streamed archive at 10000 parts or 640 GiB
+	DefaultStreamPartSize = 64 << 20
+)
+
+// UploadOptions - Tuning knobs for archive uploads
+type UploadOptions struct {
+	// PartSize in bytes, zero picks the smallest size that fits the archive
+	PartSize int64
+	// Concurrency is the number of parts in flight
+	Concurrency int
+	// Threshold is the archive size above which multipart upload is used
+	Threshold int64
+	// Resume continues an interrupted multipart upload recorded in the journal
+	Resume bool
+	// Compress compresses the archive on the fly before it is uploaded
+	Compress CompressOptions
+	// Encrypt encrypts the archive, after compression, before it leaves the host
+	Encrypt EncryptOptions
+}
+
+// withDefaults - Fill in zero values
+func (o UploadOptions) withDefaults() UploadOptions {
+	if o.Concurrency <= 0 {
+		o.Concurrency = DefaultConcurrency
+	}
+	if o.Threshold <= 0 {
+		o.Threshold = DefaultMultipartThreshold
+	}
+	return o
+}
+
+// choosePartSize - Smallest valid part size that keeps the archive under maxParts
+func choosePartSize(archiveSize int64) int64 {
+	partSize := int64(minPartSize)
+	for partSize*maxParts < archiveSize && partSize < maxPartSize {
+		partSize *= 2
+	}
+	return partSize
+}
+
+// validPartSize - Check the part size is a power of two MiB within Glacier limits
+func validPartSize(partSize int64) error {
+	if partSize < minPartSize || partSize > maxPartSize || partSize&(partSize-1) != 0 {
+		return fmt.Errorf("part size %d must be a power of two between 1 MiB and 4 GiB", partSize)
+	}
+	return nil
+}
+
+// partCount - Number of parts needed for an archive
+func partCount(archiveSize, partSize int64) int {
+	if archiveSize == 0 {
+		return 1
+	}
+	return int((archiveSize + partSize - 1) / partSize)
+}
+
+// multipartUpload - State of one multipart upload in progress
+type multipartUpload struct {
+	svc         glacieriface.GlacierAPI
+	vaultName   string
+	uploadID    string
+	partSize    int64
+	concurrency int
+}
+
+// uploadPart - Hash and upload a single part, returning its tree hash
+func (m *multipartUpload) uploadPart(r io.ReaderAt, index int, archiveSize int64) ([]byte, error) {
+	start := int64(index) * m.partSize
+	size := m.partSize
+	if start+size > archiveSize {
+		size = archiveSize - start
+	}
+	return m.sendPart(io.NewSectionReader(r, start, size), index, start, size)
+}
+
+// sendPart - Hash and upload the size bytes of body that start at offset start
+func (m *multipartUpload) sendPart(body io.ReadSeeker, index int, start, size int64) ([]byte, error) {
+	th, err := computeTreeHash(body)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	input := &glacier.UploadMultipartPartInput{
+		AccountId: aws.String("-"),
+		Body:      body,
+		Checksum:  aws.String(th.HexSum()),
+		Range:     aws.String(fmt.Sprintf("bytes %d-%d/*", start, start+size-1)),
+		UploadId:  aws.String(m.uploadID),
+		VaultName: aws.String(m.vaultName),
+	}
+	result, err := m.svc.UploadMultipartPart(input)
+	if err != nil {
+		return nil, err
+	}
+	if aws.StringValue(result.Checksum) != th.HexSum() {
+		return nil, fmt.Errorf("part %d checksum mismatch: local %s, glacier %s", index, th.HexSum(), aws.StringValue(result.Checksum))
+	}
+	return th.Sum(), nil
+}
+
+// uploadParts - Upload every part not present in done using a pool of workers.
+// The returned slice holds the tree hash of each part in order.
+func (m *multipartUpload) uploadParts(r io.ReaderAt, archiveSize int64, done map[int][]byte, partDone func(int, []byte)) ([][]byte, error) {
+	count := partCount(archiveSize, m.partSize)
+	hashes := make([][]byte, count)
+	jobs := make(chan int)
+	var (
+		mu       sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	for w := 0; w < m.concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range jobs {
+				sum, err := m.uploadPart(r, index, archiveSize)
+				mu.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+					}
+				} else {
+					hashes[index] = sum
+					if partDone != nil {
+						partDone(index, sum)
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for index := 0; index < count; index++ {
+		if sum, ok := done[index]; ok {
+			hashes[index] = sum
+			continue
+		}
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+		jobs <- index
+	}
+	close(jobs)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return hashes, nil
+}
+
+// uploadStream - Upload a stream of unknown length part by part. Each part is read
+// into memory, so at most concurrency+1 parts are buffered at a time.
+// It returns the archive size and the tree hash of each part in order.
+func (m *multipartUpload) uploadStream(r io.Reader) (int64, [][]byte, error) {
+	type part struct {
+		index int
+		start int64
+		data  []byte
+	}
+	var (
+		mu       sync.Mutex
+		firstErr error
+		hashes   [][]byte
+		wg       sync.WaitGroup
+	)
+	jobs := make(chan part)
+	// Buffers are recycled through the pool and only allocated while it is short
+	buffers := make(chan []byte, m.concurrency+1)
+	allocated := 0
+	nextBuffer := func() []byte {
+		select {
+		case buf := <-buffers:
+			return buf
+		default:
+		}
+		if allocated < cap(buffers) {
+			allocated++
+			return make([]byte, m.partSize)
+		}
+		return <-buffers
+	}
+	for w := 0; w < m.concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range jobs {
+				sum, err := m.sendPart(bytes.NewReader(p.data), p.index, p.start, int64(len(p.data)))
+				buffers <- p.data[:cap(p.data)]
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				hashes[p.index] = sum
+				mu.Unlock()
+			}
+		}()
+	}
+
+	var (
+		size    int64
+		readErr error
+	)
+	for index := 0; ; index++ {
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+		buf := nextBuffer()
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+		}
+		if err != nil {
+			readErr = err
+			break
+		}
+		if n == 0 {
+			if index == 0 {
+				readErr = fmt.Errorf("nothing to upload, the stream is empty")
+			}
+			break
+		}
+		if index >= maxParts {
+			readErr = fmt.Errorf("stream needs more than %d parts of %d bytes, use a larger part size", maxParts, m.partSize)
+			break
+		}
+		mu.Lock()
+		hashes = append(hashes, nil)
+		mu.Unlock()
+		jobs <- part{index: index, start: size, data: buf[:n]}
+		size += int64(n)
+		if n < len(buf) {
+			break
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if readErr != nil {
+		return 0, nil, readErr
+	}
+	if firstErr != nil {
+		return 0, nil, firstErr
+	}
+	return size, hashes, nil
+}
+
+// uploadArchiveStream - Upload everything read from r as one archive. A stream cannot
+// be resumed, so the multipart upload is aborted when anything fails.
+func uploadArchiveStream(svc glacieriface.GlacierAPI, vaultName, description string, r io.Reader, opts UploadOptions) (*ArchiveUpload, error) {
+	opts = opts.withDefaults()
+	partSize := opts.PartSize
+	if partSize == 0 {
+		partSize = DefaultStreamPartSize
+	}
+	if err := validPartSize(partSize); err != nil {
+		return nil, err
+	}
+	// A stream that fits in one part is sent as a plain single-request upload
+	first := make([]byte, partSize)
+	n, err := io.ReadFull(r, first)
+	switch err {
+	case nil:
+	case io.EOF:
+		return nil, fmt.Errorf("nothing to upload, the stream is empty")
+	case io.ErrUnexpectedEOF:
+		return uploadArchiveBody(svc, vaultName, description, bytes.NewReader(first[:n]))
+	default:
+		return nil, err
+	}
+	m, err := initiateMultipartUpload(svc, vaultName, description, partSize, opts.Concurrency)
+	if err != nil {
+		return nil, err
+	}
+	size, hashes, err := m.uploadStream(io.MultiReader(bytes.NewReader(first), r))
+	var result *glacier.ArchiveCreationOutput
+	if err == nil {
+		result, err = m.complete(size, hashes)
+	}
+	if err != nil {
+		m.abort()
+		return nil, err
+	}
+	return &ArchiveUpload{
+		ArchiveID: aws.StringValue(result.ArchiveId),
+		Location:  aws.StringValue(result.Location),
+		Checksum:  aws.StringValue(result.Checksum),
+		Size:      size,
+	}, nil
+}
+
+// complete - Finish the upload once every part is in place
+func (m *multipartUpload) complete(archiveSize int64, hashes [][]byte) (*glacier.ArchiveCreationOutput, error) {
+	checksum := hex.EncodeToString(combineTreeHashes(hashes))
+	input := &glacier.CompleteMultipartUploadInput{
+		AccountId:   aws.String("-"),
+		ArchiveSize: aws.String(strconv.FormatInt(archiveSize, 10)),
+		Checksum:    aws.String(checksum),
+		UploadId:    aws.String(m.uploadID),
+		VaultName:   aws.String(m.vaultName),
+	}
+	result, err := m.svc.CompleteMultipartUpload(input)
+	if err != nil {
+		return nil, err
+	}
+	if aws.StringValue(result.Checksum) != checksum {
+		return nil, fmt.Errorf("archive checksum mismatch: local %s, glacier %s", checksum, aws.StringValue(result.Checksum))
+	}
+	return result, nil
+}
+
+// initiateMultipartUpload - Start a multipart upload and return its state
+func initiateMultipartUpload(svc glacieriface.GlacierAPI, vaultName, description string, partSize int64, concurrency int) (*multipartUpload, error) {
+	input := &glacier.InitiateMultipartUploadInput{
+		AccountId:          aws.String("-"),
+		ArchiveDescription: aws.String(description),
+		PartSize:           aws.String(strconv.FormatInt(partSize, 10)),
+		VaultName:          aws.String(vaultName),
+	}
+	result, err := svc.InitiateMultipartUpload(input)
+	if err != nil {
+		return nil, err
+	}
+	return &multipartUpload{
+		svc:         svc,
+		vaultName:   vaultName,
+		uploadID:    aws.StringValue(result.UploadId),
+		partSize:    partSize,
+		concurrency: concurrency,
+	}, nil
+}
+
+// UploadMultipartArchive - Upload a file to a vault in parts, several at a time.
+// Progress is journaled under ~/.silo so an interrupted upload can be continued
+// with opts.Resume.
+// Reference - https://docs.aws.amazon.com/amazonglacier/latest/dev/uploading-archive-mpu.html
+func UploadMultipartArchive(awsRegion, vaultName, fileUpload string, opts UploadOptions) {
+	opts = opts.withDefaults()
+	absFile, err := filepath.Abs(isFile(fileUpload))
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	f, err := os.Open(absFile)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	archiveSize := info.Size()
+	if archiveSize == 0 {
+		fmt.Printf("%s is empty, Glacier archives hold at least one byte\n", absFile)
+		return
+	}
+	svc := glacier.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
+
+	var (
+		m       *multipartUpload
+		journal *uploadJournal
+		done    map[int][]byte
+	)
+	journal, err = loadUploadJournal(awsRegion, vaultName, absFile)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	if !opts.Resume && journal != nil {
+		// A new upload would orphan the recorded one, which may hold many GB already;
+		// only the user decides to throw it away
+		fmt.Printf("upload %s of %s is still recorded, continue it with --resume or abort it with abort-multipart-upload\n", journal.UploadID, absFile)
+		return
+	}
+	if opts.Resume {
+		switch {
+		case journal == nil:
+			fmt.Printf("no interrupted upload of %s to %s, starting a new one\n", absFile, vaultName)
+		case !journal.matches(info):
+			fmt.Printf("%s changed since upload %s started, abort it with abort-multipart-upload and upload again\n", absFile, journal.UploadID)
+			return
+		default:
+			m = &multipartUpload{
+				svc:         svc,
+				vaultName:   vaultName,
+				uploadID:    journal.UploadID,
+				partSize:    journal.PartSize,
+				concurrency: opts.Concurrency,
+			}
+			done, err = journal.verifiedParts(m)
+			if err != nil {
+				printGlacierError(err)
+				return
+			}
+			fmt.Printf("resuming upload %s, %d of %d parts already uploaded\n", m.uploadID, len(done), partCount(archiveSize, m.partSize))
+		}
+	}
+
+	if m == nil {
+		partSize := opts.PartSize
+		if partSize == 0 {
+			partSize = choosePartSize(archiveSize)
+		}
+		if err := validPartSize(partSize); err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		if partCount(archiveSize, partSize) > maxParts {
+			fmt.Printf("part size %d is too small for %d bytes, at most %d parts are allowed\n", partSize, archiveSize, maxParts)
+			return
+		}
+		m, err = initiateMultipartUpload(svc, vaultName, getFilename(fileUpload), partSize, opts.Concurrency)
+		if err != nil {
+			printGlacierError(err)
+			return
+		}
+		journal = newUploadJournal(awsRegion, vaultName, absFile, info, m)
+	}
+	if err := journal.save(); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	hashes, err := m.uploadParts(f, archiveSize, done, func(index int, sum []byte) {
+		journal.Parts[index] = hex.EncodeToString(sum)
+		if err := journal.save(); err != nil {
+			fmt.Println(err.Error())
+		}
+	})
+	if err != nil {
+		printGlacierError(err)
+		fmt.Printf("upload %s interrupted, run again with --resume to continue\n", m.uploadID)
+		return
+	}
+	result, err := m.complete(archiveSize, hashes)
+	if err != nil {
+		printGlacierError(err)
+		return
+	}
+	journal.remove()
+	upload := ArchiveUpload{
+		ArchiveID: aws.StringValue(result.ArchiveId),
+		Location:  aws.StringValue(result.Location),
+		Checksum:  aws.StringValue(result.Checksum),
+		Size:      archiveSize,
+	}
+	if err := catalogRecordUpload(awsRegion, vaultName, getFilename(fileUpload), upload); err != nil {
+		fmt.Println("catalog:", err)
+	}
+	printJSON(upload)
+}
+
+// ListMultipartUploads - List in-progress multipart uploads for a vault
+func ListMultipartUploads(awsRegion, vaultName string) {
+	svc := glacier.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
+	input := &glacier.ListMultipartUploadsInput{
+		AccountId: aws.String("-"),
+		VaultName: aws.String(vaultName),
+	}
+	var uploads []*glacier.UploadListElement
+	err := svc.ListMultipartUploadsPages(input, func(page *glacier.ListMultipartUploadsOutput, lastPage bool) bool {
+		uploads = append(uploads, page.UploadsList...)
+		return true
+	})
+	if err != nil {
+		printGlacierError(err)
+		return
+	}
+	fmt.Println(uploads)
+}
+
+// AbortMultipartUpload - Abort a multipart upload and forget its local journal
+func AbortMultipartUpload(awsRegion, vaultName, uploadID string) {
+	m := &multipartUpload{
+		svc:       glacier.New(session.New(), aws.NewConfig().WithRegion(awsRegion)),
+		vaultName: vaultName,
+		uploadID:  uploadID,
+	}
+	if m.abort() {
+		removeJournalsForUpload(uploadID)
+	}
+}
+
+// abort - Abort the upload so Glacier discards the parts already stored
+func (m *multipartUpload) abort() bool {
+	input := &glacier.AbortMultipartUploadInput{
+		AccountId: aws.String("-"),
+		UploadId:  aws.String(m.uploadID),
+		VaultName: aws.String(m.vaultName),
+	}
+	if _, err := m.svc.AbortMultipartUpload(input); err != nil {
+		printGlacierError(err)
+		// An upload Glacier no longer knows is as good as aborted
+		aerr, ok := err.(awserr.Error)
+		return ok && aerr.Code() == glacier.ErrCodeResourceNotFoundException
+	}
+	fmt.Printf("Multipart upload %s aborted on %s \n", m.uploadID, m.vaultName)
+	return true
+}
+
+// printGlacierError - Print an error the way the other glacier commands do
+func printGlacierError(err error) {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case glacier.ErrCodeResourceNotFoundException:
+			fmt.Println(glacier.ErrCodeResourceNotFoundException, aerr.Error())
+		case glacier.ErrCodeInvalidParameterValueException:
+			fmt.Println(glacier.ErrCodeInvalidParameterValueException, aerr.Error())
+		case glacier.ErrCodeMissingParameterValueException:
+			fmt.Println(glacier.ErrCodeMissingParameterValueException, aerr.Error())
+		case glacier.ErrCodeRequestTimeoutException:
+			fmt.Println(glacier.ErrCodeRequestTimeoutException, aerr.Error())
+		case glacier.ErrCodeServiceUnavailableException:
+			fmt.Println(glacier.ErrCodeServiceUnavailableException, aerr.Error())
+		default:
+			fmt.Println(aerr.Error())
+		}
+	} else {
+		// Print the error, cast err to awserr.Error to get the Code and
+		// Message from an error.
+		fmt.Println(err.Error())
+	}
+}
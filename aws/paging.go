@@ -0,0 +1,150 @@
+package aws
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/aws/aws-sdk-go/service/glacier/glacieriface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// Largest page each list API returns
+const (
+	glacierPageLimit = 1000
+	s3PageLimit      = 1000
+)
+
+// PageOptions - Manual paging for the list commands. With MaxItems zero every page is
+// fetched; otherwise listing stops after MaxItems and the token to continue is printed.
+type PageOptions struct {
+	MaxItems      int64
+	StartingToken string
+}
+
+// pageLimit - Request size for the next page so a page never overshoots MaxItems
+func (p PageOptions) pageLimit(fetched, apiLimit int64) int64 {
+	if p.MaxItems <= 0 {
+		return apiLimit
+	}
+	if left := p.MaxItems - fetched; left < apiLimit {
+		return left
+	}
+	return apiLimit
+}
+
+// done - Whether MaxItems has been reached
+func (p PageOptions) done(fetched int64) bool {
+	return p.MaxItems > 0 && fetched >= p.MaxItems
+}
+
+// listVaults - Follow the Marker of ListVaults until every vault or MaxItems is listed.
+// Marker of the result is set when there are more vaults to list.
+func listVaults(svc glacieriface.GlacierAPI, page PageOptions) (*glacier.ListVaultsOutput, error) {
+	all := &glacier.ListVaultsOutput{}
+	marker := page.StartingToken
+	for {
+		input := &glacier.ListVaultsInput{
+			AccountId: aws.String("-"),
+			Limit:     aws.String(strconv.FormatInt(page.pageLimit(int64(len(all.VaultList)), glacierPageLimit), 10)),
+		}
+		if marker != "" {
+			input.Marker = aws.String(marker)
+		}
+		result, err := svc.ListVaults(input)
+		if err != nil {
+			return nil, err
+		}
+		all.VaultList = append(all.VaultList, result.VaultList...)
+		marker = aws.StringValue(result.Marker)
+		if marker == "" || page.done(int64(len(all.VaultList))) {
+			break
+		}
+	}
+	if marker != "" {
+		all.Marker = aws.String(marker)
+	}
+	return all, nil
+}
+
+// listJobs - Follow the Marker of ListJobs until every job or MaxItems is listed.
+// input carries the filters; its Marker and Limit are managed here.
+func listJobs(svc glacieriface.GlacierAPI, input *glacier.ListJobsInput, page PageOptions) (*glacier.ListJobsOutput, error) {
+	all := &glacier.ListJobsOutput{}
+	marker := page.StartingToken
+	for {
+		input.Limit = aws.String(strconv.FormatInt(page.pageLimit(int64(len(all.JobList)), glacierPageLimit), 10))
+		input.Marker = nil
+		if marker != "" {
+			input.Marker = aws.String(marker)
+		}
+		result, err := svc.ListJobs(input)
+		if err != nil {
+			return nil, err
+		}
+		all.JobList = append(all.JobList, result.JobList...)
+		marker = aws.StringValue(result.Marker)
+		if marker == "" || page.done(int64(len(all.JobList))) {
+			break
+		}
+	}
+	if marker != "" {
+		all.Marker = aws.String(marker)
+	}
+	return all, nil
+}
+
+// listObjects - Follow the ContinuationToken of ListObjectsV2 until every key or MaxItems
+// is listed. With a delimiter, common prefixes count as items the way S3 counts them.
+func listObjects(svc s3iface.S3API, bucketName, prefix, delimiter string, page PageOptions) (*s3.ListObjectsV2Output, error) {
+	all := &s3.ListObjectsV2Output{Name: aws.String(bucketName)}
+	if prefix != "" {
+		all.Prefix = aws.String(prefix)
+	}
+	if delimiter != "" {
+		all.Delimiter = aws.String(delimiter)
+	}
+	token := page.StartingToken
+	var fetched int64
+	for {
+		input := &s3.ListObjectsV2Input{
+			Bucket:    aws.String(bucketName),
+			Delimiter: all.Delimiter,
+			MaxKeys:   aws.Int64(page.pageLimit(fetched, s3PageLimit)),
+			Prefix:    all.Prefix,
+		}
+		if token != "" {
+			input.ContinuationToken = aws.String(token)
+		}
+		result, err := svc.ListObjectsV2(input)
+		if err != nil {
+			return nil, err
+		}
+		all.Contents = append(all.Contents, result.Contents...)
+		all.CommonPrefixes = append(all.CommonPrefixes, result.CommonPrefixes...)
+		fetched += aws.Int64Value(result.KeyCount)
+		token = ""
+		if aws.BoolValue(result.IsTruncated) {
+			token = aws.StringValue(result.NextContinuationToken)
+		}
+		if token == "" || page.done(fetched) {
+			break
+		}
+	}
+	all.KeyCount = aws.Int64(fetched)
+	all.IsTruncated = aws.Bool(token != "")
+	if token != "" {
+		all.NextContinuationToken = aws.String(token)
+	}
+	return all, nil
+}
+
+// printNextToken - Tell how to continue a listing cut short by --max-items
+func printNextToken(token *string) {
+	if t := aws.StringValue(token); t != "" {
+		fmt.Fprintf(os.Stderr, "more results, continue with --starting-token %s\n", t)
+	}
+}
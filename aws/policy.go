@@ -0,0 +1,117 @@
+package aws
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// vaultPolicy - Just enough of an IAM policy document to check it before upload
+type vaultPolicy struct {
+	Version   string          `json:"Version"`
+	Statement json.RawMessage `json:"Statement"`
+}
+
+// policyStatement - Single statement of a vault policy
+type policyStatement struct {
+	Sid       string          `json:"Sid"`
+	Effect    string          `json:"Effect"`
+	Principal json.RawMessage `json:"Principal"`
+	Resource  json.RawMessage `json:"Resource"`
+}
+
+// stringOrList - Decode a policy value that may be a string or a list of strings
+func stringOrList(raw json.RawMessage) ([]string, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var one string
+	if err := json.Unmarshal(raw, &one); err == nil {
+		return []string{one}, nil
+	}
+	var many []string
+	if err := json.Unmarshal(raw, &many); err != nil {
+		return nil, err
+	}
+	return many, nil
+}
+
+// statements - Statement may be a single object or a list of them
+func (p *vaultPolicy) statements() ([]policyStatement, error) {
+	var many []policyStatement
+	if err := json.Unmarshal(p.Statement, &many); err == nil {
+		return many, nil
+	}
+	var one policyStatement
+	if err := json.Unmarshal(p.Statement, &one); err != nil {
+		return nil, fmt.Errorf("policy Statement: %v", err)
+	}
+	return []policyStatement{one}, nil
+}
+
+// isEveryone - Whether a principal grants access to anybody: "*" or {"AWS": "*"}
+func isEveryone(raw json.RawMessage) (bool, error) {
+	if len(raw) == 0 {
+		return false, nil
+	}
+	var one string
+	if err := json.Unmarshal(raw, &one); err == nil {
+		return one == "*", nil
+	}
+	var byType map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &byType); err != nil {
+		return false, fmt.Errorf("policy Principal: %v", err)
+	}
+	ids, err := stringOrList(byType["AWS"])
+	if err != nil {
+		return false, fmt.Errorf("policy Principal: %v", err)
+	}
+	for _, id := range ids {
+		if id == "*" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// validateVaultPolicy - Check a policy document locally before it is sent to Glacier.
+// It must parse, every Resource must be the vault itself, and unless force is set no
+// Allow statement may name a bare "*" principal.
+func validateVaultPolicy(document []byte, vaultARN string, force bool) error {
+	var policy vaultPolicy
+	if err := json.Unmarshal(document, &policy); err != nil {
+		return fmt.Errorf("policy is not valid JSON: %v", err)
+	}
+	if len(policy.Statement) == 0 {
+		return fmt.Errorf("policy has no Statement")
+	}
+	statements, err := policy.statements()
+	if err != nil {
+		return err
+	}
+	for i, st := range statements {
+		name := st.Sid
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		resources, err := stringOrList(st.Resource)
+		if err != nil {
+			return fmt.Errorf("statement %s Resource: %v", name, err)
+		}
+		if len(resources) == 0 {
+			return fmt.Errorf("statement %s has no Resource", name)
+		}
+		for _, r := range resources {
+			if r != vaultARN {
+				return fmt.Errorf("statement %s resource %s does not match vault %s", name, r, vaultARN)
+			}
+		}
+		everyone, err := isEveryone(st.Principal)
+		if err != nil {
+			return fmt.Errorf("statement %s: %v", name, err)
+		}
+		if everyone && st.Effect == "Allow" && !force {
+			return fmt.Errorf("statement %s allows principal \"*\", use --force if that is intended", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,593 @@
+package aws
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/aws/aws-sdk-go/service/glacier/glacieriface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+const (
+	// DefaultPackSize - Plain bytes of chunks collected into one pack file
+	DefaultPackSize = 16 << 20
+	// repoVersion - Format version written into the repository config
+	repoVersion = 1
+	// repoConfigName - Unencrypted settings every other repository file depends on
+	repoConfigName = "config.json"
+	// repoIndexDir and repoSnapshotDir hold the sealed pack indexes and snapshots
+	repoIndexDir    = "index"
+	repoSnapshotDir = "snapshots"
+	// repoLookupDir holds the chunk IDs of every pack, which is all a backup needs to
+	// deduplicate. They are sealed like the indexes unless a backup asked for them in
+	// the clear.
+	repoLookupDir = "lookup"
+	// repoMetaCodec - Indexes and snapshots are small JSON documents that compress well
+	repoMetaCodec = CompressZstd
+)
+
+// errNotInRepo - A repository file that does not exist
+var errNotInRepo = errors.New("not found in the repository")
+
+// RepoInitOptions - Settings of a new deduplicating repository
+type RepoInitOptions struct {
+	// Repo is a local directory or s3://bucket/prefix holding the config, indexes
+	// and snapshots
+	Repo string
+	// Packs is glacier://vault or s3://bucket/prefix, defaults to Repo when it is in S3
+	Packs string
+	// AvgChunkSize is the average content-defined chunk size, a power of two
+	AvgChunkSize int
+	// PackSize is the amount of chunk data collected into each pack
+	PackSize int
+	// Compress compresses every pack
+	Compress CompressOptions
+}
+
+// repoConfig - Layout of a repository, fixed when it is created
+type repoConfig struct {
+	Version     int         `json:"version"`
+	Packs       string      `json:"packs"`
+	Chunking    chunkParams `json:"chunking"`
+	PackSize    int         `json:"packSize"`
+	Compression string      `json:"compression,omitempty"`
+	Level       int         `json:"level,omitempty"`
+	Created     time.Time   `json:"created"`
+}
+
+// compress - Compression of new packs
+func (c repoConfig) compress() CompressOptions {
+	return CompressOptions{Codec: c.Compression, Level: c.Level}
+}
+
+// repoStore - Where the config, pack indexes and snapshots of a repository live
+type repoStore interface {
+	put(name string, data []byte) error
+	get(name string) ([]byte, error)
+	list(dir string) ([]string, error)
+}
+
+// localStore - Repository metadata in a local directory
+type localStore struct {
+	dir string
+}
+
+// put - Write a file atomically through a temporary file
+func (s *localStore) put(name string, data []byte) error {
+	path := filepath.Join(s.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// get - Read a file
+func (s *localStore) get(name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, filepath.FromSlash(name)))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s: %w", name, errNotInRepo)
+	}
+	return data, err
+}
+
+// list - Names of the files in a directory, sorted
+func (s *localStore) list(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(s.dir, filepath.FromSlash(dir)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		if info.Mode().IsRegular() && !strings.HasSuffix(info.Name(), ".tmp") {
+			names = append(names, dir+"/"+info.Name())
+		}
+	}
+	return names, nil
+}
+
+// s3Store - Repository metadata below an S3 prefix
+type s3Store struct {
+	svc    s3iface.S3API
+	bucket string
+	prefix string
+}
+
+// key - Key of a repository file
+func (s *s3Store) key(name string) string {
+	if prefix := strings.TrimSuffix(s.prefix, "/"); prefix != "" {
+		return prefix + "/" + name
+	}
+	return name
+}
+
+// put - Store a small object in one request
+func (s *s3Store) put(name string, data []byte) error {
+	_, err := s.svc.PutObject(&s3.PutObjectInput{
+		Body:   bytes.NewReader(data),
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(name)),
+	})
+	return err
+}
+
+// get - Read a whole object
+func (s *s3Store) get(name string) ([]byte, error) {
+	result, err := s.svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(name)),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, fmt.Errorf("%s: %w", name, errNotInRepo)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer result.Body.Close()
+	return ioutil.ReadAll(result.Body)
+}
+
+// list - Names of the objects below a directory, sorted
+func (s *s3Store) list(dir string) ([]string, error) {
+	var names []string
+	prefix := s.key(dir) + "/"
+	err := s.svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			names = append(names, dir+"/"+strings.TrimPrefix(aws.StringValue(obj.Key), prefix))
+		}
+		return true
+	})
+	return names, err
+}
+
+// repository - An opened repository with the services its packs need
+type repository struct {
+	store   repoStore
+	config  repoConfig
+	packs   *backupTarget
+	s3      s3iface.S3API
+	glacier glacieriface.GlacierAPI
+	region  string
+}
+
+// newRepoStore - Store for a local directory or an s3://bucket/prefix location.
+// Glacier cannot hold indexes: reading one would need a retrieval job each time.
+func newRepoStore(svc s3iface.S3API, location string) (repoStore, error) {
+	switch {
+	case location == "":
+		return nil, fmt.Errorf("a repository location is required, use --repo")
+	case strings.HasPrefix(location, "glacier://"):
+		return nil, fmt.Errorf("repository %q: indexes stay in S3 or a local directory, use --packs %s to keep the packs in Glacier", location, location)
+	case strings.HasPrefix(location, "s3://"):
+		bucket, prefix, err := parseS3URL(location)
+		if err != nil {
+			return nil, err
+		}
+		return &s3Store{svc: svc, bucket: bucket, prefix: prefix}, nil
+	}
+	dir, err := filepath.Abs(location)
+	if err != nil {
+		return nil, err
+	}
+	return &localStore{dir: dir}, nil
+}
+
+// openRepo - Read the config of an existing repository
+func openRepo(awsRegion, location string) (*repository, error) {
+	sess := session.New()
+	r := &repository{
+		s3:      s3.New(sess, aws.NewConfig().WithRegion(awsRegion)),
+		glacier: glacier.New(sess, aws.NewConfig().WithRegion(awsRegion)),
+		region:  awsRegion,
+	}
+	var err error
+	if r.store, err = newRepoStore(r.s3, location); err != nil {
+		return nil, err
+	}
+	data, err := r.store.get(repoConfigName)
+	if errors.Is(err, errNotInRepo) {
+		return nil, fmt.Errorf("%s is not a repository, create it with repo init", location)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &r.config); err != nil {
+		return nil, fmt.Errorf("%s: %v", repoConfigName, err)
+	}
+	if r.config.Version != repoVersion {
+		return nil, fmt.Errorf("repository format %d is not supported", r.config.Version)
+	}
+	if r.packs, err = parseBackupTarget(r.config.Packs); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// sealBytes - Compress and, with keys, encrypt a repository document
+func sealBytes(data []byte, enc *encryptor) ([]byte, error) {
+	var sealed bytes.Buffer
+	if err := sealTo(&sealed, bytes.NewReader(data), CompressOptions{Codec: repoMetaCodec}, enc); err != nil {
+		return nil, err
+	}
+	return sealed.Bytes(), nil
+}
+
+// unsealBytes - Decrypt and expand a repository document, which must carry the
+// encryption header when encrypted is set
+func unsealBytes(data []byte, encrypted bool, keys DecryptOptions) ([]byte, error) {
+	r, _, err := unsealReader(bytes.NewReader(data), repoMetaCodec, encrypted, keys)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// putJSON - Store v sealed under dir/id
+func (r *repository) putJSON(dir, id string, v interface{}, enc *encryptor) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	if data, err = sealBytes(data, enc); err != nil {
+		return "", err
+	}
+	name := dir + "/" + id + ".json" + sealedExt(CompressOptions{Codec: repoMetaCodec}, enc)
+	return name, r.store.put(name, data)
+}
+
+// getJSON - Read the sealed document name into v
+func (r *repository) getJSON(name string, v interface{}, keys DecryptOptions) error {
+	data, err := r.store.get(name)
+	if err != nil {
+		return err
+	}
+	if data, err = unsealBytes(data, strings.HasSuffix(name, encryptedExt), keys); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+// docID - ID of a repository document from its name
+func docID(name string) string {
+	base := name[strings.LastIndex(name, "/")+1:]
+	if i := strings.Index(base, "."); i >= 0 {
+		return base[:i]
+	}
+	return base
+}
+
+// packChunk - Where a chunk sits inside the plain bytes of a pack
+type packChunk struct {
+	ID     string `json:"id"`
+	Offset int64  `json:"offset"`
+	Length int    `json:"length"`
+}
+
+// packIndex - Location and content of one pack file, stored next to the snapshots
+type packIndex struct {
+	Pack      string      `json:"pack"`
+	Key       string      `json:"key,omitempty"`
+	ArchiveID string      `json:"archiveId,omitempty"`
+	TreeHash  string      `json:"treeHash,omitempty"`
+	Size      int64       `json:"size"`
+	Compress  string      `json:"compression,omitempty"`
+	Encrypted bool        `json:"encrypted,omitempty"`
+	Chunks    []packChunk `json:"chunks"`
+}
+
+// chunkLocation - Pack and position of a stored chunk
+type chunkLocation struct {
+	pack   *packIndex
+	offset int64
+	length int
+}
+
+// packLookup - Chunk IDs of one pack. They are SHA-256 hashes of the plain chunks, so
+// in the clear they tell anyone who can read the repository whether it holds a known
+// file; that is only done when encrypting to recipients whose private key is elsewhere.
+type packLookup struct {
+	Pack   string   `json:"pack"`
+	Chunks []string `json:"chunks"`
+}
+
+// knownChunks - IDs of every chunk the repository holds, read from the lookups. A
+// pack whose lookup is missing, after an interrupted flush, falls back to its index.
+// Packs the keys cannot open are reported and their chunks are stored again.
+func (r *repository) knownChunks(keys DecryptOptions) (map[string]bool, error) {
+	known := map[string]bool{}
+	covered := map[string]bool{}
+	var (
+		skipped  int
+		firstErr error
+	)
+	skip := func(pack string, err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+		skipped++
+		covered[pack] = true
+	}
+	names, err := r.store.list(repoLookupDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		l := &packLookup{}
+		if err := r.getJSON(name, l, keys); err != nil {
+			skip(docID(name), err)
+			continue
+		}
+		for _, id := range l.Chunks {
+			known[id] = true
+		}
+		covered[docID(name)] = true
+	}
+	indexes, err := r.store.list(repoIndexDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range indexes {
+		if covered[docID(name)] {
+			continue
+		}
+		idx := &packIndex{}
+		if err := r.getJSON(name, idx, keys); err != nil {
+			skip(docID(name), err)
+			continue
+		}
+		for _, c := range idx.Chunks {
+			known[c.ID] = true
+		}
+	}
+	if skipped > 0 {
+		fmt.Fprintf(os.Stderr, "%v\nthe chunks of %d packs are stored again; pass --key-file, or back up with --clear-chunk-ids when encrypting only to recipients\n", firstErr, skipped)
+	}
+	return known, nil
+}
+
+// loadIndexes - Every pack index of the repository by chunk ID
+func (r *repository) loadIndexes(keys DecryptOptions) (map[string]chunkLocation, error) {
+	names, err := r.store.list(repoIndexDir)
+	if err != nil {
+		return nil, err
+	}
+	chunks := map[string]chunkLocation{}
+	for _, name := range names {
+		idx := &packIndex{}
+		if err := r.getJSON(name, idx, keys); err != nil {
+			return nil, err
+		}
+		for _, c := range idx.Chunks {
+			chunks[c.ID] = chunkLocation{pack: idx, offset: c.Offset, length: c.Length}
+		}
+	}
+	return chunks, nil
+}
+
+// packKey - S3 key of a pack, spread over 256 directories
+func (r *repository) packKey(id string, enc *encryptor) string {
+	return r.packs.key("packs/" + id[:2] + "/" + id + sealedExt(r.config.compress(), enc))
+}
+
+// packWriter - Collects new chunks into packs and uploads each full pack
+type packWriter struct {
+	repo   *repository
+	enc    *encryptor
+	upload UploadOptions
+	s3opts S3UploadOptions
+	known  map[string]bool
+	buf    bytes.Buffer
+	chunks []packChunk
+
+	// clearLookup stores the chunk IDs of new packs unencrypted
+	clearLookup bool
+
+	packs     int
+	newChunks int
+	newBytes  int64
+	stored    int64
+}
+
+// add - Queue a chunk unless the repository already holds it
+func (w *packWriter) add(id string, data []byte) error {
+	if w.known[id] {
+		return nil
+	}
+	w.chunks = append(w.chunks, packChunk{ID: id, Offset: int64(w.buf.Len()), Length: len(data)})
+	w.buf.Write(data)
+	// Later copies in the same run are deduplicated against the pending pack
+	w.known[id] = true
+	w.newChunks++
+	w.newBytes += int64(len(data))
+	if w.buf.Len() >= w.repo.config.PackSize {
+		return w.flush()
+	}
+	return nil
+}
+
+// flush - Upload the pending pack, then record its index and its lookup. A pack
+// without an index is never referenced, so an interrupted run only leaves unused data
+// behind; the lookup comes last so no chunk is skipped that cannot be restored.
+func (w *packWriter) flush() error {
+	if len(w.chunks) == 0 {
+		return nil
+	}
+	sum := sha256.Sum256(w.buf.Bytes())
+	idx := &packIndex{Pack: hex.EncodeToString(sum[:]), Compress: w.repo.config.Compression, Encrypted: w.enc != nil, Chunks: w.chunks}
+	if w.repo.packs.vault != "" {
+		description := archiveDescription("silo-pack "+idx.Pack, idx.Compress)
+		sealed, err := sealReader(bytes.NewReader(w.buf.Bytes()), w.repo.config.compress(), w.enc)
+		if err != nil {
+			return err
+		}
+		upload, err := uploadArchiveStream(w.repo.glacier, w.repo.packs.vault, description, sealed, w.upload)
+		sealed.Close()
+		if err != nil {
+			return err
+		}
+		idx.ArchiveID, idx.TreeHash, idx.Size = upload.ArchiveID, upload.Checksum, upload.Size
+		upload.Compression = idx.Compress
+		if w.enc != nil {
+			upload.Encryption, upload.KeyIDs = w.enc.algorithm, w.enc.keyIDs()
+		}
+		if err := catalogRecordUpload(w.repo.region, w.repo.packs.vault, description, *upload); err != nil {
+			fmt.Fprintln(os.Stderr, "catalog:", err)
+		}
+	} else {
+		s3opts := w.s3opts
+		s3opts.Compress, s3opts.enc = w.repo.config.compress(), w.enc
+		upload, err := uploadStream(w.repo.s3, w.repo.packs.bucket, w.repo.packKey(idx.Pack, w.enc), bytes.NewReader(w.buf.Bytes()), int64(w.buf.Len()), s3opts)
+		if err != nil {
+			return err
+		}
+		idx.Key, idx.Size = upload.Key, upload.Size
+	}
+	if _, err := w.repo.putJSON(repoIndexDir, idx.Pack, idx, w.enc); err != nil {
+		return err
+	}
+	lookup := &packLookup{Pack: idx.Pack, Chunks: make([]string, len(idx.Chunks))}
+	for i, c := range idx.Chunks {
+		lookup.Chunks[i] = c.ID
+	}
+	lookupEnc := w.enc
+	if w.clearLookup {
+		lookupEnc = nil
+	}
+	if _, err := w.repo.putJSON(repoLookupDir, idx.Pack, lookup, lookupEnc); err != nil {
+		return err
+	}
+	w.packs++
+	w.stored += idx.Size
+	w.buf.Reset()
+	w.chunks = nil
+	return nil
+}
+
+// RepoInit - Create a deduplicating repository: its config goes to the repository
+// location and fixes the chunking, pack size and pack destination for good.
+func RepoInit(awsRegion string, opts RepoInitOptions) {
+	if err := opts.Compress.validate(); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	if opts.AvgChunkSize == 0 {
+		opts.AvgChunkSize = DefaultAvgChunkSize
+	}
+	params, err := newChunkParams(opts.AvgChunkSize)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	if opts.PackSize == 0 {
+		opts.PackSize = DefaultPackSize
+	}
+	if opts.PackSize < params.Max {
+		fmt.Printf("pack size %d must hold at least one maximum chunk of %d bytes\n", opts.PackSize, params.Max)
+		return
+	}
+	if opts.Packs == "" {
+		if !strings.HasPrefix(opts.Repo, "s3://") {
+			fmt.Println("a local repository needs a pack destination, use --packs glacier://vault or s3://bucket/prefix")
+			return
+		}
+		opts.Packs = opts.Repo
+	}
+	if _, err := parseBackupTarget(opts.Packs); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	svc := s3.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
+	store, err := newRepoStore(svc, opts.Repo)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	if _, err := store.get(repoConfigName); err == nil {
+		fmt.Printf("%s is already a repository\n", opts.Repo)
+		return
+	} else if !errors.Is(err, errNotInRepo) {
+		printS3Error(err)
+		return
+	}
+	config := repoConfig{
+		Version:     repoVersion,
+		Packs:       opts.Packs,
+		Chunking:    params,
+		PackSize:    opts.PackSize,
+		Compression: opts.Compress.Codec,
+		Level:       opts.Compress.Level,
+		Created:     time.Now().UTC(),
+	}
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	if err := store.put(repoConfigName, data); err != nil {
+		printS3Error(err)
+		return
+	}
+	printJSON(config)
+}
+
+// sortedPacks - The distinct packs behind a set of chunk locations, in a stable order
+func sortedPacks(locations map[string]chunkLocation) []*packIndex {
+	seen := map[string]*packIndex{}
+	for _, loc := range locations {
+		seen[loc.pack.Pack] = loc.pack
+	}
+	packs := make([]*packIndex, 0, len(seen))
+	for _, p := range seen {
+		packs = append(packs, p)
+	}
+	sort.Slice(packs, func(i, j int) bool { return packs[i].Pack < packs[j].Pack })
+	return packs
+}
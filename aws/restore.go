@@ -0,0 +1,374 @@
+package aws
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/aws/aws-sdk-go/service/glacier/glacieriface"
+)
+
+const (
+	// DefaultPollInterval - First pause between DescribeJob calls while a restore waits
+	DefaultPollInterval = 30 * time.Second
+	// DefaultMaxPollInterval - Longest pause between DescribeJob calls
+	DefaultMaxPollInterval = 15 * time.Minute
+)
+
+// PollOptions - How often to check on a Glacier job while waiting for it
+type PollOptions struct {
+	Interval    time.Duration
+	MaxInterval time.Duration
+}
+
+// withDefaults - Fill in zero values
+func (o PollOptions) withDefaults() PollOptions {
+	if o.Interval <= 0 {
+		o.Interval = DefaultPollInterval
+	}
+	if o.MaxInterval < o.Interval {
+		o.MaxInterval = DefaultMaxPollInterval
+	}
+	return o
+}
+
+// RestoreOptions - Settings for a restore run
+type RestoreOptions struct {
+	Tier     string
+	Range    string
+	Poll     PollOptions
+	Download DownloadOptions
+}
+
+// restoreState - Local record of a restore so it survives process restarts
+type restoreState struct {
+	Region    string    `json:"region"`
+	VaultName string    `json:"vaultName"`
+	ArchiveID string    `json:"archiveId"`
+	Range     string    `json:"range,omitempty"`
+	Tier      string    `json:"tier"`
+	File      string    `json:"file"`
+	JobID     string    `json:"jobId"`
+	Submitted time.Time `json:"submitted"`
+	path      string
+}
+
+// restoreStatePath - Location of the state file for one archive restore
+func restoreStatePath(awsRegion, vaultName, archiveID, byteRange string) string {
+	sum := sha256.Sum256([]byte(awsRegion + "\x00" + vaultName + "\x00" + archiveID + "\x00" + byteRange))
+	return filepath.Join(siloDir(), "restores", hex.EncodeToString(sum[:8])+".json")
+}
+
+// loadRestoreState - Read the state of an earlier restore, nil if there is none
+func loadRestoreState(path string) (*restoreState, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var st restoreState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, fmt.Errorf("restore state %s: %v", path, err)
+	}
+	st.path = path
+	return &st, nil
+}
+
+// save - Write the state atomically
+func (st *restoreState) save() error {
+	if err := os.MkdirAll(filepath.Dir(st.path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := st.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, st.path)
+}
+
+// remove - Forget the restore once it finished
+func (st *restoreState) remove() {
+	os.Remove(st.path)
+}
+
+// submit - Start a new archive-retrieval job for the restore
+func (st *restoreState) submit(svc glacieriface.GlacierAPI) error {
+	input, err := archiveRetrievalInput(st.VaultName, "silo-restore "+getFilename(st.File), st.ArchiveID, st.Range, st.Tier, "")
+	if err != nil {
+		return err
+	}
+	result, err := svc.InitiateJob(input)
+	if err != nil {
+		return err
+	}
+	st.JobID = aws.StringValue(result.JobId)
+	st.Submitted = time.Now().UTC()
+	fmt.Printf("submitted %s archive-retrieval job %s\n", st.Tier, st.JobID)
+	return st.save()
+}
+
+// waitForJob - Poll DescribeJob with a doubling interval until the job completes
+func waitForJob(svc glacieriface.GlacierAPI, vaultName, jobID string, poll PollOptions) (*glacier.JobDescription, error) {
+	poll = poll.withDefaults()
+	interval := poll.Interval
+	for {
+		job, err := svc.DescribeJob(&glacier.DescribeJobInput{
+			AccountId: aws.String("-"),
+			JobId:     aws.String(jobID),
+			VaultName: aws.String(vaultName),
+		})
+		if err != nil {
+			return nil, err
+		}
+		if aws.BoolValue(job.Completed) {
+			return job, nil
+		}
+		fmt.Printf("%s job %s is %s, checking again in %s\n", time.Now().Format(time.RFC3339), jobID, aws.StringValue(job.StatusCode), interval)
+		time.Sleep(interval)
+		interval *= 2
+		if interval > poll.MaxInterval {
+			interval = poll.MaxInterval
+		}
+	}
+}
+
+// isJobGone - Glacier forgets jobs about 24 hours after they complete
+func isJobGone(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == glacier.ErrCodeResourceNotFoundException
+}
+
+// jobArchive - An archive of a restore that spans several, with the name jobs use for it
+type jobArchive struct {
+	ID    string
+	Label string
+}
+
+// archiveJobs - Retrieval jobs by archive ID of a restore that spans several archives,
+// such as a backup chain or the packs of a snapshot. They are kept under ~/.silo like
+// the job of a single restore, so running the restore again picks them up instead of
+// paying for new retrievals.
+type archiveJobs struct {
+	Region    string            `json:"region"`
+	VaultName string            `json:"vaultName"`
+	Name      string            `json:"name"`
+	Tier      string            `json:"tier"`
+	Jobs      map[string]string `json:"jobs"`
+	path      string
+}
+
+// archiveJobsPath - Location of the state file of the restore called name
+func archiveJobsPath(awsRegion, vaultName, name string) string {
+	sum := sha256.Sum256([]byte(awsRegion + "\x00" + vaultName + "\x00" + name))
+	return filepath.Join(siloDir(), "restores", "jobs-"+hex.EncodeToString(sum[:8])+".json")
+}
+
+// loadArchiveJobs - Jobs of an earlier run of the restore, or none yet
+func loadArchiveJobs(awsRegion, vaultName, name, tier string) (*archiveJobs, error) {
+	path := archiveJobsPath(awsRegion, vaultName, name)
+	jobs := &archiveJobs{Region: awsRegion, VaultName: vaultName, Name: name, Tier: tier, path: path}
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, jobs); err != nil {
+			return nil, fmt.Errorf("restore state %s: %v", path, err)
+		}
+	}
+	if jobs.Jobs == nil {
+		jobs.Jobs = map[string]string{}
+	}
+	return jobs, nil
+}
+
+// save - Write the state atomically
+func (j *archiveJobs) save() error {
+	if err := os.MkdirAll(filepath.Dir(j.path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := j.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.path)
+}
+
+// remove - Forget the jobs once the restore finished
+func (j *archiveJobs) remove() {
+	os.Remove(j.path)
+}
+
+// submit - Start a new archive-retrieval job for one archive
+func (j *archiveJobs) submit(svc glacieriface.GlacierAPI, a jobArchive) error {
+	input, err := archiveRetrievalInput(j.VaultName, "silo-restore "+a.Label, a.ID, "", j.Tier, "")
+	if err != nil {
+		return err
+	}
+	result, err := svc.InitiateJob(input)
+	if err != nil {
+		return err
+	}
+	j.Jobs[a.ID] = aws.StringValue(result.JobId)
+	fmt.Printf("submitted %s archive-retrieval job %s for %s\n", j.Tier, j.Jobs[a.ID], a.Label)
+	return j.save()
+}
+
+// prepare - Reuse the saved job of every archive that Glacier still knows and submit
+// the rest, so all retrievals run in parallel
+func (j *archiveJobs) prepare(svc glacieriface.GlacierAPI, archives []jobArchive) error {
+	for _, a := range archives {
+		if jobID := j.Jobs[a.ID]; jobID != "" {
+			job, err := svc.DescribeJob(&glacier.DescribeJobInput{
+				AccountId: aws.String("-"),
+				JobId:     aws.String(jobID),
+				VaultName: aws.String(j.VaultName),
+			})
+			if err == nil && aws.StringValue(job.StatusCode) != glacier.StatusCodeFailed {
+				fmt.Printf("reusing job %s for %s\n", jobID, a.Label)
+				continue
+			}
+			if err != nil && !isJobGone(err) {
+				return err
+			}
+			fmt.Printf("job %s for %s expired or failed, submitting a new one\n", jobID, a.Label)
+		}
+		if err := j.submit(svc, a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wait - Wait for the job of an archive and return its ID once it succeeded. A job
+// that expired while other archives were restored is submitted again, and a failed
+// one is forgotten so the next run starts over.
+func (j *archiveJobs) wait(svc glacieriface.GlacierAPI, a jobArchive, poll PollOptions) (string, error) {
+	for {
+		jobID := j.Jobs[a.ID]
+		job, err := waitForJob(svc, j.VaultName, jobID, poll)
+		if isJobGone(err) {
+			fmt.Printf("job %s expired, submitting a new one\n", jobID)
+			if err := j.submit(svc, a); err != nil {
+				return "", err
+			}
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if aws.StringValue(job.StatusCode) != glacier.StatusCodeSucceeded {
+			delete(j.Jobs, a.ID)
+			j.save()
+			return "", fmt.Errorf("job %s %s: %s", jobID, aws.StringValue(job.StatusCode), aws.StringValue(job.StatusMessage))
+		}
+		return jobID, nil
+	}
+}
+
+// Restore - Retrieve an archive end to end: submit the job, wait for it, then
+// download and verify the output. The job ID is kept under ~/.silo so running
+// the same restore again picks up the job instead of submitting a new one.
+func Restore(awsRegion, vaultName, archiveID, fileName string, opts RestoreOptions) {
+	tier, err := retrievalTier(opts.Tier)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	if _, err := downloadCodec(opts.Download.Decompress, ""); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	svc := glacier.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
+
+	path := restoreStatePath(awsRegion, vaultName, archiveID, opts.Range)
+	st, err := loadRestoreState(path)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	if st == nil {
+		st = &restoreState{
+			Region:    awsRegion,
+			VaultName: vaultName,
+			ArchiveID: archiveID,
+			Range:     opts.Range,
+			Tier:      tier,
+			File:      fileName,
+			path:      path,
+		}
+	} else {
+		fmt.Printf("continuing restore with job %s submitted %s\n", st.JobID, st.Submitted.Format(time.RFC3339))
+		st.File = fileName
+	}
+
+	var job *glacier.JobDescription
+	for job == nil {
+		if st.JobID == "" {
+			if err := st.submit(svc); err != nil {
+				printGlacierError(err)
+				return
+			}
+		}
+		job, err = waitForJob(svc, vaultName, st.JobID, opts.Poll)
+		if isJobGone(err) {
+			fmt.Printf("job %s expired, submitting a new one\n", st.JobID)
+			st.JobID = ""
+			continue
+		}
+		if err != nil {
+			printGlacierError(err)
+			return
+		}
+	}
+	if aws.StringValue(job.StatusCode) != glacier.StatusCodeSucceeded {
+		fmt.Printf("job %s %s: %s\n", st.JobID, aws.StringValue(job.StatusCode), aws.StringValue(job.StatusMessage))
+		st.remove()
+		return
+	}
+
+	// The inventory tree hash only describes the whole archive
+	expectedTreeHash, recorded, encrypted := "", "", false
+	if archive, _, err := lookupArchive(awsRegion, vaultName, archiveID); err == nil {
+		if st.Range == "" {
+			expectedTreeHash = archive.SHA256TreeHash
+		}
+		recorded, encrypted = descriptionCodec(archive.ArchiveDescription), descriptionEncrypted(archive.ArchiveDescription)
+	}
+	codec, err := downloadCodec(opts.Download.Decompress, recorded)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	download, err := downloadJobOutput(svc, vaultName, st.JobID, fileName, expectedTreeHash, opts.Download)
+	if err != nil {
+		printGlacierError(err)
+		fmt.Printf("run restore again to retry the download of job %s\n", st.JobID)
+		return
+	}
+	st.remove()
+	if err := expandArchiveDownload(download, codec, encrypted, st.Range, opts.Download.Keys); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	printJSON(download)
+}
@@ -0,0 +1,114 @@
+package aws
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/aws/aws-sdk-go/service/glacier/glacieriface"
+)
+
+// Data retrieval policy strategies
+const (
+	RetrievalStrategyFreeTier     = "FreeTier"
+	RetrievalStrategyBytesPerHour = "BytesPerHour"
+	RetrievalStrategyNone         = "None"
+)
+
+// retrievalPolicyInput - Build a data retrieval policy. BytesPerHour is required for
+// the BytesPerHour strategy and must not be set for the others.
+func retrievalPolicyInput(strategy string, bytesPerHour int64) (*glacier.SetDataRetrievalPolicyInput, error) {
+	rule := &glacier.DataRetrievalRule{Strategy: aws.String(strategy)}
+	switch strategy {
+	case RetrievalStrategyBytesPerHour:
+		if bytesPerHour <= 0 {
+			return nil, fmt.Errorf("strategy %s needs --bytes-per-hour greater than zero", strategy)
+		}
+		rule.BytesPerHour = aws.Int64(bytesPerHour)
+	case RetrievalStrategyFreeTier, RetrievalStrategyNone:
+		if bytesPerHour != 0 {
+			return nil, fmt.Errorf("--bytes-per-hour only applies to strategy %s", RetrievalStrategyBytesPerHour)
+		}
+	default:
+		return nil, fmt.Errorf("unknown strategy %q, use %s, %s or %s", strategy, RetrievalStrategyFreeTier, RetrievalStrategyBytesPerHour, RetrievalStrategyNone)
+	}
+	return &glacier.SetDataRetrievalPolicyInput{
+		AccountId: aws.String("-"),
+		Policy: &glacier.DataRetrievalPolicy{
+			Rules: []*glacier.DataRetrievalRule{rule},
+		},
+	}, nil
+}
+
+// setRetrievalPolicy - Validate and set the data retrieval policy, then read it back
+func setRetrievalPolicy(svc glacieriface.GlacierAPI, strategy string, bytesPerHour int64) (*glacier.DataRetrievalPolicy, error) {
+	input, err := retrievalPolicyInput(strategy, bytesPerHour)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := svc.SetDataRetrievalPolicy(input); err != nil {
+		return nil, err
+	}
+	result, err := svc.GetDataRetrievalPolicy(&glacier.GetDataRetrievalPolicyInput{
+		AccountId: aws.String("-"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.Policy, nil
+}
+
+// listProvisionedCapacity - Provisioned capacity units of the account
+func listProvisionedCapacity(svc glacieriface.GlacierAPI) ([]*glacier.ProvisionedCapacityDescription, error) {
+	result, err := svc.ListProvisionedCapacity(&glacier.ListProvisionedCapacityInput{
+		AccountId: aws.String("-"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.ProvisionedCapacityList, nil
+}
+
+// purchaseProvisionedCapacity - Buy one provisioned capacity unit and return its ID
+func purchaseProvisionedCapacity(svc glacieriface.GlacierAPI) (string, error) {
+	result, err := svc.PurchaseProvisionedCapacity(&glacier.PurchaseProvisionedCapacityInput{
+		AccountId: aws.String("-"),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(result.CapacityId), nil
+}
+
+// ListProvisionedCapacity - List the provisioned capacity units of the account
+func ListProvisionedCapacity(awsRegion string) {
+	svc := glacier.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
+	units, err := listProvisionedCapacity(svc)
+	if err != nil {
+		printGlacierError(err)
+		return
+	}
+	if len(units) == 0 {
+		fmt.Println("no provisioned capacity in", awsRegion)
+		return
+	}
+	fmt.Println(units)
+}
+
+// PurchaseProvisionedCapacity - Buy a provisioned capacity unit for expedited retrievals.
+// Units are billed for a month, so unless yes is set the purchase has to be typed back.
+func PurchaseProvisionedCapacity(awsRegion string, yes bool) {
+	if !yes && !confirm(os.Stdin, os.Stdout, "A provisioned capacity unit is billed for one month and cannot be cancelled.", "purchase") {
+		fmt.Println("provisioned capacity not purchased")
+		return
+	}
+	svc := glacier.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
+	capacityID, err := purchaseProvisionedCapacity(svc)
+	if err != nil {
+		printGlacierError(err)
+		return
+	}
+	fmt.Printf("Purchased provisioned capacity %s in %s\n", capacityID, awsRegion)
+}
@@ -0,0 +1,151 @@
+package aws
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/aws/aws-sdk-go/service/glacier/glacieriface"
+)
+
+// stubGlacier - Records the retrieval calls it gets and answers with canned results
+type stubGlacier struct {
+	glacieriface.GlacierAPI
+	policy      *glacier.SetDataRetrievalPolicyInput
+	setCalls    int
+	units       []*glacier.ProvisionedCapacityDescription
+	capacityID  string
+	purchaseErr error
+}
+
+func (s *stubGlacier) SetDataRetrievalPolicy(input *glacier.SetDataRetrievalPolicyInput) (*glacier.SetDataRetrievalPolicyOutput, error) {
+	s.setCalls++
+	s.policy = input
+	return &glacier.SetDataRetrievalPolicyOutput{}, nil
+}
+
+func (s *stubGlacier) GetDataRetrievalPolicy(input *glacier.GetDataRetrievalPolicyInput) (*glacier.GetDataRetrievalPolicyOutput, error) {
+	return &glacier.GetDataRetrievalPolicyOutput{Policy: s.policy.Policy}, nil
+}
+
+func (s *stubGlacier) ListProvisionedCapacity(input *glacier.ListProvisionedCapacityInput) (*glacier.ListProvisionedCapacityOutput, error) {
+	return &glacier.ListProvisionedCapacityOutput{ProvisionedCapacityList: s.units}, nil
+}
+
+func (s *stubGlacier) PurchaseProvisionedCapacity(input *glacier.PurchaseProvisionedCapacityInput) (*glacier.PurchaseProvisionedCapacityOutput, error) {
+	if s.purchaseErr != nil {
+		return nil, s.purchaseErr
+	}
+	return &glacier.PurchaseProvisionedCapacityOutput{CapacityId: aws.String(s.capacityID)}, nil
+}
+
+func TestRetrievalPolicyInput(t *testing.T) {
+	tests := []struct {
+		name         string
+		strategy     string
+		bytesPerHour int64
+		wantErr      bool
+	}{
+		{"free tier", RetrievalStrategyFreeTier, 0, false},
+		{"free tier with rate", RetrievalStrategyFreeTier, 1024, true},
+		{"bytes per hour", RetrievalStrategyBytesPerHour, 1 << 30, false},
+		{"bytes per hour without rate", RetrievalStrategyBytesPerHour, 0, true},
+		{"bytes per hour negative rate", RetrievalStrategyBytesPerHour, -1, true},
+		{"none", RetrievalStrategyNone, 0, false},
+		{"none with rate", RetrievalStrategyNone, 1024, true},
+		{"bad strategy", "Unlimited", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input, err := retrievalPolicyInput(tt.strategy, tt.bytesPerHour)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", input)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if aws.StringValue(input.AccountId) != "-" {
+				t.Errorf("account ID %q, want -", aws.StringValue(input.AccountId))
+			}
+			if input.Policy == nil || len(input.Policy.Rules) != 1 {
+				t.Fatalf("want exactly one rule, got %v", input.Policy)
+			}
+			rule := input.Policy.Rules[0]
+			if aws.StringValue(rule.Strategy) != tt.strategy {
+				t.Errorf("strategy %q, want %q", aws.StringValue(rule.Strategy), tt.strategy)
+			}
+			if tt.strategy == RetrievalStrategyBytesPerHour {
+				if aws.Int64Value(rule.BytesPerHour) != tt.bytesPerHour {
+					t.Errorf("bytes per hour %d, want %d", aws.Int64Value(rule.BytesPerHour), tt.bytesPerHour)
+				}
+			} else if rule.BytesPerHour != nil {
+				t.Errorf("bytes per hour set to %d for strategy %s", aws.Int64Value(rule.BytesPerHour), tt.strategy)
+			}
+		})
+	}
+}
+
+func TestSetRetrievalPolicy(t *testing.T) {
+	svc := &stubGlacier{}
+	policy, err := setRetrievalPolicy(svc, RetrievalStrategyBytesPerHour, 10<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if svc.setCalls != 1 {
+		t.Fatalf("SetDataRetrievalPolicy called %d times, want 1", svc.setCalls)
+	}
+	if aws.Int64Value(policy.Rules[0].BytesPerHour) != 10<<30 {
+		t.Errorf("read back %v", policy)
+	}
+
+	if _, err := setRetrievalPolicy(svc, "Unlimited", 0); err == nil {
+		t.Fatal("expected an error for a bad strategy")
+	}
+	if svc.setCalls != 1 {
+		t.Errorf("an invalid policy reached Glacier")
+	}
+}
+
+func TestListProvisionedCapacity(t *testing.T) {
+	svc := &stubGlacier{}
+	units, err := listProvisionedCapacity(svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(units) != 0 {
+		t.Errorf("got %d units, want none", len(units))
+	}
+
+	svc.units = []*glacier.ProvisionedCapacityDescription{
+		{CapacityId: aws.String("unit-1"), StartDate: aws.String("2026-01-01T00:00:00Z"), ExpirationDate: aws.String("2026-02-01T00:00:00Z")},
+	}
+	units, err = listProvisionedCapacity(svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(units) != 1 || aws.StringValue(units[0].CapacityId) != "unit-1" {
+		t.Errorf("got %v", units)
+	}
+}
+
+func TestPurchaseProvisionedCapacity(t *testing.T) {
+	svc := &stubGlacier{capacityID: "unit-2"}
+	id, err := purchaseProvisionedCapacity(svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "unit-2" {
+		t.Errorf("capacity ID %q, want unit-2", id)
+	}
+
+	svc.purchaseErr = awserr.New(glacier.ErrCodeLimitExceededException, "too many units", nil)
+	_, err = purchaseProvisionedCapacity(svc)
+	aerr, ok := err.(awserr.Error)
+	if !ok || aerr.Code() != glacier.ErrCodeLimitExceededException {
+		t.Fatalf("got %v, want %s", err, glacier.ErrCodeLimitExceededException)
+	}
+}
@@ -2,6 +2,8 @@ package aws
 
 import (
 	"fmt"
+	"io"
+	"os"
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -10,6 +12,39 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3"
 )
 
+// parseS3URL - Split an s3://bucket/prefix location into bucket and key prefix
+func parseS3URL(location string) (string, string, error) {
+	if !strings.HasPrefix(location, "s3://") {
+		return "", "", fmt.Errorf("location %q must look like s3://bucket/prefix", location)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(location, "s3://"), "/", 2)
+	if parts[0] == "" {
+		return "", "", fmt.Errorf("location %q has no bucket", location)
+	}
+	if len(parts) == 1 {
+		return parts[0], "", nil
+	}
+	return parts[0], parts[1], nil
+}
+
+// printS3Error - Print an S3 error the way the other commands do
+func printS3Error(err error) {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case s3.ErrCodeNoSuchBucket:
+			fmt.Println(s3.ErrCodeNoSuchBucket, aerr.Error())
+		case s3.ErrCodeNoSuchKey:
+			fmt.Println(s3.ErrCodeNoSuchKey, aerr.Error())
+		default:
+			fmt.Println(aerr.Error())
+		}
+	} else {
+		// Print the error, cast err to awserr.Error to get the Code and
+		// Message from an error.
+		fmt.Println(err.Error())
+	}
+}
+
 // CreateBucket - Create S3 bucket
 func CreateBucket(awsRegion, bucketName string) {
 	svc := s3.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
@@ -40,18 +75,55 @@ func CreateBucket(awsRegion, bucketName string) {
 	fmt.Println(result)
 }
 
-// UploadBucket - Upload data to S3 bucket
-func UploadBucket(awsRegion, bucketName, fileUpload string) {
-	svc := s3.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
-	input := &s3.PutObjectInput{
-		Body:   aws.ReadSeekCloser(strings.NewReader(isFile(fileUpload))),
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(getFilename(fileUpload)),
+// UploadBucket - Upload data to S3 bucket. The file is streamed through a multipart
+// upload; "-" reads from stdin, in which case opts.Key has to name the object.
+func UploadBucket(awsRegion, bucketName, fileUpload string, opts S3UploadOptions) {
+	var (
+		body io.Reader = os.Stdin
+		size int64     = -1
+		key            = opts.Key
+	)
+	if fileUpload != "-" {
+		file, err := os.Open(isFile(fileUpload))
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		body, size = file, info.Size()
+		if key == "" {
+			key = getFilename(fileUpload)
+		}
+	}
+	if key == "" {
+		fmt.Println("specify the object key with --key when uploading from stdin")
+		return
+	}
+	if err := opts.Compress.validate(); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	enc, err := newEncryptor(opts.Encrypt)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	opts.enc = enc
+	if opts.Key == "" {
+		key += sealedExt(opts.Compress, enc)
 	}
-	result, err := svc.PutObject(input)
+	svc := s3.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
+	result, err := uploadStream(svc, bucketName, key, body, size, opts)
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			switch aerr.Code() {
+			case s3.ErrCodeNoSuchBucket:
+				fmt.Println(s3.ErrCodeNoSuchBucket, aerr.Error())
 			default:
 				fmt.Println(aerr.Error())
 			}
@@ -62,7 +134,7 @@ func UploadBucket(awsRegion, bucketName, fileUpload string) {
 		}
 		return
 	}
-	fmt.Println(result)
+	printJSON(result)
 }
 
 // ListBuckets - List of all buckets
@@ -135,14 +207,11 @@ func DeleteObjects(awsRegion, bucketName, objectKey string) {
 	fmt.Println(result)
 }
 
-// ListObjects - List all objects in a bucket
-func ListObjects(awsRegion, bucketName string) {
+// ListObjects - List all objects in a bucket under prefix, grouped by delimiter when set.
+// Every page is fetched unless page limits the listing.
+func ListObjects(awsRegion, bucketName, prefix, delimiter string, page PageOptions) {
 	svc := s3.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
-	input := &s3.ListObjectsV2Input{
-		Bucket:  aws.String(bucketName),
-		MaxKeys: aws.Int64(2),
-	}
-	result, err := svc.ListObjectsV2(input)
+	result, err := listObjects(svc, bucketName, prefix, delimiter, page)
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			switch aerr.Code() {
@@ -159,4 +228,5 @@ func ListObjects(awsRegion, bucketName string) {
 		return
 	}
 	fmt.Println(result)
+	printNextToken(result.NextContinuationToken)
 }
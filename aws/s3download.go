@@ -0,0 +1,419 @@
+package aws
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// DefaultParallel - Objects downloaded at the same time in recursive mode
+const DefaultParallel = 4
+
+// S3DownloadOptions - Tuning knobs for S3 downloads
+type S3DownloadOptions struct {
+	// PartSize in bytes of each ranged GET
+	PartSize int64
+	// Concurrency is the number of ranged GETs in flight per object
+	Concurrency int
+	// Parallel is the number of objects downloaded at the same time with a prefix
+	Parallel int
+	// Overwrite allows replacing files that already exist
+	Overwrite bool
+	// Decompress is auto, none or a codec to expand verified objects with
+	Decompress string
+	// Keys adds key files to the keyring used to decrypt encrypted objects
+	Keys DecryptOptions
+	// trimExt drops the .enc and codec extensions from file names derived from keys
+	trimExt bool
+}
+
+// withDefaults - Fill in zero values
+func (o S3DownloadOptions) withDefaults() S3DownloadOptions {
+	if o.PartSize <= 0 {
+		o.PartSize = DefaultS3PartSize
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = DefaultConcurrency
+	}
+	if o.Parallel <= 0 {
+		o.Parallel = DefaultParallel
+	}
+	return o
+}
+
+// ObjectDownload - Result of an S3 download. Verified names the checksum the file
+// was checked against, empty when S3 offered none that could be recomputed.
+type ObjectDownload struct {
+	Key      string `json:"key"`
+	File     string `json:"file"`
+	Size     int64  `json:"size"`
+	ETag     string `json:"etag"`
+	Verified string `json:"verified"`
+	Error    string `json:"error,omitempty"`
+	// Encryption and Compression name what was undone after the download was verified
+	Encryption   string `json:"encryption,omitempty"`
+	Compression  string `json:"compression,omitempty"`
+	ExpandedSize int64  `json:"expandedSize,omitempty"`
+}
+
+// objectChecksums - What S3 knows about an object that can be checked after download
+type objectChecksums struct {
+	etag     string
+	parts    int64
+	partSize int64
+	// etagIsMD5 is false for SSE-KMS and SSE-C objects, whose ETag is not a digest
+	etagIsMD5 bool
+	sha256    string
+	crc32c    string
+}
+
+// headChecksums - Read the checksums of an object
+func headChecksums(head *s3.HeadObjectOutput) objectChecksums {
+	c := objectChecksums{
+		etag:      strings.Trim(aws.StringValue(head.ETag), `"`),
+		parts:     aws.Int64Value(head.PartsCount),
+		etagIsMD5: aws.StringValue(head.SSECustomerAlgorithm) == "" && aws.StringValue(head.ServerSideEncryption) != s3.ServerSideEncryptionAwsKms,
+	}
+	for key, value := range head.Metadata {
+		if strings.EqualFold(key, s3PartSizeMetadata) {
+			c.partSize, _ = strconv.ParseInt(aws.StringValue(value), 10, 64)
+		}
+	}
+	// Checksums of multipart uploads end in -N and cover the parts, not the object
+	if v := aws.StringValue(head.ChecksumSHA256); v != "" && !strings.Contains(v, "-") {
+		c.sha256 = v
+	}
+	if v := aws.StringValue(head.ChecksumCRC32C); v != "" && !strings.Contains(v, "-") {
+		c.crc32c = v
+	}
+	return c
+}
+
+// headMetadata - Value silo recorded in the metadata of an upload, such as its codec
+func headMetadata(head *s3.HeadObjectOutput, name string) string {
+	for key, value := range head.Metadata {
+		if strings.EqualFold(key, name) {
+			return aws.StringValue(value)
+		}
+	}
+	return ""
+}
+
+// multipartETag - ETag S3 gives a multipart upload: the MD5 of the part MD5s plus the part count
+func multipartETag(r io.Reader, partSize int64) (string, error) {
+	var (
+		digests []byte
+		parts   int
+	)
+	for {
+		h := md5.New()
+		n, err := io.CopyN(h, r, partSize)
+		if n > 0 {
+			digests = append(digests, h.Sum(nil)...)
+			parts++
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	sum := md5.Sum(digests)
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), parts), nil
+}
+
+// commonPartSizes - Part sizes used by default by s3manager, the AWS CLI and silo
+var commonPartSizes = []int64{5 << 20, 8 << 20, 16 << 20, 64 << 20}
+
+// etagPartSizes - Part sizes that may have produced a multipart ETag. The size saved by
+// silo is exact; otherwise every common or whole-MiB part size that gives the right part
+// count is a candidate.
+func (c objectChecksums) etagPartSizes(size int64) ([]int64, bool) {
+	if c.partSize > 0 {
+		return []int64{c.partSize}, true
+	}
+	if c.parts <= 0 {
+		if i := strings.LastIndex(c.etag, "-"); i >= 0 {
+			c.parts, _ = strconv.ParseInt(c.etag[i+1:], 10, 64)
+		}
+	}
+	if c.parts <= 0 {
+		return nil, false
+	}
+	guess := ((size+c.parts-1)/c.parts + 1<<20 - 1) &^ (1<<20 - 1)
+	var sizes []int64
+	for _, partSize := range append([]int64{guess}, commonPartSizes...) {
+		if (size+partSize-1)/partSize == c.parts {
+			sizes = append(sizes, partSize)
+		}
+	}
+	return sizes, false
+}
+
+// objectHash - One checksum to recompute over a downloaded file
+type objectHash struct {
+	name   string
+	want   string
+	h      hash.Hash
+	encode func([]byte) string
+}
+
+// verifyObjectFile - Check a downloaded file against the object checksums and return
+// the name of the checksum that matched, or "" when none could be checked
+func verifyObjectFile(fileName string, size int64, c objectChecksums) (string, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	var hashes []objectHash
+	if c.sha256 != "" {
+		hashes = append(hashes, objectHash{"sha256", c.sha256, sha256.New(), base64.StdEncoding.EncodeToString})
+	}
+	if c.crc32c != "" {
+		hashes = append(hashes, objectHash{"crc32c", c.crc32c, crc32.New(crc32.MakeTable(crc32.Castagnoli)), base64.StdEncoding.EncodeToString})
+	}
+	multipart := strings.Contains(c.etag, "-")
+	if c.etagIsMD5 && c.etag != "" && !multipart {
+		hashes = append(hashes, objectHash{"etag", c.etag, md5.New(), hex.EncodeToString})
+	}
+	if len(hashes) > 0 {
+		writers := make([]io.Writer, len(hashes))
+		for i := range hashes {
+			writers[i] = hashes[i].h
+		}
+		if _, err := io.Copy(io.MultiWriter(writers...), file); err != nil {
+			return "", err
+		}
+		for _, h := range hashes {
+			if got := h.encode(h.h.Sum(nil)); got != h.want {
+				return "", fmt.Errorf("%s mismatch: got %s, expected %s", h.name, got, h.want)
+			}
+		}
+		return hashes[0].name, nil
+	}
+
+	if !c.etagIsMD5 || !multipart {
+		return "", nil
+	}
+	partSizes, exact := c.etagPartSizes(size)
+	for _, partSize := range partSizes {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		got, err := multipartETag(file, partSize)
+		if err != nil {
+			return "", err
+		}
+		if got == c.etag {
+			return "etag", nil
+		}
+		if exact {
+			return "", fmt.Errorf("etag mismatch: got %s, expected %s", got, c.etag)
+		}
+	}
+	// None of the guessed part sizes fit, the upload used some other size
+	return "", nil
+}
+
+// downloadObject - Download one object with ranged GETs into a temporary file, verify
+// it and only then move it to fileName
+func downloadObject(svc s3iface.S3API, bucketName, key, fileName string, opts S3DownloadOptions) (*ObjectDownload, error) {
+	opts = opts.withDefaults()
+	head, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket:       aws.String(bucketName),
+		Key:          aws.String(key),
+		ChecksumMode: aws.String(s3.ChecksumModeEnabled),
+	})
+	if err != nil {
+		return nil, err
+	}
+	codec, err := downloadCodec(opts.Decompress, headMetadata(head, s3CompressionMetadata))
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := codecs[codec]; !ok {
+		codec = ""
+	}
+	// The metadata or the key saying the object is encrypted makes the header mandatory
+	encrypted := headMetadata(head, s3EncryptionMetadata) != "" || strings.HasSuffix(key, encryptedExt)
+	if opts.trimExt {
+		exts := []string{codecs[codec].ext}
+		if encrypted {
+			exts = append([]string{encryptedExt}, exts...)
+		}
+		for _, ext := range exts {
+			if len(filepath.Base(fileName)) > len(ext) {
+				fileName = strings.TrimSuffix(fileName, ext)
+			}
+		}
+	}
+	if _, err := os.Stat(fileName); err == nil && !opts.Overwrite {
+		return nil, fmt.Errorf("%s already exists, use --overwrite to replace it", fileName)
+	}
+	if dir := filepath.Dir(fileName); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	tmp := fileName + ".part"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	downloader := s3manager.NewDownloaderWithClient(svc, func(d *s3manager.Downloader) {
+		d.PartSize = opts.PartSize
+		d.Concurrency = opts.Concurrency
+	})
+	// Pin the version seen by HeadObject so a concurrent overwrite cannot mix objects
+	size, err := downloader.Download(file, &s3.GetObjectInput{
+		Bucket:    aws.String(bucketName),
+		Key:       aws.String(key),
+		IfMatch:   head.ETag,
+		VersionId: head.VersionId,
+	})
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	var verified string
+	if err == nil {
+		verified, err = verifyObjectFile(tmp, size, headChecksums(head))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	result := &ObjectDownload{
+		Key:      key,
+		File:     fileName,
+		Size:     size,
+		ETag:     strings.Trim(aws.StringValue(head.ETag), `"`),
+		Verified: verified,
+	}
+	// Only verified bytes are expanded, the checksums describe the stored object
+	expanded, algorithm, err := unpackFile(tmp, fileName, codec, encrypted, opts.Keys)
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	if codec != "" || algorithm != "" {
+		result.Compression, result.Encryption, result.ExpandedSize = codec, algorithm, expanded
+	}
+	return result, nil
+}
+
+// prefixTarget - Local path of a key below prefix, refusing keys that escape dir
+func prefixTarget(dir, prefix, key string) (string, error) {
+	rel := strings.TrimPrefix(strings.TrimPrefix(key, prefix), "/")
+	if rel == "" {
+		rel = filepath.Base(key)
+	}
+	target := filepath.Join(dir, filepath.FromSlash(rel))
+	if target != filepath.Clean(dir) && !strings.HasPrefix(target, filepath.Clean(dir)+string(filepath.Separator)) {
+		return "", fmt.Errorf("key %s would be written outside %s", key, dir)
+	}
+	return target, nil
+}
+
+// downloadPrefix - Download every object below prefix into dir, several at a time.
+// Every object gets a result; failed ones carry their error.
+func downloadPrefix(svc s3iface.S3API, bucketName, prefix, dir string, opts S3DownloadOptions) ([]*ObjectDownload, error) {
+	opts = opts.withDefaults()
+	opts.trimExt = true
+	listing, err := listObjects(svc, bucketName, prefix, "", PageOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, object := range listing.Contents {
+		// Zero byte keys ending in / are folder placeholders made by the console
+		if key := aws.StringValue(object.Key); !strings.HasSuffix(key, "/") {
+			keys = append(keys, key)
+		}
+	}
+	results := make([]*ObjectDownload, len(keys))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < opts.Parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				key := keys[i]
+				target, err := prefixTarget(dir, prefix, key)
+				var result *ObjectDownload
+				if err == nil {
+					result, err = downloadObject(svc, bucketName, key, target, opts)
+				}
+				if err != nil {
+					result = &ObjectDownload{Key: key, File: target, Error: err.Error()}
+				}
+				results[i] = result
+			}
+		}()
+	}
+	for i := range keys {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return results, nil
+}
+
+// GetObject - Download an object to fileName and verify it against its ETag or
+// SHA-256/CRC32C checksum. Without fileName it is named after the key, less the
+// extensions of the encryption and compression the download undoes.
+func GetObject(awsRegion, bucketName, key, fileName string, opts S3DownloadOptions) {
+	if fileName == "" {
+		fileName = filepath.Base(key)
+		opts.trimExt = true
+	}
+	svc := s3.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
+	result, err := downloadObject(svc, bucketName, key, fileName, opts)
+	if err != nil {
+		printS3Error(err)
+		return
+	}
+	printJSON(result)
+}
+
+// GetObjects - Download every object below prefix into dir, keeping the key layout
+func GetObjects(awsRegion, bucketName, prefix, dir string, opts S3DownloadOptions) {
+	if dir == "" {
+		dir = "."
+	}
+	svc := s3.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
+	results, err := downloadPrefix(svc, bucketName, prefix, dir, opts)
+	if err != nil {
+		printS3Error(err)
+		return
+	}
+	printJSON(results)
+	failed := 0
+	for _, r := range results {
+		if r.Error != "" {
+			failed++
+		}
+	}
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d objects failed\n", failed, len(results))
+	}
+}
@@ -0,0 +1,157 @@
+package aws
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+const (
+	// DefaultS3PartSize - Part size of S3 multipart uploads of a known size
+	DefaultS3PartSize = 16 << 20
+	// DefaultS3StreamPartSize - Part size of S3 uploads of unknown size, such as stdin or
+	// a compressed stream. S3 allows 10000 parts, so this caps a stream at about 625 GiB.
+	DefaultS3StreamPartSize = 64 << 20
+	// s3PartSizeMetadata - Object metadata keeping the part size so the multipart
+	// ETag can be recomputed when the object is downloaded
+	s3PartSizeMetadata = "Silo-Part-Size"
+)
+
+// S3UploadOptions - Tuning knobs for S3 uploads
+type S3UploadOptions struct {
+	// Key overrides the object key, which defaults to the file name
+	Key string
+	// PartSize in bytes, at least 5 MiB; zero picks DefaultS3PartSize, or
+	// DefaultS3StreamPartSize when the size is unknown. It is grown when a file of known
+	// size would need more than 10000 parts, a stream is capped at 10000 parts.
+	PartSize int64
+	// Concurrency is the number of parts in flight
+	Concurrency int
+	// Compress compresses the object on the fly; the codec is kept in the object metadata
+	Compress CompressOptions
+	// Encrypt encrypts the object, after compression, before it leaves the host
+	Encrypt EncryptOptions
+	// enc holds the keys resolved from Encrypt so several uploads share one prompt
+	enc *encryptor
+}
+
+// withDefaults - Fill in zero values
+func (o S3UploadOptions) withDefaults() S3UploadOptions {
+	if o.Concurrency <= 0 {
+		o.Concurrency = DefaultConcurrency
+	}
+	return o
+}
+
+// ObjectUpload - Result of an S3 upload
+type ObjectUpload struct {
+	Bucket    string `json:"bucket"`
+	Key       string `json:"key"`
+	Location  string `json:"location"`
+	VersionID string `json:"versionId,omitempty"`
+	ETag      string `json:"etag"`
+	Size      int64  `json:"size"`
+	SHA256    string `json:"sha256"`
+	PartSize  int64  `json:"partSize"`
+	// Compression and Encryption name how the object was transformed before upload
+	Compression string   `json:"compression,omitempty"`
+	Encryption  string   `json:"encryption,omitempty"`
+	KeyIDs      []string `json:"keyIds,omitempty"`
+}
+
+// s3PartSize - Part size for an upload of size bytes, -1 when unknown. The size is
+// grown in whole MiB until the object fits in the S3 part limit.
+func s3PartSize(partSize, size int64) (int64, error) {
+	if partSize <= 0 {
+		partSize = DefaultS3PartSize
+		if size < 0 {
+			partSize = DefaultS3StreamPartSize
+		}
+	}
+	if partSize < s3manager.MinUploadPartSize {
+		return 0, fmt.Errorf("part size %d is below the S3 minimum of %d bytes", partSize, s3manager.MinUploadPartSize)
+	}
+	if size > 0 && size/partSize >= s3manager.MaxUploadParts {
+		partSize = (size/(s3manager.MaxUploadParts-1) + 1<<20) &^ (1<<20 - 1)
+	}
+	return partSize, nil
+}
+
+// hashingReader - Count and hash the bytes read through it
+type hashingReader struct {
+	r    io.Reader
+	hash io.Writer
+	n    int64
+}
+
+// Read - Read from the wrapped reader and hash what was read
+func (h *hashingReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.n += int64(n)
+	h.hash.Write(p[:n])
+	return n, err
+}
+
+// uploadStream - Upload r to bucket/key through the s3manager multipart uploader.
+// size is used to pick the part size and may be -1 for streams such as stdin.
+// With opts.Compress or encryption keys the stream is compressed and encrypted on its
+// way up, and the size and hashes describe the stored object.
+func uploadStream(svc s3iface.S3API, bucketName, key string, r io.Reader, size int64, opts S3UploadOptions) (*ObjectUpload, error) {
+	opts = opts.withDefaults()
+	metadata := map[string]*string{}
+	if opts.Compress.Codec != "" || opts.enc != nil {
+		sealed, err := sealReader(r, opts.Compress, opts.enc)
+		if err != nil {
+			return nil, err
+		}
+		defer sealed.Close()
+		r, size = sealed, -1
+	}
+	if opts.Compress.Codec != "" {
+		metadata[s3CompressionMetadata] = aws.String(opts.Compress.Codec)
+	}
+	if opts.enc != nil {
+		metadata[s3EncryptionMetadata] = aws.String(opts.enc.algorithm)
+	}
+	partSize, err := s3PartSize(opts.PartSize, size)
+	if err != nil {
+		return nil, err
+	}
+	metadata[s3PartSizeMetadata] = aws.String(strconv.FormatInt(partSize, 10))
+	uploader := s3manager.NewUploaderWithClient(svc, func(u *s3manager.Uploader) {
+		u.PartSize = partSize
+		u.Concurrency = opts.Concurrency
+	})
+	sum := sha256.New()
+	body := &hashingReader{r: r, hash: sum}
+	result, err := uploader.Upload(&s3manager.UploadInput{
+		Body:     body,
+		Bucket:   aws.String(bucketName),
+		Key:      aws.String(key),
+		Metadata: metadata,
+	})
+	if err != nil {
+		return nil, err
+	}
+	upload := &ObjectUpload{
+		Bucket:      bucketName,
+		Key:         key,
+		Location:    result.Location,
+		VersionID:   aws.StringValue(result.VersionID),
+		ETag:        aws.StringValue(result.ETag),
+		Size:        body.n,
+		SHA256:      hex.EncodeToString(sum.Sum(nil)),
+		PartSize:    partSize,
+		Compression: opts.Compress.Codec,
+	}
+	if opts.enc != nil {
+		upload.Encryption, upload.KeyIDs = opts.enc.algorithm, opts.enc.keyIDs()
+	}
+	return upload, nil
+}
@@ -0,0 +1,206 @@
+package aws
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/aws/aws-sdk-go/service/glacier/glacieriface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// SelectOptions - Settings of a Glacier Select job
+type SelectOptions struct {
+	ArchiveID  string
+	Expression string
+	// InputSerialization is the archive format, only csv is supported by Glacier
+	InputSerialization string
+	// FileHeaderInfo tells how the first CSV line is used: USE, IGNORE or NONE
+	FileHeaderInfo string
+	// OutputLocation is the s3://bucket/prefix Glacier writes the results under
+	OutputLocation string
+	Tier           string
+	// JobID picks up the results of an earlier select job instead of starting one
+	JobID string
+	// NoWait submits the job and returns without fetching the results
+	NoWait bool
+	// OutputDir keeps the result objects as files; without it they are printed
+	OutputDir string
+	Poll      PollOptions
+}
+
+// selectJobInput - Build the select job request for an archive
+func selectJobInput(vaultName string, opts SelectOptions) (*glacier.InitiateJobInput, error) {
+	if opts.ArchiveID == "" || opts.Expression == "" {
+		return nil, fmt.Errorf("select needs an archive ID and an expression")
+	}
+	if format := strings.ToLower(opts.InputSerialization); format != "" && format != "csv" {
+		return nil, fmt.Errorf("unsupported input serialization %q, Glacier Select only reads csv", opts.InputSerialization)
+	}
+	header := strings.ToUpper(opts.FileHeaderInfo)
+	switch header {
+	case "":
+		header = glacier.FileHeaderInfoUse
+	case glacier.FileHeaderInfoUse, glacier.FileHeaderInfoIgnore, glacier.FileHeaderInfoNone:
+	default:
+		return nil, fmt.Errorf("unknown file header info %q, use USE, IGNORE or NONE", opts.FileHeaderInfo)
+	}
+	bucket, prefix, err := parseS3URL(opts.OutputLocation)
+	if err != nil {
+		return nil, err
+	}
+	tier, err := retrievalTier(opts.Tier)
+	if err != nil {
+		return nil, err
+	}
+	return &glacier.InitiateJobInput{
+		AccountId: aws.String("-"),
+		JobParameters: &glacier.JobParameters{
+			ArchiveId:   aws.String(opts.ArchiveID),
+			Description: aws.String("silo-select"),
+			OutputLocation: &glacier.OutputLocation{
+				S3: &glacier.S3Location{
+					BucketName: aws.String(bucket),
+					Prefix:     aws.String(prefix),
+				},
+			},
+			SelectParameters: &glacier.SelectParameters{
+				Expression:     aws.String(opts.Expression),
+				ExpressionType: aws.String(glacier.ExpressionTypeSql),
+				InputSerialization: &glacier.InputSerialization{
+					Csv: &glacier.CSVInput{FileHeaderInfo: aws.String(header)},
+				},
+				OutputSerialization: &glacier.OutputSerialization{
+					Csv: &glacier.CSVOutput{},
+				},
+			},
+			Tier: aws.String(tier),
+			Type: aws.String("select"),
+		},
+		VaultName: aws.String(vaultName),
+	}, nil
+}
+
+// selectResultsPrefix - Glacier writes select results under prefix/job-id/results/
+func selectResultsPrefix(prefix, jobID string) string {
+	if prefix = strings.TrimSuffix(prefix, "/"); prefix != "" {
+		prefix += "/"
+	}
+	return prefix + jobID + "/results/"
+}
+
+// fetchSelectResults - Copy every result object of a select job to w, or into dir
+// as separate files when dir is set. It returns the number of result objects.
+func fetchSelectResults(svc s3iface.S3API, bucket, prefix string, w io.Writer, dir string) (int, error) {
+	listing, err := listObjects(svc, bucket, prefix, "", PageOptions{})
+	if err != nil {
+		return 0, err
+	}
+	for _, object := range listing.Contents {
+		key := aws.StringValue(object.Key)
+		result, err := svc.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return 0, err
+		}
+		out := w
+		var file *os.File
+		if dir != "" {
+			if file, err = os.Create(filepath.Join(dir, filepath.Base(key))); err != nil {
+				result.Body.Close()
+				return 0, err
+			}
+			out = file
+		}
+		_, err = io.Copy(out, result.Body)
+		result.Body.Close()
+		if file != nil {
+			if cerr := file.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	return len(listing.Contents), nil
+}
+
+// startSelectJob - Submit the select job and return its ID
+func startSelectJob(svc glacieriface.GlacierAPI, vaultName string, opts SelectOptions) (string, error) {
+	input, err := selectJobInput(vaultName, opts)
+	if err != nil {
+		return "", err
+	}
+	result, err := svc.InitiateJob(input)
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(result.JobId), nil
+}
+
+// Select - Run a SQL expression over a CSV archive with Glacier Select. The job is
+// polled like a restore, then the result objects are fetched from the S3 output location.
+func Select(awsRegion, vaultName string, opts SelectOptions) {
+	var (
+		bucket, prefix string
+		err            error
+	)
+	// An earlier job knows its own output location
+	if opts.OutputLocation != "" || opts.JobID == "" {
+		if bucket, prefix, err = parseS3URL(opts.OutputLocation); err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+	}
+	sess := session.New()
+	svc := glacier.New(sess, aws.NewConfig().WithRegion(awsRegion))
+	jobID := opts.JobID
+	if jobID == "" {
+		if jobID, err = startSelectJob(svc, vaultName, opts); err != nil {
+			printGlacierError(err)
+			return
+		}
+		fmt.Fprintf(os.Stderr, "submitted select job %s\n", jobID)
+	}
+	if opts.NoWait {
+		fmt.Printf("run select again with --jobID %s to fetch the results\n", jobID)
+		return
+	}
+
+	job, err := waitForJob(svc, vaultName, jobID, opts.Poll)
+	if err != nil {
+		printGlacierError(err)
+		return
+	}
+	if aws.StringValue(job.StatusCode) != glacier.StatusCodeSucceeded {
+		fmt.Printf("select job %s %s: %s\n", jobID, aws.StringValue(job.StatusCode), aws.StringValue(job.StatusMessage))
+		return
+	}
+	// The job reports where it actually wrote the results
+	if location := job.OutputLocation; location != nil && location.S3 != nil {
+		bucket = aws.StringValue(location.S3.BucketName)
+		prefix = aws.StringValue(location.S3.Prefix)
+	}
+	if opts.OutputDir != "" {
+		if err := os.MkdirAll(opts.OutputDir, 0755); err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+	}
+	s3svc := s3.New(sess, aws.NewConfig().WithRegion(awsRegion))
+	count, err := fetchSelectResults(s3svc, bucket, selectResultsPrefix(prefix, jobID), os.Stdout, opts.OutputDir)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	fmt.Fprintf(os.Stderr, "fetched %d result objects from s3://%s/%s\n", count, bucket, selectResultsPrefix(prefix, jobID))
+}
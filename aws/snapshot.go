@@ -0,0 +1,600 @@
+package aws
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// RepoBackupOptions - Settings of a snapshot into a repository
+type RepoBackupOptions struct {
+	// Repo is the repository location given to repo init
+	Repo string
+	// Sources are directories, files or glob patterns to snapshot
+	Sources []string
+	// Upload tunes Glacier pack uploads, S3 tunes S3 pack uploads
+	Upload UploadOptions
+	S3     S3UploadOptions
+	// Encrypt encrypts new packs, their indexes and the snapshot
+	Encrypt EncryptOptions
+	// Keys opens the chunk lookups and indexes of earlier encrypted packs
+	Keys DecryptOptions
+	// ClearChunkIDs stores the chunk IDs of new packs unencrypted, so a host that
+	// encrypts only to recipients can deduplicate without their private keys
+	ClearChunkIDs bool
+}
+
+// RepoRestoreOptions - Settings of a snapshot restore
+type RepoRestoreOptions struct {
+	// Repo is the repository location given to repo init
+	Repo string
+	// Snapshot is a snapshot ID, a unique prefix of one, or latest
+	Snapshot string
+	// Target is the directory the snapshot paths are recreated below
+	Target string
+	// Tier and Poll control the retrieval jobs of packs kept in Glacier
+	Tier string
+	Poll PollOptions
+	// Keys decrypts encrypted snapshots, indexes and packs
+	Keys DecryptOptions
+}
+
+// SnapshotEntry - One path of a snapshot and the chunks holding its content
+type SnapshotEntry struct {
+	ManifestEntry
+	Xattrs map[string]string `json:"xattrs,omitempty"`
+	Chunks []string          `json:"chunks,omitempty"`
+}
+
+// Snapshot - The state of the sources at one point in time
+type Snapshot struct {
+	ID        string          `json:"id"`
+	Created   time.Time       `json:"created"`
+	Hostname  string          `json:"hostname"`
+	Sources   []string        `json:"sources"`
+	Size      int64           `json:"size"`
+	NewChunks int             `json:"newChunks"`
+	NewBytes  int64           `json:"newBytes"`
+	Files     []SnapshotEntry `json:"files"`
+}
+
+// snapshotBuilder - Walks the sources, chunks every file and queues the new chunks
+type snapshotBuilder struct {
+	packs   *packWriter
+	params  chunkParams
+	links   map[[2]uint64]string
+	entries []SnapshotEntry
+	size    int64
+}
+
+// addSource - Walk a source without following symlinks and add everything below it
+func (b *snapshotBuilder) addSource(source string) error {
+	return filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return b.addPath(path, info)
+	})
+}
+
+// addPath - Record one path with its metadata, and the chunks of regular files
+func (b *snapshotBuilder) addPath(path string, info os.FileInfo) error {
+	if info.Mode()&os.ModeSocket != 0 {
+		fmt.Fprintf(os.Stderr, "skipping socket %s\n", path)
+		return nil
+	}
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+	}
+	// The tar header is the portable way to read the owner of a file
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	entry := SnapshotEntry{ManifestEntry: ManifestEntry{
+		Path:    tarName(path),
+		Mode:    info.Mode(),
+		ModTime: info.ModTime().UTC(),
+		UID:     hdr.Uid,
+		GID:     hdr.Gid,
+	}}
+	if info.Mode()&os.ModeSymlink == 0 {
+		if entry.Xattrs, err = readXattrs(path); err != nil {
+			return fmt.Errorf("%s: xattrs: %v", path, err)
+		}
+	}
+	switch {
+	case info.IsDir():
+		entry.Type = "dir"
+	case info.Mode()&os.ModeSymlink != 0:
+		entry.Type, entry.Link = "symlink", link
+	case info.Mode().IsRegular():
+		entry.Type = "file"
+		if dev, ino, nlink, ok := fileID(info); ok && nlink > 1 {
+			id := [2]uint64{dev, ino}
+			if first, seen := b.links[id]; seen {
+				entry.Type, entry.Link = "hardlink", first
+				break
+			}
+			b.links[id] = entry.Path
+		}
+		if err := b.chunkFile(path, &entry); err != nil {
+			return err
+		}
+	default:
+		entry.Type = "special"
+	}
+	b.entries = append(b.entries, entry)
+	return nil
+}
+
+// chunkFile - Split a file into content-defined chunks and hash it
+func (b *snapshotBuilder) chunkFile(path string, entry *SnapshotEntry) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	c := newChunker(f, b.params)
+	for {
+		chunk, err := c.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		h.Write(chunk)
+		sum := sha256.Sum256(chunk)
+		id := hex.EncodeToString(sum[:])
+		if err := b.packs.add(id, chunk); err != nil {
+			return err
+		}
+		entry.Chunks = append(entry.Chunks, id)
+		entry.Size += int64(len(chunk))
+	}
+	entry.SHA256 = hex.EncodeToString(h.Sum(nil))
+	b.size += entry.Size
+	return nil
+}
+
+// snapshotID - Sortable ID of a new snapshot: its UTC time and a random suffix
+func snapshotID(now time.Time) (string, error) {
+	suffix, err := randomBytes(4)
+	if err != nil {
+		return "", err
+	}
+	return now.UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(suffix), nil
+}
+
+// printError - Print an error of the pack destination the way the other commands do
+func (r *repository) printError(err error) {
+	if r.packs.vault != "" {
+		printGlacierError(err)
+	} else {
+		printS3Error(err)
+	}
+}
+
+// backup - Chunk the sources, upload the packs of new chunks, then write the snapshot
+func (r *repository) backup(sources []string, opts RepoBackupOptions, enc *encryptor) (*Snapshot, *packWriter, error) {
+	known, err := r.knownChunks(opts.Keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now().UTC()
+	id, err := snapshotID(now)
+	if err != nil {
+		return nil, nil, err
+	}
+	packs := &packWriter{repo: r, enc: enc, upload: opts.Upload, s3opts: opts.S3, known: known, clearLookup: opts.ClearChunkIDs}
+	b := &snapshotBuilder{packs: packs, params: r.config.Chunking, links: map[[2]uint64]string{}}
+	for _, source := range sources {
+		if err := b.addSource(source); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := packs.flush(); err != nil {
+		return nil, nil, err
+	}
+	hostname, _ := os.Hostname()
+	snap := &Snapshot{
+		ID:        id,
+		Created:   now,
+		Hostname:  hostname,
+		Sources:   sources,
+		Size:      b.size,
+		NewChunks: packs.newChunks,
+		NewBytes:  packs.newBytes,
+		Files:     b.entries,
+	}
+	// The snapshot is written last: until then the new packs are simply unused
+	if _, err := r.putJSON(repoSnapshotDir, id, snap, enc); err != nil {
+		return nil, nil, err
+	}
+	return snap, packs, nil
+}
+
+// RepoBackup - Snapshot the sources into a repository. Files are split with FastCDC
+// and only chunks the repository does not hold yet are packed and uploaded, so an
+// unchanged tree costs little more than its snapshot file.
+func RepoBackup(awsRegion string, opts RepoBackupOptions) {
+	repo, err := openRepo(awsRegion, opts.Repo)
+	if err != nil {
+		printS3Error(err)
+		return
+	}
+	sources, err := expandSources(opts.Sources)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	enc, err := newEncryptor(opts.Encrypt)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	if opts.ClearChunkIDs && enc != nil && (len(enc.keys) > 0 || enc.passphrase != nil) {
+		fmt.Println("--clear-chunk-ids is only for encryption to --recipient keys alone; with a key file or passphrase the sealed chunk IDs can be read")
+		return
+	}
+	if opts.Encrypt.KeyFile != "" {
+		opts.Keys.KeyFiles = append(opts.Keys.KeyFiles, opts.Encrypt.KeyFile)
+	}
+	snap, packs, err := repo.backup(sources, opts, enc)
+	if err != nil {
+		repo.printError(err)
+		return
+	}
+	printJSON(struct {
+		Snapshot  string `json:"snapshot"`
+		Files     int    `json:"files"`
+		Size      int64  `json:"size"`
+		NewChunks int    `json:"newChunks"`
+		NewBytes  int64  `json:"newBytes"`
+		Packs     int    `json:"packs"`
+		Stored    int64  `json:"stored"`
+	}{snap.ID, len(snap.Files), snap.Size, snap.NewChunks, snap.NewBytes, packs.packs, packs.stored})
+}
+
+// findSnapshot - Name of the snapshot matching an ID, a unique ID prefix or latest
+func (r *repository) findSnapshot(id string) (string, error) {
+	names, err := r.store.list(repoSnapshotDir)
+	if err != nil {
+		return "", err
+	}
+	if len(names) == 0 {
+		return "", fmt.Errorf("the repository holds no snapshots")
+	}
+	if id == "" || id == "latest" {
+		return names[len(names)-1], nil
+	}
+	var matches []string
+	for _, name := range names {
+		if docID(name) == id {
+			return name, nil
+		}
+		if strings.HasPrefix(docID(name), id) {
+			matches = append(matches, name)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("snapshot %s: %w", id, errNotInRepo)
+	case 1:
+		return matches[0], nil
+	}
+	return "", fmt.Errorf("snapshot %s is ambiguous, it matches %d snapshots", id, len(matches))
+}
+
+// ListSnapshots - Print the snapshots of a repository, oldest first
+func ListSnapshots(awsRegion, location string, keys DecryptOptions) {
+	repo, err := openRepo(awsRegion, location)
+	if err != nil {
+		printS3Error(err)
+		return
+	}
+	names, err := repo.store.list(repoSnapshotDir)
+	if err != nil {
+		printS3Error(err)
+		return
+	}
+	type summary struct {
+		ID        string    `json:"id"`
+		Created   time.Time `json:"created"`
+		Hostname  string    `json:"hostname"`
+		Sources   []string  `json:"sources"`
+		Files     int       `json:"files"`
+		Size      int64     `json:"size"`
+		NewBytes  int64     `json:"newBytes"`
+		Encrypted bool      `json:"encrypted"`
+	}
+	list := []summary{}
+	for _, name := range names {
+		snap := &Snapshot{}
+		if err := repo.getJSON(name, snap, keys); err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		list = append(list, summary{snap.ID, snap.Created, snap.Hostname, snap.Sources, len(snap.Files), snap.Size, snap.NewBytes, strings.HasSuffix(name, encryptedExt)})
+	}
+	printJSON(list)
+}
+
+// fetchPacks - Download and expand every pack into dir. Glacier packs get all their
+// retrieval jobs prepared up front in jobs so they run in parallel.
+func (r *repository) fetchPacks(packs []*packIndex, dir string, jobs *archiveJobs, opts RepoRestoreOptions) (map[string]string, error) {
+	files := map[string]string{}
+	if r.packs.vault == "" {
+		for _, p := range packs {
+			file := filepath.Join(dir, p.Pack)
+			if _, err := downloadObject(r.s3, r.packs.bucket, p.Key, file, S3DownloadOptions{Overwrite: true, Keys: opts.Keys}); err != nil {
+				return nil, fmt.Errorf("pack %s: %v", p.Pack, err)
+			}
+			files[p.Pack] = file
+		}
+		return files, nil
+	}
+	archives := make([]jobArchive, len(packs))
+	for i, p := range packs {
+		archives[i] = jobArchive{ID: p.ArchiveID, Label: "pack " + p.Pack}
+	}
+	if err := jobs.prepare(r.glacier, archives); err != nil {
+		return nil, err
+	}
+	for i, p := range packs {
+		jobID, err := jobs.wait(r.glacier, archives[i], opts.Poll)
+		if err != nil {
+			return nil, err
+		}
+		file := filepath.Join(dir, p.Pack)
+		download, err := downloadJobOutput(r.glacier, r.packs.vault, jobID, file, p.TreeHash, DownloadOptions{Keys: opts.Keys})
+		if err != nil {
+			return nil, err
+		}
+		if err := expandArchiveDownload(download, p.Compress, p.Encrypted, "", opts.Keys); err != nil {
+			return nil, err
+		}
+		files[p.Pack] = file
+	}
+	return files, nil
+}
+
+// restoreTarget - Local path of a snapshot path below target, refusing paths that
+// escape it
+func restoreTarget(target, path string) (string, error) {
+	dest := filepath.Join(target, filepath.FromSlash(path))
+	if dest != target && !strings.HasPrefix(dest, target+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s would be restored outside %s", path, target)
+	}
+	return dest, nil
+}
+
+// snapshotRestore - Rebuilds the paths of a snapshot from the fetched packs
+type snapshotRestore struct {
+	target    string
+	locations map[string]chunkLocation
+	packs     map[string]*os.File
+}
+
+// restoreFile - Write a file chunk by chunk, checking every chunk and the whole file
+func (s *snapshotRestore) restoreFile(dest string, e SnapshotEntry) error {
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	for _, id := range e.Chunks {
+		loc := s.locations[id]
+		chunk := make([]byte, loc.length)
+		if _, err := s.packs[loc.pack.Pack].ReadAt(chunk, loc.offset); err != nil {
+			return fmt.Errorf("%s: pack %s: %v", e.Path, loc.pack.Pack, err)
+		}
+		if sum := sha256.Sum256(chunk); hex.EncodeToString(sum[:]) != id {
+			return fmt.Errorf("%s: chunk %s in pack %s is corrupt", e.Path, id, loc.pack.Pack)
+		}
+		h.Write(chunk)
+		if _, err := f.Write(chunk); err != nil {
+			return err
+		}
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != e.SHA256 {
+		return fmt.Errorf("%s: sha256 mismatch: got %s, expected %s", e.Path, got, e.SHA256)
+	}
+	return f.Close()
+}
+
+// restoreMetadata - Put back permissions, ownership, extended attributes and times.
+// Ownership is only restored when running as root.
+func restoreMetadata(dest string, e SnapshotEntry) error {
+	if e.Type == "symlink" {
+		if os.Geteuid() == 0 {
+			return os.Lchown(dest, e.UID, e.GID)
+		}
+		return nil
+	}
+	if os.Geteuid() == 0 {
+		if err := os.Chown(dest, e.UID, e.GID); err != nil {
+			return err
+		}
+	}
+	if err := os.Chmod(dest, e.Mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+	if err := writeXattrs(dest, e.Xattrs); err != nil {
+		return err
+	}
+	return os.Chtimes(dest, e.ModTime, e.ModTime)
+}
+
+// restoreSnapshot - Recreate every path of a snapshot below the target. Symlinks come
+// last so no path is ever written through one, and directories get their metadata
+// once nothing more is written into them.
+func (s *snapshotRestore) restoreSnapshot(snap *Snapshot) error {
+	var dirs, symlinks []SnapshotEntry
+	for _, e := range snap.Files {
+		dest, err := restoreTarget(s.target, e.Path)
+		if err != nil {
+			return err
+		}
+		switch e.Type {
+		case "dir":
+			if err := os.MkdirAll(dest, 0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, e)
+			continue
+		case "symlink":
+			symlinks = append(symlinks, e)
+			continue
+		case "special":
+			fmt.Fprintf(os.Stderr, "skipping special file %s\n", e.Path)
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+			return err
+		}
+		if e.Type == "hardlink" {
+			first, err := restoreTarget(s.target, e.Link)
+			if err != nil {
+				return err
+			}
+			if err := os.Link(first, dest); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := s.restoreFile(dest, e); err != nil {
+			return err
+		}
+		if err := restoreMetadata(dest, e); err != nil {
+			return fmt.Errorf("%s: %v", e.Path, err)
+		}
+	}
+	for _, e := range symlinks {
+		dest, _ := restoreTarget(s.target, e.Path)
+		if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+			return err
+		}
+		if err := os.Symlink(e.Link, dest); err != nil {
+			return err
+		}
+		if err := restoreMetadata(dest, e); err != nil {
+			return fmt.Errorf("%s: %v", e.Path, err)
+		}
+	}
+	// Deepest directories first, so setting a parent's time is the last change to it
+	for i := len(dirs) - 1; i >= 0; i-- {
+		dest, _ := restoreTarget(s.target, dirs[i].Path)
+		if err := restoreMetadata(dest, dirs[i]); err != nil {
+			return fmt.Errorf("%s: %v", dirs[i].Path, err)
+		}
+	}
+	return nil
+}
+
+// restore - Fetch the packs a snapshot needs and recreate it below target. It
+// returns the snapshot and the number of packs fetched.
+func (r *repository) restore(target string, opts RepoRestoreOptions) (*Snapshot, int, error) {
+	name, err := r.findSnapshot(opts.Snapshot)
+	if err != nil {
+		return nil, 0, err
+	}
+	snap := &Snapshot{}
+	if err := r.getJSON(name, snap, opts.Keys); err != nil {
+		return nil, 0, err
+	}
+	all, err := r.loadIndexes(opts.Keys)
+	if err != nil {
+		return nil, 0, err
+	}
+	locations := map[string]chunkLocation{}
+	for _, e := range snap.Files {
+		for _, id := range e.Chunks {
+			loc, ok := all[id]
+			if !ok {
+				return nil, 0, fmt.Errorf("snapshot %s needs chunk %s, which no pack index lists", snap.ID, id)
+			}
+			locations[id] = loc
+		}
+	}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return nil, 0, err
+	}
+	dir, err := ioutil.TempDir(target, ".silo-packs-")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer os.RemoveAll(dir)
+	var jobs *archiveJobs
+	if r.packs.vault != "" {
+		tier, err := retrievalTier(opts.Tier)
+		if err != nil {
+			return nil, 0, err
+		}
+		if jobs, err = loadArchiveJobs(r.region, r.packs.vault, "snapshot "+opts.Repo+" "+snap.ID, tier); err != nil {
+			return nil, 0, err
+		}
+	}
+	needed := sortedPacks(locations)
+	files, err := r.fetchPacks(needed, dir, jobs, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	s := &snapshotRestore{target: target, locations: locations, packs: map[string]*os.File{}}
+	for pack, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer f.Close()
+		s.packs[pack] = f
+	}
+	if err := s.restoreSnapshot(snap); err != nil {
+		return nil, 0, err
+	}
+	if jobs != nil {
+		jobs.remove()
+	}
+	return snap, len(needed), nil
+}
+
+// RepoRestore - Recreate a snapshot below a target directory. Only the packs holding
+// its chunks are fetched; packs in Glacier go through retrieval jobs first.
+func RepoRestore(awsRegion string, opts RepoRestoreOptions) {
+	repo, err := openRepo(awsRegion, opts.Repo)
+	if err != nil {
+		printS3Error(err)
+		return
+	}
+	target, err := filepath.Abs(opts.Target)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	snap, packs, err := repo.restore(target, opts)
+	if err != nil {
+		repo.printError(err)
+		return
+	}
+	printJSON(struct {
+		Snapshot string `json:"snapshot"`
+		Target   string `json:"target"`
+		Files    int    `json:"files"`
+		Size     int64  `json:"size"`
+		Packs    int    `json:"packs"`
+	}{snap.ID, target, len(snap.Files), snap.Size, packs})
+}
@@ -0,0 +1,82 @@
+//go:build linux
+
+package aws
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// fileID - Device, inode and link count of a file, used to find hard links
+func fileID(info os.FileInfo) (dev, ino, nlink uint64, ok bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, 0, false
+	}
+	return uint64(st.Dev), uint64(st.Ino), uint64(st.Nlink), true
+}
+
+// readXattrs - Extended attributes of a file. Filesystems without xattr support
+// simply report none; any other failure is an error rather than a silent loss.
+func readXattrs(path string) (map[string]string, error) {
+	size, err := syscall.Listxattr(path, nil)
+	if err == syscall.ENOTSUP || err == syscall.ENODATA {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if size <= 0 {
+		return nil, nil
+	}
+	list := make([]byte, size)
+	if size, err = syscall.Listxattr(path, list); err != nil {
+		return nil, err
+	}
+	attrs := map[string]string{}
+	for _, name := range strings.Split(strings.TrimRight(string(list[:size]), "\x00"), "\x00") {
+		if name == "" {
+			continue
+		}
+		n, err := syscall.Getxattr(path, name, nil)
+		if err == syscall.ENODATA {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, n)
+		n, err = syscall.Getxattr(path, name, value)
+		if err == syscall.ENODATA {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		attrs[name] = string(value[:n])
+	}
+	return attrs, nil
+}
+
+// writeXattrs - Set extended attributes on a restored file. Like ownership, the
+// security and trusted namespaces are only restored as root; attributes the target
+// filesystem or the user may not set are reported and skipped.
+func writeXattrs(path string, attrs map[string]string) error {
+	root := os.Geteuid() == 0
+	for name, value := range attrs {
+		if !root && (strings.HasPrefix(name, "security.") || strings.HasPrefix(name, "trusted.")) {
+			continue
+		}
+		err := syscall.Setxattr(path, name, []byte(value), 0)
+		switch err {
+		case nil:
+		case syscall.EPERM, syscall.EACCES, syscall.ENOTSUP:
+			fmt.Fprintf(os.Stderr, "%s: xattr %s not restored: %v\n", path, name, err)
+		default:
+			return fmt.Errorf("%s: xattr %s: %v", path, name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package aws
+
+import "os"
+
+// fileID - Hard links are only detected on Linux
+func fileID(info os.FileInfo) (dev, ino, nlink uint64, ok bool) {
+	return 0, 0, 0, false
+}
+
+// readXattrs - Extended attributes are only read on Linux
+func readXattrs(path string) (map[string]string, error) {
+	return nil, nil
+}
+
+// writeXattrs - Extended attributes are only restored on Linux
+func writeXattrs(path string, attrs map[string]string) error {
+	return nil
+}
@@ -0,0 +1,138 @@
+package aws
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/aws/aws-sdk-go/service/glacier/glacieriface"
+)
+
+// Glacier limits on vault tags
+const (
+	maxVaultTags      = 50
+	maxTagKeyLength   = 128
+	maxTagValueLength = 256
+)
+
+// parseTags - Turn "key=value" arguments into vault tags
+func parseTags(args []string) (map[string]*string, error) {
+	tags := make(map[string]*string, len(args))
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("tag %q must look like key=value", arg)
+		}
+		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if key == "" {
+			return nil, fmt.Errorf("tag %q has an empty key", arg)
+		}
+		if strings.HasPrefix(key, "aws:") {
+			return nil, fmt.Errorf("tag key %q uses the reserved aws: prefix", key)
+		}
+		if len(key) > maxTagKeyLength || len(value) > maxTagValueLength {
+			return nil, fmt.Errorf("tag %q is too long, keys are limited to %d and values to %d characters", arg, maxTagKeyLength, maxTagValueLength)
+		}
+		tags[key] = aws.String(value)
+	}
+	if len(tags) > maxVaultTags {
+		return nil, fmt.Errorf("a vault can have at most %d tags", maxVaultTags)
+	}
+	return tags, nil
+}
+
+// tagsMatch - Whether a vault has every wanted tag. A wanted tag without "=value"
+// only needs the key to be present.
+func tagsMatch(tags map[string]*string, wanted []string) bool {
+	for _, w := range wanted {
+		parts := strings.SplitN(w, "=", 2)
+		value, ok := tags[strings.TrimSpace(parts[0])]
+		if !ok {
+			return false
+		}
+		if len(parts) == 2 && aws.StringValue(value) != strings.TrimSpace(parts[1]) {
+			return false
+		}
+	}
+	return true
+}
+
+// addVaultTags - Add or overwrite tags on a vault
+func addVaultTags(svc glacieriface.GlacierAPI, vaultName string, tags map[string]*string) error {
+	_, err := svc.AddTagsToVault(&glacier.AddTagsToVaultInput{
+		AccountId: aws.String("-"),
+		Tags:      tags,
+		VaultName: aws.String(vaultName),
+	})
+	return err
+}
+
+// vaultTags - Tags set on a vault
+func vaultTags(svc glacieriface.GlacierAPI, vaultName string) (map[string]*string, error) {
+	result, err := svc.ListTagsForVault(&glacier.ListTagsForVaultInput{
+		AccountId: aws.String("-"),
+		VaultName: aws.String(vaultName),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.Tags, nil
+}
+
+// filterVaultsByTag - Keep the vaults that carry every wanted tag
+func filterVaultsByTag(svc glacieriface.GlacierAPI, vaults []*glacier.DescribeVaultOutput, wanted []string) ([]*glacier.DescribeVaultOutput, error) {
+	var matched []*glacier.DescribeVaultOutput
+	for _, vault := range vaults {
+		tags, err := vaultTags(svc, aws.StringValue(vault.VaultName))
+		if err != nil {
+			return nil, err
+		}
+		if tagsMatch(tags, wanted) {
+			matched = append(matched, vault)
+		}
+	}
+	return matched, nil
+}
+
+// TagVault - Add or overwrite "key=value" tags on a vault
+func TagVault(awsRegion, vaultName string, args []string) {
+	tags, err := parseTags(args)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	svc := glacier.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
+	if err := addVaultTags(svc, vaultName, tags); err != nil {
+		printGlacierError(err)
+		return
+	}
+	fmt.Printf("Tagged vault %s with %d tags\n", vaultName, len(tags))
+}
+
+// ListVaultTags - List the tags of a vault
+func ListVaultTags(awsRegion, vaultName string) {
+	svc := glacier.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
+	tags, err := vaultTags(svc, vaultName)
+	if err != nil {
+		printGlacierError(err)
+		return
+	}
+	printJSON(aws.StringValueMap(tags))
+}
+
+// UntagVault - Remove tags from a vault by key
+func UntagVault(awsRegion, vaultName string, keys []string) {
+	svc := glacier.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
+	_, err := svc.RemoveTagsFromVault(&glacier.RemoveTagsFromVaultInput{
+		AccountId: aws.String("-"),
+		TagKeys:   aws.StringSlice(keys),
+		VaultName: aws.String(vaultName),
+	})
+	if err != nil {
+		printGlacierError(err)
+		return
+	}
+	fmt.Printf("Removed %d tags from vault %s\n", len(keys), vaultName)
+}
@@ -0,0 +1,125 @@
+package aws
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+// treeHashChunk - Glacier computes the SHA-256 tree hash over 1 MiB leaves
+const treeHashChunk = 1 << 20
+
+// TreeHash - Streaming SHA-256 tree hash as defined by Glacier
+// Reference - https://docs.aws.amazon.com/amazonglacier/latest/dev/checksum-calculations.html
+type TreeHash struct {
+	leaf   hash.Hash
+	filled int
+	leaves [][]byte
+	size   int64
+}
+
+// NewTreeHash - Create an empty tree hash
+func NewTreeHash() *TreeHash {
+	return &TreeHash{leaf: sha256.New()}
+}
+
+// Write - Feed data into the tree hash, splitting it into 1 MiB leaves
+func (t *TreeHash) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		room := treeHashChunk - t.filled
+		if room > len(p) {
+			room = len(p)
+		}
+		t.leaf.Write(p[:room])
+		t.filled += room
+		p = p[room:]
+		if t.filled == treeHashChunk {
+			t.leaves = append(t.leaves, t.leaf.Sum(nil))
+			t.leaf.Reset()
+			t.filled = 0
+		}
+	}
+	t.size += int64(n)
+	return n, nil
+}
+
+// Size - Number of bytes written so far
+func (t *TreeHash) Size() int64 {
+	return t.size
+}
+
+// Sum - Root of the tree hash for everything written so far
+func (t *TreeHash) Sum() []byte {
+	leaves := t.leaves
+	if t.filled > 0 || len(leaves) == 0 {
+		leaves = append(leaves[:len(leaves):len(leaves)], t.leaf.Sum(nil))
+	}
+	return combineTreeHashes(leaves)
+}
+
+// HexSum - Root of the tree hash as the hex string Glacier uses in headers
+func (t *TreeHash) HexSum() string {
+	return hex.EncodeToString(t.Sum())
+}
+
+// combineTreeHashes - Reduce a level of hashes pairwise until a single root remains
+func combineTreeHashes(level [][]byte) []byte {
+	if len(level) == 0 {
+		return nil
+	}
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			h := sha256.New()
+			h.Write(level[i])
+			h.Write(level[i+1])
+			next = append(next, h.Sum(nil))
+		}
+		level = next
+	}
+	return level[0]
+}
+
+// computeTreeHash - Tree hash of everything r yields
+func computeTreeHash(r io.Reader) (*TreeHash, error) {
+	th := NewTreeHash()
+	if _, err := io.Copy(th, r); err != nil {
+		return nil, err
+	}
+	return th, nil
+}
+
+// anyChecksum - Whether at least one of the checksums is known
+func anyChecksum(checksums ...string) bool {
+	for _, c := range checksums {
+		if c != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// warnUnverified - Say so when no checksum covered a download, for instance a byte
+// range that is not tree-hash aligned
+func warnUnverified(fileName string) {
+	fmt.Fprintf(os.Stderr, "warning: no checksum covers %s, the data was saved UNVERIFIED\n", fileName)
+}
+
+// verifyTreeHash - Compare a computed tree hash with every non-empty expected value
+func verifyTreeHash(computed string, expected ...string) error {
+	for _, want := range expected {
+		if want != "" && !strings.EqualFold(want, computed) {
+			return fmt.Errorf("tree hash mismatch: computed %s, expected %s", computed, want)
+		}
+	}
+	return nil
+}
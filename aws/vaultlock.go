@@ -0,0 +1,347 @@
+package aws
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/glacier"
+	"github.com/aws/aws-sdk-go/service/glacier/glacieriface"
+)
+
+// Vault lock policy templates
+const (
+	// LockTemplateDenyDeleteYoungerThan - Deny DeleteArchive for archives younger than N days
+	LockTemplateDenyDeleteYoungerThan = "deny-delete-younger-than"
+	// LockTemplateDenyDeleteAll - Deny DeleteArchive for every archive, forever
+	LockTemplateDenyDeleteAll = "deny-delete-all"
+)
+
+// lockWindow - Glacier aborts an InProgress lock that is not completed within 24 hours
+const lockWindow = 24 * time.Hour
+
+// lockPolicyDocument - Policy document as Glacier expects it
+type lockPolicyDocument struct {
+	Version   string                `json:"Version"`
+	Statement []lockPolicyStatement `json:"Statement"`
+}
+
+// lockPolicyStatement - Deny statement of a lock policy template
+type lockPolicyStatement struct {
+	Sid       string                       `json:"Sid"`
+	Effect    string                       `json:"Effect"`
+	Principal map[string]string            `json:"Principal"`
+	Action    string                       `json:"Action"`
+	Resource  string                       `json:"Resource"`
+	Condition map[string]map[string]string `json:"Condition,omitempty"`
+}
+
+// vaultARNAccount - Account ID embedded in a vault ARN
+func vaultARNAccount(vaultARN string) (string, error) {
+	// arn:aws:glacier:region:account:vaults/name
+	parts := strings.SplitN(vaultARN, ":", 6)
+	if len(parts) != 6 || parts[4] == "" {
+		return "", fmt.Errorf("unexpected vault ARN %q", vaultARN)
+	}
+	return parts[4], nil
+}
+
+// vaultLockTemplate - Generate a WORM lock policy for a vault from a template
+func vaultLockTemplate(template, awsRegion, accountID, vaultName string, days int) (string, error) {
+	statement := lockPolicyStatement{
+		Effect:    "Deny",
+		Principal: map[string]string{"AWS": "*"},
+		Action:    "glacier:DeleteArchive",
+		Resource:  fmt.Sprintf("arn:aws:glacier:%s:%s:vaults/%s", awsRegion, accountID, vaultName),
+	}
+	switch template {
+	case LockTemplateDenyDeleteYoungerThan:
+		if days <= 0 {
+			return "", fmt.Errorf("template %s needs --days greater than zero", template)
+		}
+		statement.Sid = fmt.Sprintf("deny-delete-younger-than-%d-days", days)
+		statement.Condition = map[string]map[string]string{
+			"NumericLessThan": {"glacier:ArchiveAgeInDays": fmt.Sprint(days)},
+		}
+	case LockTemplateDenyDeleteAll:
+		statement.Sid = "deny-delete-all"
+	default:
+		return "", fmt.Errorf("unknown template %q, use %s or %s", template, LockTemplateDenyDeleteYoungerThan, LockTemplateDenyDeleteAll)
+	}
+	out, err := json.Marshal(lockPolicyDocument{Version: "2012-10-17", Statement: []lockPolicyStatement{statement}})
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// vaultLockState - Lock ID kept locally, Glacier only returns it once
+type vaultLockState struct {
+	VaultName string    `json:"vaultName"`
+	VaultARN  string    `json:"vaultARN"`
+	LockID    string    `json:"lockId"`
+	Initiated time.Time `json:"initiated"`
+	Expires   time.Time `json:"expires"`
+	Policy    string    `json:"policy"`
+}
+
+// vaultLockStatePath - Location of the lock state of a vault
+func vaultLockStatePath(awsRegion, vaultName string) string {
+	return filepath.Join(siloDir(), "vaultlocks", awsRegion, vaultName+".json")
+}
+
+// saveVaultLockState - Record the lock ID of a vault
+func saveVaultLockState(awsRegion string, st *vaultLockState) error {
+	path := vaultLockStatePath(awsRegion, st.VaultName)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadVaultLockState - Read the lock ID of a vault, nil if silo did not start the lock
+func loadVaultLockState(awsRegion, vaultName string) (*vaultLockState, error) {
+	data, err := ioutil.ReadFile(vaultLockStatePath(awsRegion, vaultName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var st vaultLockState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// removeVaultLockState - Forget the lock ID once the lock is completed or aborted
+func removeVaultLockState(awsRegion, vaultName string) {
+	os.Remove(vaultLockStatePath(awsRegion, vaultName))
+}
+
+// confirm - Ask a question and require the exact answer to be typed back
+func confirm(in io.Reader, out io.Writer, question, answer string) bool {
+	fmt.Fprintf(out, "%s\nType %q to continue: ", question, answer)
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && line == "" {
+		return false
+	}
+	return strings.TrimSpace(line) == answer
+}
+
+// describeVaultARN - ARN of a vault, also used to learn the account ID
+func describeVaultARN(svc glacieriface.GlacierAPI, vaultName string) (string, error) {
+	vault, err := svc.DescribeVault(&glacier.DescribeVaultInput{
+		AccountId: aws.String("-"),
+		VaultName: aws.String(vaultName),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(vault.VaultARN), nil
+}
+
+// VaultLockPolicy - Print the lock policy a template generates for a vault
+func VaultLockPolicy(awsRegion, vaultName, template string, days int) {
+	svc := glacier.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
+	vaultARN, err := describeVaultARN(svc, vaultName)
+	if err != nil {
+		printGlacierError(err)
+		return
+	}
+	account, err := vaultARNAccount(vaultARN)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	policy, err := vaultLockTemplate(template, awsRegion, account, vaultName, days)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	fmt.Println(policy)
+}
+
+// StartVaultLock - First phase of the vault lock: install the policy in the InProgress
+// state and keep the lock ID. The policy comes from a template or, when policyFile is
+// set, from a JSON file.
+func StartVaultLock(awsRegion, vaultName, template string, days int, policyFile string) {
+	svc := glacier.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
+	vaultARN, err := describeVaultARN(svc, vaultName)
+	if err != nil {
+		printGlacierError(err)
+		return
+	}
+	var policy string
+	if policyFile != "" {
+		document, err := ioutil.ReadFile(isFile(policyFile))
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		policy = string(document)
+	} else {
+		account, err := vaultARNAccount(vaultARN)
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		if policy, err = vaultLockTemplate(template, awsRegion, account, vaultName, days); err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+	}
+	if err := validateVaultPolicy([]byte(policy), vaultARN, false); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	fmt.Printf("Lock policy for %s:\n%s\n", vaultARN, policy)
+	if !confirm(os.Stdin, os.Stdout, "The policy can still be aborted for 24 hours, after completion it can never be changed.", vaultName) {
+		fmt.Println("vault lock not started")
+		return
+	}
+	result, err := svc.InitiateVaultLock(&glacier.InitiateVaultLockInput{
+		AccountId: aws.String("-"),
+		Policy: &glacier.VaultLockPolicy{
+			Policy: aws.String(policy),
+		},
+		VaultName: aws.String(vaultName),
+	})
+	if err != nil {
+		printGlacierError(err)
+		return
+	}
+	now := time.Now().UTC()
+	st := &vaultLockState{
+		VaultName: vaultName,
+		VaultARN:  vaultARN,
+		LockID:    aws.StringValue(result.LockId),
+		Initiated: now,
+		Expires:   now.Add(lockWindow),
+		Policy:    policy,
+	}
+	if err := saveVaultLockState(awsRegion, st); err != nil {
+		fmt.Println(err.Error())
+		fmt.Printf("keep the lock ID %s, it is needed to complete the lock\n", st.LockID)
+		return
+	}
+	fmt.Printf("Vault lock InProgress on %s, lock ID %s saved\n", vaultName, st.LockID)
+	fmt.Printf("Test the policy, then run vault-lock complete before %s or the lock is aborted\n", st.Expires.Format(time.RFC3339))
+}
+
+// VaultLockStatus - Show the lock state of a vault and how long an InProgress lock has left
+func VaultLockStatus(awsRegion, vaultName string) {
+	svc := glacier.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
+	lock, err := svc.GetVaultLock(&glacier.GetVaultLockInput{
+		AccountId: aws.String("-"),
+		VaultName: aws.String(vaultName),
+	})
+	if err != nil {
+		printGlacierError(err)
+		return
+	}
+	fmt.Println(lock)
+	st, err := loadVaultLockState(awsRegion, vaultName)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	warnLockWindow(aws.StringValue(lock.State), aws.StringValue(lock.ExpirationDate), st)
+}
+
+// warnLockWindow - Tell how much of the 24 hour InProgress window is left
+func warnLockWindow(state, expirationDate string, st *vaultLockState) {
+	if state != "InProgress" {
+		return
+	}
+	expires, err := time.Parse(time.RFC3339, expirationDate)
+	if err != nil && st != nil {
+		expires = st.Expires
+	}
+	if left := time.Until(expires); !expires.IsZero() {
+		if left <= 0 {
+			fmt.Println("WARNING: the InProgress window has passed, Glacier will abort this lock")
+		} else {
+			fmt.Printf("WARNING: lock is InProgress, %s left to complete or abort it\n", left.Round(time.Minute))
+		}
+	}
+	if st == nil {
+		fmt.Println("the lock ID was not saved by silo, pass it with --lockID to complete the lock")
+	}
+}
+
+// FinishVaultLock - Second phase of the vault lock: make the InProgress policy permanent
+// after the vault name is typed back. lockID overrides the saved lock ID.
+func FinishVaultLock(awsRegion, vaultName, lockID string) {
+	svc := glacier.New(session.New(), aws.NewConfig().WithRegion(awsRegion))
+	lock, err := svc.GetVaultLock(&glacier.GetVaultLockInput{
+		AccountId: aws.String("-"),
+		VaultName: aws.String(vaultName),
+	})
+	if err != nil {
+		printGlacierError(err)
+		return
+	}
+	if state := aws.StringValue(lock.State); state != "InProgress" {
+		fmt.Printf("vault lock on %s is %s, nothing to complete\n", vaultName, state)
+		return
+	}
+	st, err := loadVaultLockState(awsRegion, vaultName)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	if lockID == "" {
+		if st == nil {
+			fmt.Println("no saved lock ID for this vault, pass it with --lockID")
+			return
+		}
+		lockID = st.LockID
+	}
+	warnLockWindow(aws.StringValue(lock.State), aws.StringValue(lock.ExpirationDate), st)
+
+	fmt.Printf("Policy to lock on %s:\n%s\n", vaultName, aws.StringValue(lock.Policy))
+	if !confirm(os.Stdin, os.Stdout, "Completing the lock is PERMANENT, the policy can never be changed or removed.", "lock "+vaultName) {
+		fmt.Println("vault lock not completed")
+		return
+	}
+	_, err = svc.CompleteVaultLock(&glacier.CompleteVaultLockInput{
+		AccountId: aws.String("-"),
+		LockId:    aws.String(lockID),
+		VaultName: aws.String(vaultName),
+	})
+	if err != nil {
+		printGlacierError(err)
+		return
+	}
+	removeVaultLockState(awsRegion, vaultName)
+	fmt.Printf("Vault %s is locked\n", vaultName)
+}
+
+// CancelVaultLock - Abort an InProgress lock and forget its saved lock ID. The ID is
+// kept when the abort fails, since the lock may still be InProgress.
+func CancelVaultLock(awsRegion, vaultName string) {
+	if err := AbortVaultLock(awsRegion, vaultName); err != nil {
+		fmt.Printf("the saved lock ID of %s is kept in %s\n", vaultName, vaultLockStatePath(awsRegion, vaultName))
+		return
+	}
+	removeVaultLockState(awsRegion, vaultName)
+}
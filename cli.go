@@ -42,6 +42,10 @@ func main() {
 							Name:  "name",
 							Usage: "vault name",
 						},
+						&cli.StringSliceFlag{
+							Name:  "tag",
+							Usage: "tag the new vault, key=value, can be repeated",
+						},
 						&cli.StringFlag{
 							Name:        "region",
 							Usage:       "aws region",
@@ -53,7 +57,7 @@ func main() {
 						if c.String("name") == "" || region == "" {
 							return cli.NewExitError("specify vault name and region using --name and --region", 2)
 						}
-						aws.CreateVault(region, c.String("name"))
+						aws.CreateVault(region, c.String("name"), c.StringSlice("tag"))
 						return nil
 					},
 				},
@@ -61,6 +65,92 @@ func main() {
 					Name:  "list-vaults",
 					Usage: "list valuts in region",
 					Flags: []cli.Flag{
+						&cli.StringSliceFlag{
+							Name:  "tag",
+							Usage: "only list vaults with this tag, key=value or key, can be repeated",
+						},
+						&cli.Int64Flag{
+							Name:  "max-items",
+							Usage: "stop after this many items and print the token to continue (default: list everything)",
+						},
+						&cli.StringFlag{
+							Name:  "starting-token",
+							Usage: "continue a listing from the token printed by --max-items",
+						},
+						&cli.StringFlag{
+							Name:        "region",
+							Usage:       "aws region",
+							EnvVars:     []string{"AWS_DEFAULT_REGION"},
+							Destination: &region,
+						},
+					},
+					Action: func(c *cli.Context) error {
+						aws.ListVault(region, c.StringSlice("tag"), aws.PageOptions{MaxItems: c.Int64("max-items"), StartingToken: c.String("starting-token")})
+						return nil
+					},
+				},
+				{
+					Name:  "tag-vault",
+					Usage: "add or overwrite tags on a vault",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "name",
+							Usage: "vault name",
+						},
+						&cli.StringSliceFlag{
+							Name:  "tag",
+							Usage: "tag to set, key=value, can be repeated",
+						},
+						&cli.StringFlag{
+							Name:        "region",
+							Usage:       "aws region",
+							EnvVars:     []string{"AWS_DEFAULT_REGION"},
+							Destination: &region,
+						},
+					},
+					Action: func(c *cli.Context) error {
+						if c.String("name") == "" || region == "" || len(c.StringSlice("tag")) == 0 {
+							return cli.NewExitError("specify vault name, region and tags using --name, --region and --tag", 2)
+						}
+						aws.TagVault(region, c.String("name"), c.StringSlice("tag"))
+						return nil
+					},
+				},
+				{
+					Name:  "list-vault-tags",
+					Usage: "list the tags of a vault",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "name",
+							Usage: "vault name",
+						},
+						&cli.StringFlag{
+							Name:        "region",
+							Usage:       "aws region",
+							EnvVars:     []string{"AWS_DEFAULT_REGION"},
+							Destination: &region,
+						},
+					},
+					Action: func(c *cli.Context) error {
+						if c.String("name") == "" || region == "" {
+							return cli.NewExitError("specify vault name and region using --name and --region", 2)
+						}
+						aws.ListVaultTags(region, c.String("name"))
+						return nil
+					},
+				},
+				{
+					Name:  "untag-vault",
+					Usage: "remove tags from a vault",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "name",
+							Usage: "vault name",
+						},
+						&cli.StringSliceFlag{
+							Name:  "key",
+							Usage: "tag key to remove, can be repeated",
+						},
 						&cli.StringFlag{
 							Name:        "region",
 							Usage:       "aws region",
@@ -69,7 +159,10 @@ func main() {
 						},
 					},
 					Action: func(c *cli.Context) error {
-						aws.ListVault(region)
+						if c.String("name") == "" || region == "" || len(c.StringSlice("key")) == 0 {
+							return cli.NewExitError("specify vault name, region and tag keys using --name, --region and --key", 2)
+						}
+						aws.UntagVault(region, c.String("name"), c.StringSlice("key"))
 						return nil
 					},
 				},
@@ -81,6 +174,39 @@ func main() {
 							Name:  "name",
 							Usage: "vault name",
 						},
+						&cli.StringFlag{
+							Name:  "status",
+							Usage: "only list jobs with this status, InProgress, Succeeded or Failed",
+						},
+						&cli.StringFlag{
+							Name:  "completed",
+							Usage: "only list completed (true) or active (false) jobs",
+						},
+						&cli.StringFlag{
+							Name:  "type",
+							Usage: "only list jobs of this type, archive-retrieval, inventory-retrieval or select",
+						},
+						&cli.StringFlag{
+							Name:  "output",
+							Usage: "json or table (default: raw listing)",
+						},
+						&cli.BoolFlag{
+							Name:  "watch",
+							Usage: "redraw a table of active jobs until they all finish",
+						},
+						&cli.DurationFlag{
+							Name:  "interval",
+							Usage: "pause between redraws with --watch",
+							Value: aws.DefaultWatchInterval,
+						},
+						&cli.Int64Flag{
+							Name:  "max-items",
+							Usage: "stop after this many items and print the token to continue (default: list everything)",
+						},
+						&cli.StringFlag{
+							Name:  "starting-token",
+							Usage: "continue a listing from the token printed by --max-items",
+						},
 						&cli.StringFlag{
 							Name:        "region",
 							Usage:       "aws region",
@@ -92,7 +218,16 @@ func main() {
 						if c.String("name") == "" || region == "" {
 							return cli.NewExitError("specify vault name and region using --name and --region", 2)
 						}
-						aws.ListJobs(region, c.String("name"))
+						filter := aws.JobFilter{
+							Status:    c.String("status"),
+							Completed: c.String("completed"),
+							Type:      c.String("type"),
+						}
+						if c.Bool("watch") {
+							aws.WatchJobs(region, c.String("name"), filter, c.Duration("interval"))
+							return nil
+						}
+						aws.ListJobs(region, c.String("name"), filter, c.String("output"), aws.PageOptions{MaxItems: c.Int64("max-items"), StartingToken: c.String("starting-token")})
 						return nil
 					},
 				},
@@ -164,12 +299,119 @@ func main() {
 							Name:  "file",
 							Usage: "upload file name",
 						},
+						&cli.Int64Flag{
+							Name:  "part-size",
+							Usage: "multipart part size in MiB, a power of two (default: picked from the file size)",
+						},
+						&cli.IntFlag{
+							Name:  "concurrency",
+							Value: aws.DefaultConcurrency,
+							Usage: "number of parts uploaded at the same time",
+						},
+						&cli.Int64Flag{
+							Name:  "multipart-threshold",
+							Value: aws.DefaultMultipartThreshold >> 20,
+							Usage: "upload files larger than this many MiB in parts",
+						},
+						&cli.BoolFlag{
+							Name:  "resume",
+							Usage: "continue an interrupted multipart upload of the same file",
+						},
+						&cli.StringFlag{
+							Name:  "compress",
+							Usage: "compress on the fly with gzip, zstd or xz",
+						},
+						&cli.IntFlag{
+							Name:  "level",
+							Usage: "compression level, 1 (fast) up to 9 for gzip and xz or 22 for zstd (default: the codec default)",
+						},
+						&cli.StringFlag{
+							Name:  "encrypt-key",
+							Usage: "encrypt with a key file made by silo keygen",
+						},
+						&cli.BoolFlag{
+							Name:  "passphrase",
+							Usage: "encrypt with a key derived from a passphrase, read from $SILO_PASSPHRASE or the terminal",
+						},
+						&cli.StringSliceFlag{
+							Name:  "recipient",
+							Usage: "encrypt to a silo-x25519: public key or key file, repeatable",
+						},
+						&cli.StringFlag{
+							Name:  "cipher",
+							Usage: "aes-256-gcm or chacha20-poly1305 (default: aes-256-gcm)",
+						},
 					},
 					Action: func(c *cli.Context) error {
 						if c.String("name") == "" || c.String("file") == "" || region == "" {
 							return cli.NewExitError("specify vault name, region and upload file using --name, --region and --file", 2)
 						}
-						aws.UploadArchive(region, c.String("name"), c.String("file"))
+						aws.UploadArchive(region, c.String("name"), c.String("file"), aws.UploadOptions{
+							PartSize:    c.Int64("part-size") << 20,
+							Concurrency: c.Int("concurrency"),
+							Threshold:   c.Int64("multipart-threshold") << 20,
+							Resume:      c.Bool("resume"),
+							Compress: aws.CompressOptions{
+								Codec: c.String("compress"),
+								Level: c.Int("level"),
+							},
+							Encrypt: aws.EncryptOptions{
+								Algorithm:  c.String("cipher"),
+								KeyFile:    c.String("encrypt-key"),
+								Passphrase: c.Bool("passphrase"),
+								Recipients: c.StringSlice("recipient"),
+							},
+						})
+						return nil
+					},
+				},
+				{
+					Name:  "list-multipart-uploads",
+					Usage: "list in-progress multipart uploads for vault",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "name",
+							Usage: "vault name",
+						},
+						&cli.StringFlag{
+							Name:        "region",
+							Usage:       "aws region",
+							EnvVars:     []string{"AWS_DEFAULT_REGION"},
+							Destination: &region,
+						},
+					},
+					Action: func(c *cli.Context) error {
+						if c.String("name") == "" || region == "" {
+							return cli.NewExitError("specify vault name and region using --name and --region", 2)
+						}
+						aws.ListMultipartUploads(region, c.String("name"))
+						return nil
+					},
+				},
+				{
+					Name:  "abort-multipart-upload",
+					Usage: "abort a multipart upload and discard its uploaded parts",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "name",
+							Usage: "vault name",
+						},
+						&cli.StringFlag{
+							Name:  "uploadID",
+							Usage: "specify a multipart upload ID",
+						},
+						&cli.StringFlag{
+							Name:        "region",
+							Usage:       "aws region",
+							EnvVars:     []string{"AWS_DEFAULT_REGION"},
+							Destination: &region,
+						},
+					},
+					Action: func(c *cli.Context) error {
+						if c.String("name") == "" || c.String("uploadID") == "" || region == "" {
+							return cli.NewExitError("specify vault name, region and uploadID using --name, --region and --uploadID", 2)
+						}
+						aws.AbortMultipartUpload(region, c.String("name"), c.String("uploadID"))
 						return nil
 					},
 				},
@@ -186,6 +428,45 @@ func main() {
 							Value: "inventory-retrieval-job",
 							Usage: "description for a job",
 						},
+						&cli.StringFlag{
+							Name:  "format",
+							Value: "JSON",
+							Usage: "inventory format: CSV or JSON",
+						},
+						&cli.StringFlag{
+							Name:  "sns-topic",
+							Usage: "SNS topic ARN notified when the job completes",
+						},
+						&cli.StringFlag{
+							Name:  "start-date",
+							Usage: "only archives created on or after this date (YYYY-MM-DD or RFC 3339)",
+						},
+						&cli.StringFlag{
+							Name:  "end-date",
+							Usage: "only archives created before this date (YYYY-MM-DD or RFC 3339)",
+						},
+						&cli.IntFlag{
+							Name:  "limit",
+							Usage: "maximum number of archives in the inventory",
+						},
+						&cli.StringFlag{
+							Name:  "marker",
+							Usage: "continue an inventory from the marker returned by a limited job",
+						},
+						&cli.BoolFlag{
+							Name:  "all",
+							Usage: "follow markers through successive jobs until the whole vault is listed, waiting for each job",
+						},
+						&cli.DurationFlag{
+							Name:  "poll-interval",
+							Value: aws.DefaultPollInterval,
+							Usage: "with --all, first wait between job status checks",
+						},
+						&cli.DurationFlag{
+							Name:  "max-poll-interval",
+							Value: aws.DefaultMaxPollInterval,
+							Usage: "with --all, longest wait between job status checks",
+						},
 						&cli.StringFlag{
 							Name:        "region",
 							Usage:       "aws region",
@@ -197,7 +478,20 @@ func main() {
 						if c.String("name") == "" || region == "" {
 							return cli.NewExitError("specify vault name and region using --name and --region", 2)
 						}
-						aws.InitInventoryRetrieval(region, c.String("name"), c.String("desc"))
+						filter := aws.InventoryFilter{
+							StartDate: c.String("start-date"),
+							EndDate:   c.String("end-date"),
+							Limit:     c.Int("limit"),
+							Marker:    c.String("marker"),
+						}
+						if c.Bool("all") {
+							aws.FollowInventoryRetrieval(region, c.String("name"), c.String("desc"), c.String("format"), c.String("sns-topic"), filter, aws.PollOptions{
+								Interval:    c.Duration("poll-interval"),
+								MaxInterval: c.Duration("max-poll-interval"),
+							})
+							return nil
+						}
+						aws.InitInventoryRetrieval(region, c.String("name"), c.String("desc"), c.String("format"), c.String("sns-topic"), filter)
 						return nil
 					},
 				},
@@ -218,6 +512,23 @@ func main() {
 							Name:  "jobID",
 							Usage: "specify a job ID",
 						},
+						&cli.StringFlag{
+							Name:  "range",
+							Usage: "retrieve only start-end bytes of the archive, megabyte aligned",
+						},
+						&cli.StringFlag{
+							Name:  "tier",
+							Value: "standard",
+							Usage: "retrieval tier: expedited, standard or bulk",
+						},
+						&cli.StringFlag{
+							Name:  "sns-topic",
+							Usage: "SNS topic ARN notified when the job completes",
+						},
+						&cli.BoolFlag{
+							Name:  "estimate",
+							Usage: "print expected cost and completion window from the local catalog without submitting the job",
+						},
 						&cli.StringFlag{
 							Name:        "region",
 							Usage:       "aws region",
@@ -229,7 +540,11 @@ func main() {
 						if c.String("name") == "" || region == "" || c.String("jobID") == "" {
 							return cli.NewExitError("specify vault name, region and jobID using --name, --region and --jobID", 2)
 						}
-						aws.InitArchiveRetrieval(region, c.String("name"), c.String("desc"), c.String("jobID"))
+						if c.Bool("estimate") {
+							aws.EstimateArchiveRetrieval(region, c.String("name"), c.String("jobID"), c.String("range"), c.String("tier"))
+							return nil
+						}
+						aws.InitArchiveRetrieval(region, c.String("name"), c.String("desc"), c.String("jobID"), c.String("range"), c.String("tier"), c.String("sns-topic"))
 						return nil
 					},
 				},
@@ -241,9 +556,18 @@ func main() {
 							Name:  "name",
 							Usage: "vault name",
 						},
-						&cli.StringFlag{
+						&cli.StringSliceFlag{
 							Name:  "jobID",
-							Usage: "specify a job ID",
+							Usage: "specify a job ID, repeat to stitch the pages of a limited inventory",
+						},
+						&cli.BoolFlag{
+							Name:  "chain",
+							Usage: "stitch the jobs of the last init-inventory-retrieval --all",
+						},
+						&cli.StringFlag{
+							Name:  "output",
+							Value: "table",
+							Usage: "output format: json, csv or table",
 						},
 						&cli.StringFlag{
 							Name:        "region",
@@ -253,10 +577,18 @@ func main() {
 						},
 					},
 					Action: func(c *cli.Context) error {
-						if c.String("name") == "" || c.String("jobID") == "" || region == "" {
-							return cli.NewExitError("specify vault name, region and jobID using --name, --region and --jobID", 2)
+						if c.String("name") == "" || region == "" || (len(c.StringSlice("jobID")) == 0 && !c.Bool("chain")) {
+							return cli.NewExitError("specify vault name, region and jobID using --name, --region and --jobID or --chain", 2)
+						}
+						jobIDs := c.StringSlice("jobID")
+						if c.Bool("chain") {
+							chain, err := aws.InventoryChainJobs(region, c.String("name"))
+							if err != nil {
+								return cli.NewExitError(err.Error(), 1)
+							}
+							jobIDs = chain
 						}
-						aws.GetVautlInventory(region, c.String("name"), c.String("jobID"))
+						aws.GetVautlInventory(region, c.String("name"), jobIDs, c.String("output"))
 						return nil
 					},
 				},
@@ -276,6 +608,38 @@ func main() {
 							Name:  "file",
 							Usage: "specify file including path",
 						},
+						&cli.StringFlag{
+							Name:  "tree-hash",
+							Usage: "expected SHA256TreeHash from the vault inventory",
+						},
+						&cli.StringFlag{
+							Name:  "range",
+							Usage: "download only start-end bytes of the job output",
+						},
+						&cli.Int64Flag{
+							Name:  "chunk-size",
+							Value: aws.DefaultChunkSize >> 20,
+							Usage: "chunked download piece size in MiB, a power of two",
+						},
+						&cli.IntFlag{
+							Name:  "concurrency",
+							Value: aws.DefaultConcurrency,
+							Usage: "number of chunks downloaded at the same time",
+						},
+						&cli.Int64Flag{
+							Name:  "chunk-threshold",
+							Value: aws.DefaultChunkThreshold >> 20,
+							Usage: "download job outputs larger than this many MiB in chunks",
+						},
+						&cli.StringFlag{
+							Name:  "decompress",
+							Value: aws.DecompressAuto,
+							Usage: "auto expands data uploaded with --compress, none keeps it as stored, or force gzip, zstd or xz",
+						},
+						&cli.StringSliceFlag{
+							Name:  "key-file",
+							Usage: "key file to decrypt with besides the keyring in ~/.silo/keys, repeatable",
+						},
 						&cli.StringFlag{
 							Name:        "region",
 							Usage:       "aws region",
@@ -287,17 +651,44 @@ func main() {
 						if c.String("name") == "" || c.String("jobID") == "" || region == "" || c.String("file") == "" {
 							return cli.NewExitError("specify vault name, region, jobID and file using --name, --region, --jobID and --file", 2)
 						}
-						aws.GetVaultArchive(region, c.String("name"), c.String("jobID"), c.String("file"))
+						aws.GetVaultArchive(region, c.String("name"), c.String("jobID"), c.String("file"), c.String("tree-hash"), aws.DownloadOptions{
+							Range:       c.String("range"),
+							ChunkSize:   c.Int64("chunk-size") << 20,
+							Concurrency: c.Int("concurrency"),
+							Threshold:   c.Int64("chunk-threshold") << 20,
+							Decompress:  c.String("decompress"),
+							Keys:        aws.DecryptOptions{KeyFiles: c.StringSlice("key-file")},
+						})
 						return nil
 					},
 				},
 				{
-					Name:  "get-vaultlock",
-					Usage: "get information about vault's policy",
+					Name:  "ls",
+					Usage: "list archives from the local catalog built from inventories and silo uploads",
 					Flags: []cli.Flag{
 						&cli.StringFlag{
-							Name:  "name",
-							Usage: "vault name",
+							Name:    "name",
+							Aliases: []string{"vault"},
+							Usage:   "vault name",
+						},
+						&cli.TimestampFlag{
+							Name:   "since",
+							Layout: "2006-01-02",
+							Usage:  "only archives created on or after this date (YYYY-MM-DD)",
+						},
+						&cli.TimestampFlag{
+							Name:   "until",
+							Layout: "2006-01-02",
+							Usage:  "only archives created before this date (YYYY-MM-DD)",
+						},
+						&cli.StringFlag{
+							Name:  "match",
+							Usage: "only archives whose description matches this glob, e.g. '*.sql.gz'",
+						},
+						&cli.StringFlag{
+							Name:  "output",
+							Value: "table",
+							Usage: "output format: json, csv or table",
 						},
 						&cli.StringFlag{
 							Name:        "region",
@@ -310,21 +701,65 @@ func main() {
 						if c.String("name") == "" || region == "" {
 							return cli.NewExitError("specify vault name and region using --name and --region", 2)
 						}
-						aws.GetVaultLock(region, c.String("name"))
+						q := aws.CatalogQuery{Match: c.String("match")}
+						if t := c.Timestamp("since"); t != nil {
+							q.Since = *t
+						}
+						if t := c.Timestamp("until"); t != nil {
+							q.Until = *t
+						}
+						aws.ListCatalog(region, c.String("name"), q, c.String("output"))
 						return nil
 					},
 				},
 				{
-					Name:  "init-vaultlock",
-					Usage: "init vault lock policy on the specified vault",
+					Name:  "restore",
+					Usage: "retrieve an archive, wait for the job and download the verified output",
 					Flags: []cli.Flag{
 						&cli.StringFlag{
 							Name:  "name",
 							Usage: "vault name",
 						},
 						&cli.StringFlag{
-							Name:  "policy",
-							Usage: "vault policy",
+							Name:  "archiveID",
+							Usage: "specify a archive ID",
+						},
+						&cli.StringFlag{
+							Name:  "file",
+							Usage: "specify file including path",
+						},
+						&cli.StringFlag{
+							Name:  "tier",
+							Value: "standard",
+							Usage: "retrieval tier: expedited, standard or bulk",
+						},
+						&cli.StringFlag{
+							Name:  "range",
+							Usage: "retrieve only start-end bytes of the archive, megabyte aligned",
+						},
+						&cli.DurationFlag{
+							Name:  "poll-interval",
+							Value: aws.DefaultPollInterval,
+							Usage: "first wait between job status checks, doubled up to --max-poll-interval",
+						},
+						&cli.DurationFlag{
+							Name:  "max-poll-interval",
+							Value: aws.DefaultMaxPollInterval,
+							Usage: "longest wait between job status checks",
+						},
+						&cli.IntFlag{
+							Name:  "concurrency",
+							Value: aws.DefaultConcurrency,
+							Usage: "number of chunks downloaded at the same time",
+						},
+						&cli.StringFlag{
+							Name:  "decompress",
+							Value: aws.DecompressAuto,
+							Usage: "auto expands data uploaded with --compress, none keeps it as stored, or force gzip, zstd or xz",
+						},
+						&cli.StringSliceFlag{
+							Name:  "key-file",
+							Usage: "key file to decrypt with besides the keyring in ~/.silo/keys, repeatable",
 						},
 						&cli.StringFlag{
 							Name:        "region",
@@ -334,21 +769,83 @@ func main() {
 						},
 					},
 					Action: func(c *cli.Context) error {
-						if c.String("name") == "" || region == "" {
-							return cli.NewExitError("specify vault name, region and policy using --name, --region and --policy", 2)
+						if c.String("name") == "" || c.String("archiveID") == "" || region == "" || c.String("file") == "" {
+							return cli.NewExitError("specify vault name, region, archiveID and file using --name, --region, --archiveID and --file", 2)
 						}
-						aws.InitiateVaultLock(region, c.String("name"), c.String("policy"))
+						aws.Restore(region, c.String("name"), c.String("archiveID"), c.String("file"), aws.RestoreOptions{
+							Tier:  c.String("tier"),
+							Range: c.String("range"),
+							Poll: aws.PollOptions{
+								Interval:    c.Duration("poll-interval"),
+								MaxInterval: c.Duration("max-poll-interval"),
+							},
+							Download: aws.DownloadOptions{
+								Concurrency: c.Int("concurrency"),
+								Decompress:  c.String("decompress"),
+								Keys:        aws.DecryptOptions{KeyFiles: c.StringSlice("key-file")},
+							},
+						})
 						return nil
 					},
 				},
 				{
-					Name:  "abort-vaultlock",
-					Usage: "aborts the vault locking process if not already in locked state",
+					Name:  "select",
+					Usage: "run a SQL expression over a CSV archive and fetch the results from S3",
 					Flags: []cli.Flag{
 						&cli.StringFlag{
 							Name:  "name",
 							Usage: "vault name",
 						},
+						&cli.StringFlag{
+							Name:    "archive-id",
+							Aliases: []string{"archiveID"},
+							Usage:   "archive to query",
+						},
+						&cli.StringFlag{
+							Name:  "expression",
+							Usage: "SQL expression, e.g. SELECT * FROM archive WHERE s._1 = 'x'",
+						},
+						&cli.StringFlag{
+							Name:  "input-serialization",
+							Value: "csv",
+							Usage: "archive format, only csv is supported",
+						},
+						&cli.StringFlag{
+							Name:  "file-header",
+							Value: "USE",
+							Usage: "first CSV line: USE as column names, IGNORE or NONE",
+						},
+						&cli.StringFlag{
+							Name:  "output-location",
+							Usage: "s3://bucket/prefix where Glacier writes the results",
+						},
+						&cli.StringFlag{
+							Name:  "tier",
+							Value: "standard",
+							Usage: "retrieval tier: expedited, standard or bulk",
+						},
+						&cli.StringFlag{
+							Name:  "jobID",
+							Usage: "fetch the results of an earlier select job instead of starting one",
+						},
+						&cli.BoolFlag{
+							Name:  "no-wait",
+							Usage: "submit the job and return without waiting for the results",
+						},
+						&cli.StringFlag{
+							Name:  "output-dir",
+							Usage: "save the result objects in this directory instead of printing them",
+						},
+						&cli.DurationFlag{
+							Name:  "poll-interval",
+							Value: aws.DefaultPollInterval,
+							Usage: "first wait between job status checks, doubled up to --max-poll-interval",
+						},
+						&cli.DurationFlag{
+							Name:  "max-poll-interval",
+							Value: aws.DefaultMaxPollInterval,
+							Usage: "longest wait between job status checks",
+						},
 						&cli.StringFlag{
 							Name:        "region",
 							Usage:       "aws region",
@@ -360,13 +857,30 @@ func main() {
 						if c.String("name") == "" || region == "" {
 							return cli.NewExitError("specify vault name and region using --name and --region", 2)
 						}
-						aws.AbortVaultLock(region, c.String("name"))
+						if c.String("jobID") == "" && (c.String("archive-id") == "" || c.String("expression") == "" || c.String("output-location") == "") {
+							return cli.NewExitError("specify archive, expression and output location using --archive-id, --expression and --output-location", 2)
+						}
+						aws.Select(region, c.String("name"), aws.SelectOptions{
+							ArchiveID:          c.String("archive-id"),
+							Expression:         c.String("expression"),
+							InputSerialization: c.String("input-serialization"),
+							FileHeaderInfo:     c.String("file-header"),
+							OutputLocation:     c.String("output-location"),
+							Tier:               c.String("tier"),
+							JobID:              c.String("jobID"),
+							NoWait:             c.Bool("no-wait"),
+							OutputDir:          c.String("output-dir"),
+							Poll: aws.PollOptions{
+								Interval:    c.Duration("poll-interval"),
+								MaxInterval: c.Duration("max-poll-interval"),
+							},
+						})
 						return nil
 					},
 				},
 				{
-					Name:  "complete-vaultlock",
-					Usage: "complete vault lock in process.",
+					Name:  "get-access-policy",
+					Usage: "get the access policy of a vault",
 					Flags: []cli.Flag{
 						&cli.StringFlag{
 							Name:  "name",
@@ -378,23 +892,31 @@ func main() {
 							EnvVars:     []string{"AWS_DEFAULT_REGION"},
 							Destination: &region,
 						},
-						&cli.StringFlag{
-							Name:  "lockID",
-							Usage: "vault lockID",
-						},
 					},
 					Action: func(c *cli.Context) error {
-						if c.String("name") == "" || region == "" || c.String("lockID") == "" {
-							return cli.NewExitError("specify vault name, region and lockID using --name, --region and --lockID", 2)
+						if c.String("name") == "" || region == "" {
+							return cli.NewExitError("specify vault name and region using --name and --region", 2)
 						}
-						aws.CompleteVaultLock(region, c.String("name"), c.String("lockID"))
+						aws.GetVaultAccessPolicy(region, c.String("name"))
 						return nil
 					},
 				},
 				{
-					Name:  "get-retrieval-policy",
-					Usage: "get the current data retrieval policy",
+					Name:  "set-access-policy",
+					Usage: "validate and set the access policy of a vault",
 					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "name",
+							Usage: "vault name",
+						},
+						&cli.StringFlag{
+							Name:  "policy-file",
+							Usage: "JSON policy document",
+						},
+						&cli.BoolFlag{
+							Name:  "force",
+							Usage: "allow statements granting access to principal \"*\"",
+						},
 						&cli.StringFlag{
 							Name:        "region",
 							Usage:       "aws region",
@@ -403,15 +925,450 @@ func main() {
 						},
 					},
 					Action: func(c *cli.Context) error {
-						if region == "" {
-							return cli.NewExitError("specify region using --region", 2)
+						if c.String("name") == "" || c.String("policy-file") == "" || region == "" {
+							return cli.NewExitError("specify vault name, region and policy file using --name, --region and --policy-file", 2)
 						}
-						aws.GetRetrievalPolicy(region)
+						aws.SetVaultAccessPolicy(region, c.String("name"), c.String("policy-file"), c.Bool("force"))
 						return nil
 					},
 				},
 				{
-					Name:  "delete-archive",
+					Name:  "delete-access-policy",
+					Usage: "delete the access policy of a vault",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "name",
+							Usage: "vault name",
+						},
+						&cli.StringFlag{
+							Name:        "region",
+							Usage:       "aws region",
+							EnvVars:     []string{"AWS_DEFAULT_REGION"},
+							Destination: &region,
+						},
+					},
+					Action: func(c *cli.Context) error {
+						if c.String("name") == "" || region == "" {
+							return cli.NewExitError("specify vault name and region using --name and --region", 2)
+						}
+						aws.DeleteVaultAccessPolicy(region, c.String("name"))
+						return nil
+					},
+				},
+				{
+					Name:  "get-vaultlock",
+					Usage: "get information about vault's policy",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "name",
+							Usage: "vault name",
+						},
+						&cli.StringFlag{
+							Name:        "region",
+							Usage:       "aws region",
+							EnvVars:     []string{"AWS_DEFAULT_REGION"},
+							Destination: &region,
+						},
+					},
+					Action: func(c *cli.Context) error {
+						if c.String("name") == "" || region == "" {
+							return cli.NewExitError("specify vault name and region using --name and --region", 2)
+						}
+						aws.GetVaultLock(region, c.String("name"))
+						return nil
+					},
+				},
+				{
+					Name:  "init-vaultlock",
+					Usage: "init vault lock policy on the specified vault",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "name",
+							Usage: "vault name",
+						},
+						&cli.StringFlag{
+							Name:  "policy",
+							Usage: "vault policy",
+						},
+						&cli.StringFlag{
+							Name:        "region",
+							Usage:       "aws region",
+							EnvVars:     []string{"AWS_DEFAULT_REGION"},
+							Destination: &region,
+						},
+					},
+					Action: func(c *cli.Context) error {
+						if c.String("name") == "" || region == "" {
+							return cli.NewExitError("specify vault name, region and policy using --name, --region and --policy", 2)
+						}
+						aws.InitiateVaultLock(region, c.String("name"), c.String("policy"))
+						return nil
+					},
+				},
+				{
+					Name:  "abort-vaultlock",
+					Usage: "aborts the vault locking process if not already in locked state",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "name",
+							Usage: "vault name",
+						},
+						&cli.StringFlag{
+							Name:        "region",
+							Usage:       "aws region",
+							EnvVars:     []string{"AWS_DEFAULT_REGION"},
+							Destination: &region,
+						},
+					},
+					Action: func(c *cli.Context) error {
+						if c.String("name") == "" || region == "" {
+							return cli.NewExitError("specify vault name and region using --name and --region", 2)
+						}
+						aws.AbortVaultLock(region, c.String("name"))
+						return nil
+					},
+				},
+				{
+					Name:  "complete-vaultlock",
+					Usage: "complete vault lock in process.",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "name",
+							Usage: "vault name",
+						},
+						&cli.StringFlag{
+							Name:        "region",
+							Usage:       "aws region",
+							EnvVars:     []string{"AWS_DEFAULT_REGION"},
+							Destination: &region,
+						},
+						&cli.StringFlag{
+							Name:  "lockID",
+							Usage: "vault lockID",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						if c.String("name") == "" || region == "" || c.String("lockID") == "" {
+							return cli.NewExitError("specify vault name, region and lockID using --name, --region and --lockID", 2)
+						}
+						aws.CompleteVaultLock(region, c.String("name"), c.String("lockID"))
+						return nil
+					},
+				},
+				{
+					Name:  "vault-lock",
+					Usage: "guided two-phase vault lock: policy, init, status, complete, abort",
+					Subcommands: []*cli.Command{
+						{
+							Name:  "policy",
+							Usage: "print the lock policy a template generates for the vault",
+							Flags: []cli.Flag{
+								&cli.StringFlag{
+									Name:  "name",
+									Usage: "vault name",
+								},
+								&cli.StringFlag{
+									Name:  "template",
+									Usage: "policy template, deny-delete-younger-than or deny-delete-all",
+									Value: "deny-delete-younger-than",
+								},
+								&cli.IntFlag{
+									Name:  "days",
+									Usage: "minimum archive age in days for deny-delete-younger-than",
+								},
+								&cli.StringFlag{
+									Name:        "region",
+									Usage:       "aws region",
+									EnvVars:     []string{"AWS_DEFAULT_REGION"},
+									Destination: &region,
+								},
+							},
+							Action: func(c *cli.Context) error {
+								if c.String("name") == "" || region == "" {
+									return cli.NewExitError("specify vault name and region using --name and --region", 2)
+								}
+								aws.VaultLockPolicy(region, c.String("name"), c.String("template"), c.Int("days"))
+								return nil
+							},
+						},
+						{
+							Name:  "init",
+							Usage: "install a lock policy in the InProgress state and save the lock ID",
+							Flags: []cli.Flag{
+								&cli.StringFlag{
+									Name:  "name",
+									Usage: "vault name",
+								},
+								&cli.StringFlag{
+									Name:  "template",
+									Usage: "policy template, deny-delete-younger-than or deny-delete-all",
+									Value: "deny-delete-younger-than",
+								},
+								&cli.IntFlag{
+									Name:  "days",
+									Usage: "minimum archive age in days for deny-delete-younger-than",
+								},
+								&cli.StringFlag{
+									Name:  "policy-file",
+									Usage: "JSON policy file used instead of a template",
+								},
+								&cli.StringFlag{
+									Name:        "region",
+									Usage:       "aws region",
+									EnvVars:     []string{"AWS_DEFAULT_REGION"},
+									Destination: &region,
+								},
+							},
+							Action: func(c *cli.Context) error {
+								if c.String("name") == "" || region == "" {
+									return cli.NewExitError("specify vault name and region using --name and --region", 2)
+								}
+								aws.StartVaultLock(region, c.String("name"), c.String("template"), c.Int("days"), c.String("policy-file"))
+								return nil
+							},
+						},
+						{
+							Name:  "status",
+							Usage: "show the lock state and the time left to complete it",
+							Flags: []cli.Flag{
+								&cli.StringFlag{
+									Name:  "name",
+									Usage: "vault name",
+								},
+								&cli.StringFlag{
+									Name:        "region",
+									Usage:       "aws region",
+									EnvVars:     []string{"AWS_DEFAULT_REGION"},
+									Destination: &region,
+								},
+							},
+							Action: func(c *cli.Context) error {
+								if c.String("name") == "" || region == "" {
+									return cli.NewExitError("specify vault name and region using --name and --region", 2)
+								}
+								aws.VaultLockStatus(region, c.String("name"))
+								return nil
+							},
+						},
+						{
+							Name:  "complete",
+							Usage: "make the InProgress lock policy permanent after typed confirmation",
+							Flags: []cli.Flag{
+								&cli.StringFlag{
+									Name:  "name",
+									Usage: "vault name",
+								},
+								&cli.StringFlag{
+									Name:  "lockID",
+									Usage: "lock ID, defaults to the one saved by vault-lock init",
+								},
+								&cli.StringFlag{
+									Name:        "region",
+									Usage:       "aws region",
+									EnvVars:     []string{"AWS_DEFAULT_REGION"},
+									Destination: &region,
+								},
+							},
+							Action: func(c *cli.Context) error {
+								if c.String("name") == "" || region == "" {
+									return cli.NewExitError("specify vault name and region using --name and --region", 2)
+								}
+								aws.FinishVaultLock(region, c.String("name"), c.String("lockID"))
+								return nil
+							},
+						},
+						{
+							Name:  "abort",
+							Usage: "abort the InProgress lock and forget the saved lock ID",
+							Flags: []cli.Flag{
+								&cli.StringFlag{
+									Name:  "name",
+									Usage: "vault name",
+								},
+								&cli.StringFlag{
+									Name:        "region",
+									Usage:       "aws region",
+									EnvVars:     []string{"AWS_DEFAULT_REGION"},
+									Destination: &region,
+								},
+							},
+							Action: func(c *cli.Context) error {
+								if c.String("name") == "" || region == "" {
+									return cli.NewExitError("specify vault name and region using --name and --region", 2)
+								}
+								aws.CancelVaultLock(region, c.String("name"))
+								return nil
+							},
+						},
+					},
+				},
+				{
+					Name:  "set-vault-notifications",
+					Usage: "publish vault job events to an SNS topic",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "name",
+							Usage: "vault name",
+						},
+						&cli.StringFlag{
+							Name:  "sns-topic",
+							Usage: "SNS topic ARN",
+						},
+						&cli.StringSliceFlag{
+							Name:  "event",
+							Usage: "event to publish, ArchiveRetrievalCompleted or InventoryRetrievalCompleted (default: both)",
+						},
+						&cli.StringFlag{
+							Name:        "region",
+							Usage:       "aws region",
+							EnvVars:     []string{"AWS_DEFAULT_REGION"},
+							Destination: &region,
+						},
+					},
+					Action: func(c *cli.Context) error {
+						if c.String("name") == "" || c.String("sns-topic") == "" || region == "" {
+							return cli.NewExitError("specify vault name, region and SNS topic using --name, --region and --sns-topic", 2)
+						}
+						aws.SetVaultNotifications(region, c.String("name"), c.String("sns-topic"), c.StringSlice("event"))
+						return nil
+					},
+				},
+				{
+					Name:  "get-vault-notifications",
+					Usage: "get the notification configuration of a vault",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "name",
+							Usage: "vault name",
+						},
+						&cli.StringFlag{
+							Name:        "region",
+							Usage:       "aws region",
+							EnvVars:     []string{"AWS_DEFAULT_REGION"},
+							Destination: &region,
+						},
+					},
+					Action: func(c *cli.Context) error {
+						if c.String("name") == "" || region == "" {
+							return cli.NewExitError("specify vault name and region using --name and --region", 2)
+						}
+						aws.GetVaultNotifications(region, c.String("name"))
+						return nil
+					},
+				},
+				{
+					Name:  "delete-vault-notifications",
+					Usage: "stop a vault from publishing job events",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "name",
+							Usage: "vault name",
+						},
+						&cli.StringFlag{
+							Name:        "region",
+							Usage:       "aws region",
+							EnvVars:     []string{"AWS_DEFAULT_REGION"},
+							Destination: &region,
+						},
+					},
+					Action: func(c *cli.Context) error {
+						if c.String("name") == "" || region == "" {
+							return cli.NewExitError("specify vault name and region using --name and --region", 2)
+						}
+						aws.DeleteVaultNotifications(region, c.String("name"))
+						return nil
+					},
+				},
+				{
+					Name:  "get-retrieval-policy",
+					Usage: "get the current data retrieval policy",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:        "region",
+							Usage:       "aws region",
+							EnvVars:     []string{"AWS_DEFAULT_REGION"},
+							Destination: &region,
+						},
+					},
+					Action: func(c *cli.Context) error {
+						if region == "" {
+							return cli.NewExitError("specify region using --region", 2)
+						}
+						aws.GetRetrievalPolicy(region)
+						return nil
+					},
+				},
+				{
+					Name:  "set-retrieval-policy",
+					Usage: "set the data retrieval policy to cap retrieval spend",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "strategy",
+							Usage: "FreeTier, BytesPerHour or None",
+						},
+						&cli.Int64Flag{
+							Name:  "bytes-per-hour",
+							Usage: "maximum bytes retrieved per hour for the BytesPerHour strategy",
+						},
+						&cli.StringFlag{
+							Name:        "region",
+							Usage:       "aws region",
+							EnvVars:     []string{"AWS_DEFAULT_REGION"},
+							Destination: &region,
+						},
+					},
+					Action: func(c *cli.Context) error {
+						if c.String("strategy") == "" || region == "" {
+							return cli.NewExitError("specify strategy and region using --strategy and --region", 2)
+						}
+						aws.SetDataRetrievalPolicy(region, c.String("strategy"), c.Int64("bytes-per-hour"))
+						return nil
+					},
+				},
+				{
+					Name:  "list-provisioned-capacity",
+					Usage: "list provisioned capacity units for expedited retrievals",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:        "region",
+							Usage:       "aws region",
+							EnvVars:     []string{"AWS_DEFAULT_REGION"},
+							Destination: &region,
+						},
+					},
+					Action: func(c *cli.Context) error {
+						if region == "" {
+							return cli.NewExitError("specify region using --region", 2)
+						}
+						aws.ListProvisionedCapacity(region)
+						return nil
+					},
+				},
+				{
+					Name:  "purchase-provisioned-capacity",
+					Usage: "purchase a provisioned capacity unit for expedited retrievals",
+					Flags: []cli.Flag{
+						&cli.BoolFlag{
+							Name:  "yes",
+							Usage: "skip the typed confirmation",
+						},
+						&cli.StringFlag{
+							Name:        "region",
+							Usage:       "aws region",
+							EnvVars:     []string{"AWS_DEFAULT_REGION"},
+							Destination: &region,
+						},
+					},
+					Action: func(c *cli.Context) error {
+						if region == "" {
+							return cli.NewExitError("specify region using --region", 2)
+						}
+						aws.PurchaseProvisionedCapacity(region, c.Bool("yes"))
+						return nil
+					},
+				},
+				{
+					Name:  "delete-archive",
 					Usage: "delete archive from vault",
 					Flags: []cli.Flag{
 						&cli.StringFlag{
@@ -509,8 +1466,9 @@ func main() {
 					},
 				},
 				{
-					Name:  "upload-archive",
-					Usage: "upload data to a bucket",
+					Name:    "upload-archive",
+					Aliases: []string{"upload"},
+					Usage:   "upload data to a bucket",
 					Flags: []cli.Flag{
 						&cli.StringFlag{
 							Name:  "name",
@@ -524,14 +1482,144 @@ func main() {
 						},
 						&cli.StringFlag{
 							Name:  "file",
-							Usage: "upload file name",
+							Value: "-",
+							Usage: "upload file name, - reads from stdin",
+						},
+						&cli.StringFlag{
+							Name:  "key",
+							Usage: "object key (default: the file name)",
+						},
+						&cli.Int64Flag{
+							Name:  "part-size",
+							Usage: "multipart part size in MiB, at least 5; S3 allows 10000 parts, so stdin and compressed or encrypted uploads are capped at 10000 x part size (default: 16, 64 when the size is unknown)",
+						},
+						&cli.IntFlag{
+							Name:  "concurrency",
+							Value: aws.DefaultConcurrency,
+							Usage: "number of parts uploaded at the same time",
+						},
+						&cli.StringFlag{
+							Name:  "compress",
+							Usage: "compress on the fly with gzip, zstd or xz",
+						},
+						&cli.IntFlag{
+							Name:  "level",
+							Usage: "compression level, 1 (fast) up to 9 for gzip and xz or 22 for zstd (default: the codec default)",
+						},
+						&cli.StringFlag{
+							Name:  "encrypt-key",
+							Usage: "encrypt with a key file made by silo keygen",
+						},
+						&cli.BoolFlag{
+							Name:  "passphrase",
+							Usage: "encrypt with a key derived from a passphrase, read from $SILO_PASSPHRASE or the terminal",
+						},
+						&cli.StringSliceFlag{
+							Name:  "recipient",
+							Usage: "encrypt to a silo-x25519: public key or key file, repeatable",
+						},
+						&cli.StringFlag{
+							Name:  "cipher",
+							Usage: "aes-256-gcm or chacha20-poly1305 (default: aes-256-gcm)",
 						},
 					},
 					Action: func(c *cli.Context) error {
-						if c.String("name") == "" || c.String("file") == "" || region == "" {
+						if c.String("name") == "" || region == "" {
 							return cli.NewExitError("specify bucket name, region and upload file using --name, --region and --file", 2)
 						}
-						aws.UploadBucket(region, c.String("name"), c.String("file"))
+						if c.String("file") == "-" && c.String("key") == "" {
+							return cli.NewExitError("specify the object key using --key when reading from stdin", 2)
+						}
+						aws.UploadBucket(region, c.String("name"), c.String("file"), aws.S3UploadOptions{
+							Key:         c.String("key"),
+							PartSize:    c.Int64("part-size") << 20,
+							Concurrency: c.Int("concurrency"),
+							Compress: aws.CompressOptions{
+								Codec: c.String("compress"),
+								Level: c.Int("level"),
+							},
+							Encrypt: aws.EncryptOptions{
+								Algorithm:  c.String("cipher"),
+								KeyFile:    c.String("encrypt-key"),
+								Passphrase: c.Bool("passphrase"),
+								Recipients: c.StringSlice("recipient"),
+							},
+						})
+						return nil
+					},
+				},
+				{
+					Name:  "get-object",
+					Usage: "download an object, or every object below --prefix, and verify it",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "name",
+							Usage: "bucket name",
+						},
+						&cli.StringFlag{
+							Name:  "key",
+							Usage: "object key",
+						},
+						&cli.StringFlag{
+							Name:  "prefix",
+							Usage: "download every object below this prefix, keeping the key layout",
+						},
+						&cli.StringFlag{
+							Name:  "file",
+							Usage: "destination file, or directory with --prefix (default: the key name without .enc and codec extensions, or .)",
+						},
+						&cli.Int64Flag{
+							Name:  "part-size",
+							Value: aws.DefaultS3PartSize >> 20,
+							Usage: "size in MiB of each ranged request",
+						},
+						&cli.IntFlag{
+							Name:  "concurrency",
+							Value: aws.DefaultConcurrency,
+							Usage: "number of ranged requests per object in flight",
+						},
+						&cli.IntFlag{
+							Name:  "parallel",
+							Value: aws.DefaultParallel,
+							Usage: "number of objects downloaded at the same time with --prefix",
+						},
+						&cli.BoolFlag{
+							Name:  "overwrite",
+							Usage: "replace files that already exist",
+						},
+						&cli.StringFlag{
+							Name:  "decompress",
+							Value: aws.DecompressAuto,
+							Usage: "auto expands data uploaded with --compress, none keeps it as stored, or force gzip, zstd or xz",
+						},
+						&cli.StringSliceFlag{
+							Name:  "key-file",
+							Usage: "key file to decrypt with besides the keyring in ~/.silo/keys, repeatable",
+						},
+						&cli.StringFlag{
+							Name:        "region",
+							Usage:       "aws region",
+							EnvVars:     []string{"AWS_DEFAULT_REGION"},
+							Destination: &region,
+						},
+					},
+					Action: func(c *cli.Context) error {
+						if c.String("name") == "" || region == "" || (c.String("key") == "" && !c.IsSet("prefix")) {
+							return cli.NewExitError("specify bucket name, region and key or prefix using --name, --region and --key or --prefix", 2)
+						}
+						opts := aws.S3DownloadOptions{
+							PartSize:    c.Int64("part-size") << 20,
+							Concurrency: c.Int("concurrency"),
+							Parallel:    c.Int("parallel"),
+							Overwrite:   c.Bool("overwrite"),
+							Decompress:  c.String("decompress"),
+							Keys:        aws.DecryptOptions{KeyFiles: c.StringSlice("key-file")},
+						}
+						if c.IsSet("prefix") {
+							aws.GetObjects(region, c.String("name"), c.String("prefix"), c.String("file"), opts)
+							return nil
+						}
+						aws.GetObject(region, c.String("name"), c.String("key"), c.String("file"), opts)
 						return nil
 					},
 				},
@@ -543,6 +1631,22 @@ func main() {
 							Name:  "name",
 							Usage: "bucket name",
 						},
+						&cli.StringFlag{
+							Name:  "prefix",
+							Usage: "only list keys that begin with this prefix",
+						},
+						&cli.StringFlag{
+							Name:  "delimiter",
+							Usage: "group keys sharing a prefix up to this delimiter, e.g. /",
+						},
+						&cli.Int64Flag{
+							Name:  "max-items",
+							Usage: "stop after this many items and print the token to continue (default: list everything)",
+						},
+						&cli.StringFlag{
+							Name:  "starting-token",
+							Usage: "continue a listing from the token printed by --max-items",
+						},
 						&cli.StringFlag{
 							Name:        "region",
 							Usage:       "aws region",
@@ -554,7 +1658,7 @@ func main() {
 						if c.String("name") == "" || region == "" {
 							return cli.NewExitError("specify bucket name and region using --name and --region", 2)
 						}
-						aws.ListObjects(region, c.String("name"))
+						aws.ListObjects(region, c.String("name"), c.String("prefix"), c.String("delimiter"), aws.PageOptions{MaxItems: c.Int64("max-items"), StartingToken: c.String("starting-token")})
 						return nil
 					},
 				},
@@ -610,6 +1714,413 @@ func main() {
 				},
 			}, // end of s3 operations
 		}, // cli.Command
+		{
+			Name:  "keygen",
+			Usage: "create an encryption key in ~/.silo/keys",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "type",
+					Value: aws.KeyTypeSymmetric,
+					Usage: "symmetric for a secret key file, x25519 for a key pair whose public key others encrypt to",
+				},
+				&cli.StringFlag{
+					Name:  "out",
+					Usage: "also write the key file here",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				aws.GenerateKey(c.String("type"), c.String("out"))
+				return nil
+			},
+		},
+		{
+			Name:  "backup",
+			Usage: "stream a tar archive of directories to glacier or s3",
+			Flags: []cli.Flag{
+				&cli.StringSliceFlag{
+					Name:  "source",
+					Usage: "directory, file or glob pattern to back up, repeatable",
+				},
+				&cli.StringFlag{
+					Name:  "to",
+					Usage: "destination, glacier://vault or s3://bucket/prefix",
+				},
+				&cli.StringFlag{
+					Name:  "name",
+					Usage: "archive name (default: the first source and the time)",
+				},
+				&cli.Int64Flag{
+					Name:  "part-size",
+					Usage: "multipart part size in MiB; a stream is capped at 10000 parts, so at 10000 x part size (default: 64)",
+				},
+				&cli.IntFlag{
+					Name:  "concurrency",
+					Value: aws.DefaultConcurrency,
+					Usage: "number of parts uploaded at the same time",
+				},
+				&cli.StringFlag{
+					Name:  "compress",
+					Usage: "compress on the fly with gzip, zstd or xz",
+				},
+				&cli.IntFlag{
+					Name:  "level",
+					Usage: "compression level, 1 (fast) up to 9 for gzip and xz or 22 for zstd (default: the codec default)",
+				},
+				&cli.StringFlag{
+					Name:  "encrypt-key",
+					Usage: "encrypt with a key file made by silo keygen",
+				},
+				&cli.BoolFlag{
+					Name:  "passphrase",
+					Usage: "encrypt with a key derived from a passphrase, read from $SILO_PASSPHRASE or the terminal",
+				},
+				&cli.StringSliceFlag{
+					Name:  "recipient",
+					Usage: "encrypt to a silo-x25519: public key or key file, repeatable",
+				},
+				&cli.StringFlag{
+					Name:  "cipher",
+					Usage: "aes-256-gcm or chacha20-poly1305 (default: aes-256-gcm)",
+				},
+				&cli.BoolFlag{
+					Name:  "incremental",
+					Usage: "only archive files changed since the last successful run, plus a list of deleted paths",
+				},
+				&cli.IntFlag{
+					Name:  "full-every",
+					Usage: "with --incremental, start a new full backup once a chain holds N backups (default: never)",
+				},
+				&cli.StringFlag{
+					Name:        "region",
+					Usage:       "aws region",
+					EnvVars:     []string{"AWS_DEFAULT_REGION"},
+					Destination: &region,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if len(c.StringSlice("source")) == 0 || c.String("to") == "" || region == "" {
+					return cli.NewExitError("specify sources, destination and region using --source, --to and --region", 2)
+				}
+				aws.Backup(region, aws.BackupOptions{
+					Sources: c.StringSlice("source"),
+					To:      c.String("to"),
+					Name:    c.String("name"),
+					Upload: aws.UploadOptions{
+						PartSize:    c.Int64("part-size") << 20,
+						Concurrency: c.Int("concurrency"),
+					},
+					S3: aws.S3UploadOptions{
+						PartSize:    c.Int64("part-size") << 20,
+						Concurrency: c.Int("concurrency"),
+					},
+					Compress: aws.CompressOptions{
+						Codec: c.String("compress"),
+						Level: c.Int("level"),
+					},
+					Encrypt: aws.EncryptOptions{
+						Algorithm:  c.String("cipher"),
+						KeyFile:    c.String("encrypt-key"),
+						Passphrase: c.Bool("passphrase"),
+						Recipients: c.StringSlice("recipient"),
+					},
+					Incremental: c.Bool("incremental"),
+					FullEvery:   c.Int("full-every"),
+				})
+				return nil
+			},
+		},
+		{
+			Name:  "restore-backup",
+			Usage: "rebuild a backup below a directory, replaying incremental chains from the full backup",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "name",
+					Usage: "name of the backup to restore",
+				},
+				&cli.StringFlag{
+					Name:  "from",
+					Usage: "backup destination, s3://bucket/prefix, needed when the manifests are not in ~/.silo/backups",
+				},
+				&cli.StringFlag{
+					Name:  "target",
+					Usage: "directory the backup is restored below",
+				},
+				&cli.StringFlag{
+					Name:  "tier",
+					Value: "standard",
+					Usage: "retrieval tier for backups in glacier: expedited, standard or bulk",
+				},
+				&cli.DurationFlag{
+					Name:  "poll-interval",
+					Value: aws.DefaultPollInterval,
+					Usage: "first wait between job status checks, doubled up to --max-poll-interval",
+				},
+				&cli.DurationFlag{
+					Name:  "max-poll-interval",
+					Value: aws.DefaultMaxPollInterval,
+					Usage: "longest wait between job status checks",
+				},
+				&cli.StringSliceFlag{
+					Name:  "key-file",
+					Usage: "key file to decrypt with besides the keyring in ~/.silo/keys, repeatable",
+				},
+				&cli.StringFlag{
+					Name:        "region",
+					Usage:       "aws region",
+					EnvVars:     []string{"AWS_DEFAULT_REGION"},
+					Destination: &region,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if c.String("name") == "" || c.String("target") == "" || region == "" {
+					return cli.NewExitError("specify backup name, target and region using --name, --target and --region", 2)
+				}
+				aws.RestoreBackup(region, aws.RestoreBackupOptions{
+					Name:   c.String("name"),
+					From:   c.String("from"),
+					Target: c.String("target"),
+					Tier:   c.String("tier"),
+					Poll: aws.PollOptions{
+						Interval:    c.Duration("poll-interval"),
+						MaxInterval: c.Duration("max-poll-interval"),
+					},
+					Keys: aws.DecryptOptions{KeyFiles: c.StringSlice("key-file")},
+				})
+				return nil
+			},
+		},
+		{
+			Name:  "repo",
+			Usage: "deduplicated snapshots in chunked pack files on glacier or s3",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "init",
+					Usage: "create a repository",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "repo",
+							Usage: "where the config, indexes and snapshots live, a local directory or s3://bucket/prefix",
+						},
+						&cli.StringFlag{
+							Name:  "packs",
+							Usage: "where the pack files go, glacier://vault or s3://bucket/prefix (default: --repo when it is in s3)",
+						},
+						&cli.IntFlag{
+							Name:  "avg-chunk-size",
+							Value: aws.DefaultAvgChunkSize >> 10,
+							Usage: "average chunk size in KiB, a power of two",
+						},
+						&cli.IntFlag{
+							Name:  "pack-size",
+							Value: aws.DefaultPackSize >> 20,
+							Usage: "chunk data collected into each pack in MiB",
+						},
+						&cli.StringFlag{
+							Name:  "compress",
+							Value: aws.CompressZstd,
+							Usage: "compress packs with gzip, zstd or xz, or none",
+						},
+						&cli.IntFlag{
+							Name:  "level",
+							Usage: "compression level (default: the codec default)",
+						},
+						&cli.StringFlag{
+							Name:        "region",
+							Usage:       "aws region",
+							EnvVars:     []string{"AWS_DEFAULT_REGION"},
+							Destination: &region,
+						},
+					},
+					Action: func(c *cli.Context) error {
+						if c.String("repo") == "" || region == "" {
+							return cli.NewExitError("specify repository and region using --repo and --region", 2)
+						}
+						codec := c.String("compress")
+						if codec == aws.DecompressNone {
+							codec = ""
+						}
+						aws.RepoInit(region, aws.RepoInitOptions{
+							Repo:         c.String("repo"),
+							Packs:        c.String("packs"),
+							AvgChunkSize: c.Int("avg-chunk-size") << 10,
+							PackSize:     c.Int("pack-size") << 20,
+							Compress: aws.CompressOptions{
+								Codec: codec,
+								Level: c.Int("level"),
+							},
+						})
+						return nil
+					},
+				},
+				{
+					Name:  "backup",
+					Usage: "snapshot directories, uploading only chunks the repository does not hold",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "repo",
+							Usage: "repository location given to repo init",
+						},
+						&cli.StringSliceFlag{
+							Name:  "source",
+							Usage: "directory, file or glob pattern to back up, repeatable",
+						},
+						&cli.Int64Flag{
+							Name:  "part-size",
+							Usage: "multipart part size in MiB; a stream is capped at 10000 parts, so at 10000 x part size (default: 64)",
+						},
+						&cli.IntFlag{
+							Name:  "concurrency",
+							Value: aws.DefaultConcurrency,
+							Usage: "number of parts uploaded at the same time",
+						},
+						&cli.StringFlag{
+							Name:  "encrypt-key",
+							Usage: "encrypt with a key file made by silo keygen",
+						},
+						&cli.BoolFlag{
+							Name:  "passphrase",
+							Usage: "encrypt with a key derived from a passphrase, read from $SILO_PASSPHRASE or the terminal",
+						},
+						&cli.StringSliceFlag{
+							Name:  "recipient",
+							Usage: "encrypt to a silo-x25519: public key or key file, repeatable",
+						},
+						&cli.StringFlag{
+							Name:  "cipher",
+							Usage: "aes-256-gcm or chacha20-poly1305 (default: aes-256-gcm)",
+						},
+						&cli.StringSliceFlag{
+							Name:  "key-file",
+							Usage: "key file that opens the chunk IDs of earlier encrypted packs besides --encrypt-key and the keyring in ~/.silo/keys, repeatable",
+						},
+						&cli.BoolFlag{
+							Name:  "clear-chunk-ids",
+							Usage: "with --recipient only, store the chunk IDs of new packs unencrypted so later backups deduplicate without the private key; the IDs are SHA-256 hashes that reveal whether a known file is in the repository",
+						},
+						&cli.StringFlag{
+							Name:        "region",
+							Usage:       "aws region",
+							EnvVars:     []string{"AWS_DEFAULT_REGION"},
+							Destination: &region,
+						},
+					},
+					Action: func(c *cli.Context) error {
+						if c.String("repo") == "" || len(c.StringSlice("source")) == 0 || region == "" {
+							return cli.NewExitError("specify repository, sources and region using --repo, --source and --region", 2)
+						}
+						aws.RepoBackup(region, aws.RepoBackupOptions{
+							Repo:    c.String("repo"),
+							Sources: c.StringSlice("source"),
+							Upload: aws.UploadOptions{
+								PartSize:    c.Int64("part-size") << 20,
+								Concurrency: c.Int("concurrency"),
+							},
+							S3: aws.S3UploadOptions{
+								PartSize:    c.Int64("part-size") << 20,
+								Concurrency: c.Int("concurrency"),
+							},
+							Encrypt: aws.EncryptOptions{
+								Algorithm:  c.String("cipher"),
+								KeyFile:    c.String("encrypt-key"),
+								Passphrase: c.Bool("passphrase"),
+								Recipients: c.StringSlice("recipient"),
+							},
+							Keys:          aws.DecryptOptions{KeyFiles: c.StringSlice("key-file")},
+							ClearChunkIDs: c.Bool("clear-chunk-ids"),
+						})
+						return nil
+					},
+				},
+				{
+					Name:  "snapshots",
+					Usage: "list the snapshots of a repository",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "repo",
+							Usage: "repository location given to repo init",
+						},
+						&cli.StringSliceFlag{
+							Name:  "key-file",
+							Usage: "key file to decrypt with besides the keyring in ~/.silo/keys, repeatable",
+						},
+						&cli.StringFlag{
+							Name:        "region",
+							Usage:       "aws region",
+							EnvVars:     []string{"AWS_DEFAULT_REGION"},
+							Destination: &region,
+						},
+					},
+					Action: func(c *cli.Context) error {
+						if c.String("repo") == "" || region == "" {
+							return cli.NewExitError("specify repository and region using --repo and --region", 2)
+						}
+						aws.ListSnapshots(region, c.String("repo"), aws.DecryptOptions{KeyFiles: c.StringSlice("key-file")})
+						return nil
+					},
+				},
+				{
+					Name:  "restore",
+					Usage: "recreate a snapshot below a directory",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "repo",
+							Usage: "repository location given to repo init",
+						},
+						&cli.StringFlag{
+							Name:  "snapshot",
+							Value: "latest",
+							Usage: "snapshot ID, a unique prefix of one, or latest",
+						},
+						&cli.StringFlag{
+							Name:  "target",
+							Usage: "directory the snapshot is restored below",
+						},
+						&cli.StringFlag{
+							Name:  "tier",
+							Value: "standard",
+							Usage: "retrieval tier for packs in glacier: expedited, standard or bulk",
+						},
+						&cli.DurationFlag{
+							Name:  "poll-interval",
+							Value: aws.DefaultPollInterval,
+							Usage: "first wait between job status checks, doubled up to --max-poll-interval",
+						},
+						&cli.DurationFlag{
+							Name:  "max-poll-interval",
+							Value: aws.DefaultMaxPollInterval,
+							Usage: "longest wait between job status checks",
+						},
+						&cli.StringSliceFlag{
+							Name:  "key-file",
+							Usage: "key file to decrypt with besides the keyring in ~/.silo/keys, repeatable",
+						},
+						&cli.StringFlag{
+							Name:        "region",
+							Usage:       "aws region",
+							EnvVars:     []string{"AWS_DEFAULT_REGION"},
+							Destination: &region,
+						},
+					},
+					Action: func(c *cli.Context) error {
+						if c.String("repo") == "" || c.String("target") == "" || region == "" {
+							return cli.NewExitError("specify repository, target and region using --repo, --target and --region", 2)
+						}
+						aws.RepoRestore(region, aws.RepoRestoreOptions{
+							Repo:     c.String("repo"),
+							Snapshot: c.String("snapshot"),
+							Target:   c.String("target"),
+							Tier:     c.String("tier"),
+							Poll: aws.PollOptions{
+								Interval:    c.Duration("poll-interval"),
+								MaxInterval: c.Duration("max-poll-interval"),
+							},
+							Keys: aws.DecryptOptions{KeyFiles: c.StringSlice("key-file")},
+						})
+						return nil
+					},
+				},
+			}, // end of repo operations
+		},
 	} // app.Commands
 
 	err := app.Run(os.Args)